@@ -0,0 +1,67 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"maps"
+	"sync"
+	"time"
+)
+
+// Alert describes a timeout rate that crossed the threshold configured with [WithAlert].
+type Alert struct {
+	// Start is the beginning of the one-minute window during which the threshold was crossed.
+	Start time.Time
+	// Routes is the number of timeouts per route, keyed by [RouteKey].
+	Routes map[string]int
+	// Timeouts is the number of timeouts observed so far in the window.
+	Timeouts int
+}
+
+// AlertFunc is a function invoked when the timeout rate crosses a threshold, see [WithAlert].
+type AlertFunc func(a Alert)
+
+// alertWatcher counts timeouts in one-minute tumbling windows and fires at most once per window. It is only
+// updated on the timeout path, so locking does not slow down requests completing in time.
+type alertWatcher struct {
+	fn        AlertFunc
+	routes    map[string]int
+	minute    int64
+	threshold int
+	count     int
+	mu        sync.Mutex
+}
+
+func newAlertWatcher(threshold int, fn AlertFunc) *alertWatcher {
+	return &alertWatcher{
+		fn:        fn,
+		threshold: threshold,
+		routes:    make(map[string]int),
+	}
+}
+
+func (w *alertWatcher) record(now time.Time, route string) {
+	minute := now.Unix() / 60
+	w.mu.Lock()
+	if minute != w.minute {
+		w.minute = minute
+		w.count = 0
+		clear(w.routes)
+	}
+	w.count++
+	w.routes[route]++
+	if w.count != w.threshold {
+		w.mu.Unlock()
+		return
+	}
+	a := Alert{
+		Start:    time.Unix(minute*60, 0),
+		Routes:   maps.Clone(w.routes),
+		Timeouts: w.count,
+	}
+	w.mu.Unlock()
+
+	go w.fn(a)
+}
@@ -0,0 +1,53 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"net/http"
+)
+
+// Behavior defines how the middleware signals a timeout to the client, see [WithProtocolBehavior].
+type Behavior uint8
+
+const (
+	// BehaviorRespond sends the timeout response.
+	BehaviorRespond Behavior = iota + 1
+	// BehaviorClose sends the timeout response and closes the connection, like [WithCloseOnTimeout]. The connection
+	// is only closed for HTTP/1.x requests.
+	BehaviorClose
+	// BehaviorAbort aborts the response without writing anything, like [WithAbortOnTimeout]. The server closes the
+	// connection with HTTP/1.x, and resets the stream with HTTP/2 and HTTP/3.
+	BehaviorAbort
+)
+
+// String returns the name of the behavior.
+func (b Behavior) String() string {
+	switch b {
+	case BehaviorRespond:
+		return "respond"
+	case BehaviorClose:
+		return "close"
+	case BehaviorAbort:
+		return "abort"
+	default:
+		return "unknown"
+	}
+}
+
+// behavior returns the timeout behavior for the protocol of the request. A behavior configured for the protocol
+// takes precedence over [WithAbortOnTimeout] and [WithCloseOnTimeout].
+func (t *Timeout) behavior(r *http.Request) Behavior {
+	if b, ok := t.cfg.behaviors[r.ProtoMajor]; ok {
+		return b
+	}
+	switch {
+	case t.cfg.abort:
+		return BehaviorAbort
+	case t.cfg.closeConn:
+		return BehaviorClose
+	default:
+		return BehaviorRespond
+	}
+}
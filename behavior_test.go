@@ -0,0 +1,110 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"bufio"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tigerwill90/fox"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMiddleware_WithProtocolBehavior(t *testing.T) {
+	f, err := fox.New(
+		fox.WithMiddleware(
+			fox.Recovery(),
+			Middleware(
+				50*time.Microsecond,
+				WithCloseOnTimeout(true),
+				WithProtocolBehavior(2, BehaviorAbort),
+				WithProtocolBehavior(3, BehaviorRespond),
+			),
+		),
+	)
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo", success201response)
+
+	cases := []struct {
+		name      string
+		major     int
+		wantAbort bool
+		wantConn  string
+	}{
+		{
+			name:     "http/1.1 falls back to close",
+			major:    1,
+			wantConn: "close",
+		},
+		{
+			name:      "http/2 aborts",
+			major:     2,
+			wantAbort: true,
+		},
+		{
+			name:  "http/3 responds",
+			major: 3,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+			req.ProtoMajor = tc.major
+			w := httptest.NewRecorder()
+			if tc.wantAbort {
+				assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+					f.ServeHTTP(w, req)
+				})
+				assert.Empty(t, w.Body.String())
+				return
+			}
+			f.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+			assert.Equal(t, tc.wantConn, w.Header().Get("Connection"))
+		})
+	}
+}
+
+// h3Writer mimics the capabilities of an HTTP/3 response writer, which can't be hijacked.
+type h3Writer struct {
+	fox.ResponseWriter
+	deadlines int
+}
+
+func (w *h3Writer) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, fox.ErrNotSupported()
+}
+
+func (w *h3Writer) SetReadDeadline(_ time.Time) error {
+	w.deadlines++
+	return nil
+}
+
+func TestMiddleware_HTTP3(t *testing.T) {
+	var hw *h3Writer
+	h3 := func(next fox.HandlerFunc) fox.HandlerFunc {
+		return func(c fox.Context) {
+			hw = &h3Writer{ResponseWriter: c.Writer()}
+			cp := c.CloneWith(hw, c.Request())
+			defer cp.Close()
+			next(cp)
+		}
+	}
+
+	f, err := fox.New(fox.WithMiddleware(h3, Middleware(50*time.Microsecond)))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo", success201response)
+	req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	req.ProtoMajor, req.ProtoMinor, req.Proto = 3, 0, "HTTP/3.0"
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Zero(t, hw.deadlines)
+}
@@ -0,0 +1,115 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"runtime"
+	"sync"
+	"time"
+)
+
+const (
+	// bundleLatencies is the number of recent latencies kept per route for the diagnostics bundle.
+	bundleLatencies = 64
+	// maxBundleStacks bounds the size of the goroutine stacks captured in the diagnostics bundle.
+	maxBundleStacks = 1 << 20
+)
+
+// Bundle is a diagnostics bundle describing the state of the process when a route repeatedly timed out, see
+// [WithDiagnosticsBundle]. It is meant to be attached to incidents.
+type Bundle struct {
+	// Time is the time at which the bundle was captured.
+	Time time.Time
+	// Route is the route that timed out, keyed by [RouteKey].
+	Route string
+	// Latencies are the most recent request durations observed on the route, oldest first, including those that
+	// exceeded their deadline.
+	Latencies []time.Duration
+	// Stacks holds the stack traces of all goroutines, truncated to 1MB.
+	Stacks []byte
+	// Timeouts is the number of timeouts observed on the route within the window.
+	Timeouts int
+	// Goroutines is the number of goroutines that currently exist.
+	Goroutines int
+}
+
+// BundleFunc is a function invoked with a diagnostics bundle, see [WithDiagnosticsBundle].
+type BundleFunc func(b Bundle)
+
+// bundleWatcher tracks recent latencies and timeouts per route, and captures a diagnostics bundle the first time
+// a route reaches the threshold within the window.
+type bundleWatcher struct {
+	fn        BundleFunc
+	routes    sync.Map
+	window    time.Duration
+	threshold int
+}
+
+type routeTrace struct {
+	timeouts  []time.Time
+	latencies [bundleLatencies]time.Duration
+	n         int
+	mu        sync.Mutex
+	fired     bool
+}
+
+func newBundleWatcher(threshold int, window time.Duration, fn BundleFunc) *bundleWatcher {
+	return &bundleWatcher{
+		fn:        fn,
+		window:    window,
+		threshold: threshold,
+	}
+}
+
+func (w *bundleWatcher) record(now time.Time, route string, elapsed time.Duration, timeout bool) {
+	v, ok := w.routes.Load(route)
+	if !ok {
+		v, _ = w.routes.LoadOrStore(route, new(routeTrace))
+	}
+	rt := v.(*routeTrace)
+
+	rt.mu.Lock()
+	rt.latencies[rt.n%bundleLatencies] = elapsed
+	rt.n++
+	if !timeout || rt.fired {
+		rt.mu.Unlock()
+		return
+	}
+	cutoff := now.Add(-w.window)
+	i := 0
+	for i < len(rt.timeouts) && !rt.timeouts[i].After(cutoff) {
+		i++
+	}
+	rt.timeouts = append(rt.timeouts[i:], now)
+	if len(rt.timeouts) < w.threshold {
+		rt.mu.Unlock()
+		return
+	}
+	rt.fired = true
+	b := Bundle{
+		Time:      now,
+		Route:     route,
+		Timeouts:  len(rt.timeouts),
+		Latencies: rt.recentLatencies(),
+	}
+	rt.timeouts = nil
+	rt.mu.Unlock()
+
+	go func() {
+		b.Goroutines = runtime.NumGoroutine()
+		buf := make([]byte, maxBundleStacks)
+		b.Stacks = buf[:runtime.Stack(buf, true)]
+		w.fn(b)
+	}()
+}
+
+func (rt *routeTrace) recentLatencies() []time.Duration {
+	n := min(rt.n, bundleLatencies)
+	latencies := make([]time.Duration, 0, n)
+	for i := rt.n - n; i < rt.n; i++ {
+		latencies = append(latencies, rt.latencies[i%bundleLatencies])
+	}
+	return latencies
+}
@@ -0,0 +1,56 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tigerwill90/fox"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMiddleware_WithDiagnosticsBundle(t *testing.T) {
+	bundles := make(chan Bundle, 2)
+	f, err := fox.New(fox.WithMiddleware(Middleware(
+		20*time.Millisecond,
+		WithDiagnosticsBundle(2, time.Minute, func(b Bundle) {
+			bundles <- b
+		}),
+	)))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo/{id}", func(c fox.Context) {
+		if c.Param("id") == "fast" {
+			_ = c.String(http.StatusOK, "ok")
+			return
+		}
+		<-c.Request().Context().Done()
+	})
+
+	for _, path := range []string{"/foo/fast", "/foo/1", "/foo/2", "/foo/3", "/foo/4"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, req)
+	}
+
+	select {
+	case b := <-bundles:
+		assert.Equal(t, "GET /foo/{id}", b.Route)
+		assert.Equal(t, 2, b.Timeouts)
+		assert.Len(t, b.Latencies, 3)
+		assert.Positive(t, b.Goroutines)
+		assert.Contains(t, string(b.Stacks), "goroutine")
+	case <-time.After(time.Second):
+		t.Fatal("no bundle captured")
+	}
+
+	select {
+	case <-bundles:
+		t.Fatal("bundle captured twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultHintsRoundTrips   = 3
+	defaultHintsSlowDownlink = 1
+	defaultHintsSlowFactor   = 1.5
+)
+
+// ClientHints configures how budgets are adapted to the network conditions reported by the client with the RTT,
+// Downlink and Save-Data client hint headers, see [WithClientHints]. Budgets are only ever extended, so that
+// high-latency mobile clients aren't cut off by budgets calibrated for fast links.
+type ClientHints struct {
+	// RoundTrips is the number of client round trips added to the budget, based on the RTT hint. It defaults to 3.
+	RoundTrips int
+	// SlowDownlink is the bandwidth, in megabits per second, under which the Downlink hint denotes a slow link.
+	// It defaults to 1.
+	SlowDownlink float64
+	// SlowFactor is the factor applied to the budget for slow links and clients requesting reduced data usage with
+	// the Save-Data hint. It defaults to 1.5.
+	SlowFactor float64
+	// MaxExtra bounds the time added to the budget. It defaults to the budget itself, so a budget is at most doubled.
+	MaxExtra time.Duration
+}
+
+func (h ClientHints) withDefaults() ClientHints {
+	if h.RoundTrips <= 0 {
+		h.RoundTrips = defaultHintsRoundTrips
+	}
+	if h.SlowDownlink <= 0 {
+		h.SlowDownlink = defaultHintsSlowDownlink
+	}
+	if h.SlowFactor < 1 {
+		h.SlowFactor = defaultHintsSlowFactor
+	}
+	return h
+}
+
+// adapt extends the budget according to the client hints of the request, if any.
+func (h ClientHints) adapt(dt time.Duration, r *http.Request) time.Duration {
+	limit := h.MaxExtra
+	if limit <= 0 {
+		limit = max(dt, 0)
+	}
+
+	// The hints are sent by the client, so each extension is capped to the limit before it is added, rather than
+	// overflowing into a shorter budget.
+	var extra time.Duration
+	if rtt, err := strconv.ParseInt(r.Header.Get("RTT"), 10, 64); err == nil && rtt > 0 {
+		if rtt > int64(limit/time.Millisecond)/int64(h.RoundTrips) {
+			extra = limit
+		} else {
+			extra = time.Duration(rtt) * time.Millisecond * time.Duration(h.RoundTrips)
+		}
+	}
+	downlink, err := strconv.ParseFloat(r.Header.Get("Downlink"), 64)
+	slow := err == nil && downlink > 0 && downlink < h.SlowDownlink
+	if slow || r.Header.Get("Save-Data") == "on" {
+		if f := float64(dt) * (h.SlowFactor - 1); f >= float64(limit-extra) {
+			extra = limit
+		} else if f > 0 {
+			extra += time.Duration(f)
+		}
+	}
+
+	if extra > math.MaxInt64-dt {
+		return math.MaxInt64
+	}
+	return dt + extra
+}
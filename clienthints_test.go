@@ -0,0 +1,97 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tigerwill90/fox"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMiddleware_WithClientHints(t *testing.T) {
+	f, err := fox.New(fox.WithMiddleware(Middleware(2*time.Second, WithClientHints(ClientHints{MaxExtra: 3 * time.Second}))))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo", func(c fox.Context) {
+		dl, ok := c.Request().Context().Deadline()
+		require.True(t, ok)
+		_ = c.String(http.StatusOK, "%s", time.Until(dl).Round(100*time.Millisecond))
+	})
+
+	cases := []struct {
+		name    string
+		headers map[string]string
+		want    string
+	}{
+		{
+			name: "no hints",
+			want: "2s",
+		},
+		{
+			name:    "high rtt",
+			headers: map[string]string{"RTT": "300"},
+			want:    "2.9s",
+		},
+		{
+			name:    "save data",
+			headers: map[string]string{"Save-Data": "on"},
+			want:    "3s",
+		},
+		{
+			name:    "slow link and high rtt are bounded",
+			headers: map[string]string{"RTT": "1000", "Downlink": "0.4"},
+			want:    "5s",
+		},
+		{
+			name:    "huge rtt is bounded",
+			headers: map[string]string{"RTT": "192153584101140496"},
+			want:    "5s",
+		},
+		{
+			name:    "max rtt is bounded",
+			headers: map[string]string{"RTT": "9223372036854775807", "Save-Data": "on"},
+			want:    "5s",
+		},
+		{
+			name:    "invalid hints",
+			headers: map[string]string{"RTT": "foo", "Downlink": "10"},
+			want:    "2s",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			f.ServeHTTP(w, req)
+			assert.Equal(t, tc.want, w.Body.String())
+		})
+	}
+}
+
+func TestClientHints_Adapt(t *testing.T) {
+	h := ClientHints{}.withDefaults()
+	for _, rtt := range []string{"192153584101140496", "3074457345618258", "9223372036854775807", "6148914691236517"} {
+		t.Run(rtt, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+			req.Header.Set("RTT", rtt)
+			// Budgets are only ever extended, and at most doubled by default.
+			assert.Equal(t, 4*time.Second, h.adapt(2*time.Second, req))
+		})
+	}
+
+	// The budget saturates rather than overflows with a huge limit.
+	h = ClientHints{MaxExtra: math.MaxInt64}.withDefaults()
+	req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	req.Header.Set("RTT", "9223372036854775807")
+	assert.Equal(t, time.Duration(math.MaxInt64), h.adapt(2*time.Second, req))
+}
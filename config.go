@@ -0,0 +1,538 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/tigerwill90/fox"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Config is an immutable snapshot of the effective configuration of the middleware, see [Timeout.Config]. It allows
+// applications to assert their configuration in startup checks or to expose it on admin pages.
+type Config struct {
+	// Default is the default timeout duration of the current [Policy]. The middleware is disabled if zero or negative.
+	Default time.Duration
+	// SLO is the objective defended by the middleware, if enabled with [WithSLO].
+	SLO *SLO
+	// StatusCode is the status code of the timeout response, or zero if a custom response handler is set with
+	// [WithResponse].
+	StatusCode int
+	// ResponseTimeout bounds the execution of the response handlers, or zero if unbounded, see
+	// [WithResponseTimeout].
+	ResponseTimeout time.Duration
+	// ErrorWriteTimeout is the write deadline of the timeout response, or zero if disabled, see
+	// [WithErrorWriteTimeout].
+	ErrorWriteTimeout time.Duration
+	// HeadersOnly reports whether the timeout responses are sent with an empty body, see [WithHeadersOnly].
+	HeadersOnly bool
+	// SourceStatus is the status code of the timeout response per source of the budget, see [WithSourceStatus].
+	SourceStatus map[Source]int
+	// ReasonHeader is the name of the reason header enabled with [WithReasonHeader], or empty if disabled.
+	ReasonHeader string
+	// RetryAfter is the value of the Retry-After header set with [WithRetryAfter], or zero if disabled.
+	RetryAfter time.Duration
+	// Streaming reports whether the response is not buffered, see [WithStreaming].
+	Streaming bool
+	// Redirect reports whether timeouts are redirected to a status URL, see [WithRedirectOnTimeout].
+	Redirect bool
+	// DebugHeader is the name of the debug header enabled with [WithDebugHeader], or empty if disabled.
+	DebugHeader string
+	// PolicyHeader is the name of the policy header enabled with [WithPolicyHeader], or empty if disabled.
+	PolicyHeader string
+	// Filters is the number of filters registered with [WithFilter].
+	Filters int
+	// PartialResponse is the number of buffered bytes included in timeout events, see [WithPartialResponse].
+	PartialResponse int
+	// AlertThreshold is the number of timeouts per minute triggering the alert, or zero if disabled.
+	AlertThreshold int
+	// AdmissionFloor is the minimum budget required to admit a request, if Admission is enabled.
+	AdmissionFloor time.Duration
+	// InterimInterval is the interval between interim responses, or zero if disabled, see [WithInterimResponses].
+	InterimInterval time.Duration
+	// Clamp is the maximum budget of a request, or zero if budgets are not capped, see [WithClamp].
+	Clamp time.Duration
+	// Jitter is the fraction of the budget within which budgets are randomized, or zero if disabled, see
+	// [WithJitter].
+	Jitter float64
+	// MaxHeaderCount and MaxHeaderSize are the limits of the response headers, or zero if unbounded, see
+	// [WithHeaderLimit].
+	MaxHeaderCount int
+	MaxHeaderSize  int
+	// MicroCache is the time to live of the responses of the micro-cache, or zero if disabled, see [WithMicroCache].
+	MicroCache time.Duration
+	// ServeStale is how long expired responses of the micro-cache are served on timeout, or zero if disabled, see
+	// [WithServeStale].
+	ServeStale time.Duration
+	// Phases is the budgets of the read and write phases, see [WithPhases].
+	Phases Phases
+	// RecentTimeouts is the number of recent timeouts kept in memory, see [WithRecentTimeouts].
+	RecentTimeouts int
+	// TimerWheelTick is the tick of the timing wheel, or zero if deadlines use one runtime timer per request.
+	TimerWheelTick time.Duration
+	// ClientHints reports whether budgets are adapted to the client hints, see [WithClientHints].
+	ClientHints bool
+	// ClientPenalty reports whether the budgets of clients repeatedly exceeding their deadline are shrunk, see
+	// [WithClientPenalty].
+	ClientPenalty bool
+	// Precedence is the order in which the sources of a timeout duration are consulted, see [WithPrecedence].
+	Precedence []Source
+	// Resolver reports whether a custom [Resolver] is configured.
+	Resolver bool
+	// Admission reports whether the admission control is enabled with [WithAdmission].
+	Admission bool
+	// Hook reports whether a timeout hook is registered with [WithTimeoutHook].
+	Hook bool
+	// BeforeFlush reports whether a before flush hook is registered with [WithBeforeFlush].
+	BeforeFlush bool
+	// WarnHook reports whether a warn hook is registered with [WithWarnHook].
+	WarnHook bool
+	// Snapshot reports whether a snapshot sink is registered with [WithSnapshot].
+	Snapshot bool
+	// DiagnosticsBundle reports whether a diagnostics bundle callback is registered with [WithDiagnosticsBundle].
+	DiagnosticsBundle bool
+	// Emitter reports whether an [Emitter] is configured with [WithEmitter].
+	Emitter bool
+	// MetricLabels reports whether the route label of the metrics is controlled with [WithMetricLabels].
+	MetricLabels bool
+	// MaxMetricRoutes is the maximum number of distinct route labels of the metrics, or zero if unbounded, see
+	// [WithMetricLabels].
+	MaxMetricRoutes int
+	// DiagnosticsSampling is the fraction of the timeouts whose expensive diagnostics are captured, or zero if every
+	// timeout is captured, see [WithDiagnosticsSampling].
+	DiagnosticsSampling float64
+	// WriteDiagnostics reports whether the write diagnostics are enabled with [WithWriteDiagnostics].
+	WriteDiagnostics bool
+	// StrictWriteHeader reports whether superfluous WriteHeader calls are turned into errors, see
+	// [WithStrictWriteHeader].
+	StrictWriteHeader bool
+	// StrictLateWrites is the strict mode for writes after the deadline, "log" or "panic", or empty if disabled, see
+	// [WithStrictLateWrites].
+	StrictLateWrites string
+	// StripHopByHop reports whether the hop-by-hop headers set by handlers are stripped, see [WithStripHopByHop].
+	StripHopByHop bool
+	// ETag reports whether an ETag is computed from the buffered body, see [WithETag].
+	ETag bool
+	// ContentMD5 reports whether the Content-MD5 header is computed from the buffered body, see [WithETag].
+	ContentMD5 bool
+	// Writer reports whether a custom response writer is registered with [WithWriter].
+	Writer bool
+	// Debug reports whether the decisions made for every request are logged, see [WithDebug].
+	Debug bool
+	// AbortOnTimeout reports whether the response is aborted on timeout, see [WithAbortOnTimeout].
+	AbortOnTimeout bool
+	// CloseOnTimeout reports whether HTTP/1.x connections are closed after a timeout, see [WithCloseOnTimeout].
+	CloseOnTimeout bool
+	// ProtocolBehaviors is the timeout behavior per major protocol version, see [WithProtocolBehavior].
+	ProtocolBehaviors map[int]Behavior
+	// Maintenance reports whether the maintenance mode is currently enabled, see [Timeout.SetMaintenance].
+	Maintenance bool
+	// DisabledRoutes is the sorted patterns of the routes currently exempted from the timeout, see
+	// [Timeout.DisableRoute].
+	DisabledRoutes []string
+	// DrainFactor is the factor applied to the budget of new requests, or zero if the drain mode is disabled, see
+	// [Timeout.Drain].
+	DrainFactor float64
+}
+
+// Config returns a snapshot of the effective configuration of the middleware. The snapshot reflects the current
+// [Policy] and maintenance mode, and is not updated by later changes.
+func (t *Timeout) Config() Config {
+	_, noop := t.cfg.resolver.(noResolver)
+	cfg := Config{
+		Default:           t.policy.Load().Default,
+		StatusCode:        t.cfg.status,
+		ResponseTimeout:   t.cfg.respTimeout,
+		ErrorWriteTimeout: t.cfg.errWrite,
+		HeadersOnly:       t.cfg.headersOnly,
+		SourceStatus:      maps.Clone(t.cfg.sourceStatus),
+		ReasonHeader:      t.cfg.reasonHeader,
+		RetryAfter:        t.cfg.retryAfter,
+		Streaming:         t.cfg.stream,
+		Redirect:          t.cfg.redirect != nil,
+		DebugHeader:       t.cfg.debugHeader,
+		PolicyHeader:      t.cfg.policyHeader,
+		Filters:           len(t.cfg.filters),
+		PartialResponse:   t.cfg.partial,
+		Clamp:             t.cfg.clamp,
+		Jitter:            t.cfg.jitter,
+		Phases:            t.cfg.phases,
+		MicroCache:        t.cfg.cache.timeToLive(),
+		ServeStale:        t.cfg.staleWindow(),
+		RecentTimeouts:    t.cfg.recent.capacity(),
+		ClientHints:       t.cfg.hints != nil,
+		ClientPenalty:     t.cfg.penalty != nil,
+		Precedence:        slices.Clone(t.cfg.precedence),
+		Resolver:          !noop,
+		Hook:              t.cfg.hook != nil,
+		WarnHook:          t.cfg.warnHook != nil,
+		BeforeFlush:       t.cfg.beforeFlush != nil,
+		Snapshot:          t.cfg.snapshot != nil,
+		DiagnosticsBundle: t.cfg.bundle != nil,
+		Emitter:           t.cfg.emitter != nil,
+		MetricLabels:      t.cfg.labels != nil,
+		WriteDiagnostics:  t.cfg.lateWrites != nil,
+		StrictWriteHeader: t.cfg.strictHeader,
+		StrictLateWrites:  t.cfg.strictLate.String(),
+		StripHopByHop:     t.cfg.stripHop,
+		ETag:              t.cfg.etag != nil,
+		ContentMD5:        t.cfg.etag != nil && t.cfg.etag.md5,
+		Writer:            t.cfg.writer != nil,
+		Debug:             t.cfg.debug,
+		AbortOnTimeout:    t.cfg.abort,
+		CloseOnTimeout:    t.cfg.closeConn,
+		ProtocolBehaviors: maps.Clone(t.cfg.behaviors),
+		Maintenance:       t.maintenance.Load() != nil,
+	}
+	if t.cfg.labels != nil {
+		cfg.MaxMetricRoutes = int(t.cfg.labels.max)
+	}
+	if t.cfg.sampling != nil {
+		cfg.DiagnosticsSampling = t.cfg.sampling.rate
+	}
+	if l := t.cfg.headerLimits; l != nil {
+		cfg.MaxHeaderCount, cfg.MaxHeaderSize = l.count, l.size
+	}
+	if m := t.disabled.Load(); m != nil {
+		cfg.DisabledRoutes = slices.Sorted(maps.Keys(*m))
+	}
+	if t.slo != nil {
+		slo := t.slo.slo
+		cfg.SLO = &slo
+	}
+	if t.cfg.alert != nil {
+		cfg.AlertThreshold = t.cfg.alert.threshold
+	}
+	if t.cfg.admission != nil {
+		cfg.Admission = true
+		cfg.AdmissionFloor = t.cfg.admission.floor
+	}
+	if t.cfg.wheel != nil {
+		cfg.TimerWheelTick = t.cfg.wheel.tick
+	}
+	if t.cfg.interim != nil {
+		cfg.InterimInterval = t.cfg.interim.interval
+	}
+	if factor := t.drain.Load(); factor != nil {
+		cfg.DrainFactor = *factor
+	}
+	return cfg
+}
+
+// String returns a summary of the effective configuration of the middleware, listing only the enabled features,
+// for inclusion in startup logs (e.g. "foxtimeout{default=2s resolver slo=0.999 maintenance}").
+func (t *Timeout) String() string {
+	c := t.Config()
+	var sb strings.Builder
+	sb.WriteString("foxtimeout{default=")
+	sb.WriteString(c.Default.String())
+	attr := func(key string, value any) {
+		sb.WriteByte(' ')
+		sb.WriteString(key)
+		if value != nil {
+			_, _ = fmt.Fprintf(&sb, "=%v", value)
+		}
+	}
+	if c.Resolver {
+		attr("resolver", nil)
+	}
+	if c.ClientHints {
+		attr("hints", nil)
+	}
+	if c.ClientPenalty {
+		attr("penalty", nil)
+	}
+	if !slices.Equal(c.Precedence, defaultPrecedence) {
+		names := make([]string, len(c.Precedence))
+		for i, s := range c.Precedence {
+			names[i] = s.String()
+		}
+		attr("precedence", strings.Join(names, ">"))
+	}
+	if c.Filters > 0 {
+		attr("filters", c.Filters)
+	}
+	if c.SLO != nil {
+		attr("slo", c.SLO.Target)
+	}
+	if c.Clamp > 0 {
+		attr("clamp", c.Clamp)
+	}
+	if c.Jitter > 0 {
+		attr("jitter", c.Jitter)
+	}
+	if c.MaxHeaderCount > 0 {
+		attr("headers", c.MaxHeaderCount)
+	}
+	if c.MaxHeaderSize > 0 {
+		attr("headers.size", c.MaxHeaderSize)
+	}
+	if c.MicroCache > 0 {
+		attr("cache", c.MicroCache)
+	}
+	if c.ServeStale > 0 {
+		attr("stale", c.ServeStale)
+	}
+	if c.Phases.Read > 0 {
+		attr("read", c.Phases.Read)
+	}
+	if c.Phases.Write > 0 {
+		attr("write", c.Phases.Write)
+	}
+	if c.RecentTimeouts > 0 {
+		attr("recent", c.RecentTimeouts)
+	}
+	if c.InterimInterval > 0 {
+		attr("interim", c.InterimInterval)
+	}
+	if c.TimerWheelTick > 0 {
+		attr("wheel", c.TimerWheelTick)
+	}
+	if c.Admission {
+		attr("admission", c.AdmissionFloor)
+	}
+	if c.AlertThreshold > 0 {
+		attr("alert", c.AlertThreshold)
+	}
+	if c.StatusCode != 0 && c.StatusCode != http.StatusServiceUnavailable {
+		attr("status", c.StatusCode)
+	}
+	if c.ResponseTimeout > 0 {
+		attr("render", c.ResponseTimeout)
+	}
+	if c.ErrorWriteTimeout != DefaultErrorWriteTimeout {
+		attr("errwrite", c.ErrorWriteTimeout)
+	}
+	if c.HeadersOnly {
+		attr("headersonly", nil)
+	}
+	for _, src := range slices.Sorted(maps.Keys(c.SourceStatus)) {
+		attr("status."+src.String(), c.SourceStatus[src])
+	}
+	if c.ReasonHeader != "" {
+		attr("reason", c.ReasonHeader)
+	}
+	if c.RetryAfter > 0 {
+		attr("retry", c.RetryAfter)
+	}
+	if c.Streaming {
+		attr("streaming", nil)
+	}
+	if c.Redirect {
+		attr("redirect", nil)
+	}
+	if c.DebugHeader != "" {
+		attr("debug", c.DebugHeader)
+	}
+	if c.PolicyHeader != "" {
+		attr("policy", c.PolicyHeader)
+	}
+	if c.PartialResponse > 0 {
+		attr("partial", c.PartialResponse)
+	}
+	switch {
+	case c.MaxMetricRoutes > 0:
+		attr("labels", c.MaxMetricRoutes)
+	case c.MetricLabels:
+		attr("labels", nil)
+	}
+	for _, f := range []struct {
+		key string
+		on  bool
+	}{{"hook", c.Hook}, {"warn", c.WarnHook}, {"flush", c.BeforeFlush}, {"snapshot", c.Snapshot}, {"bundle", c.DiagnosticsBundle}, {"emitter", c.Emitter}, {"diagnostics", c.WriteDiagnostics}, {"strict", c.StrictWriteHeader}, {"hop", c.StripHopByHop}, {"etag", c.ETag}, {"md5", c.ContentMD5}, {"writer", c.Writer}, {"verbose", c.Debug}, {"abort", c.AbortOnTimeout}, {"close", c.CloseOnTimeout}, {"maintenance", c.Maintenance}} {
+		if f.on {
+			attr(f.key, nil)
+		}
+	}
+	if c.DiagnosticsSampling > 0 {
+		attr("sampling", c.DiagnosticsSampling)
+	}
+	if c.StrictLateWrites != "" {
+		attr("late", c.StrictLateWrites)
+	}
+	if c.DrainFactor > 0 {
+		attr("drain", c.DrainFactor)
+	}
+	if len(c.DisabledRoutes) > 0 {
+		attr("disabled", strings.Join(c.DisabledRoutes, ","))
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+// MarshalJSON encodes the effective configuration of the middleware, as returned by [Timeout.Config], for inclusion
+// in diagnostics bundles. Durations are encoded as strings (e.g. "2s") and disabled features are omitted.
+func (t *Timeout) MarshalJSON() ([]byte, error) {
+	c := t.Config()
+	v := struct {
+		Default           string         `json:"default"`
+		SLO               *sloJSON       `json:"slo,omitempty"`
+		StatusCode        int            `json:"status_code,omitempty"`
+		ResponseTimeout   string         `json:"response_timeout,omitempty"`
+		ErrorWriteTimeout string         `json:"error_write_timeout,omitempty"`
+		HeadersOnly       bool           `json:"headers_only"`
+		SourceStatus      map[string]int `json:"source_status,omitempty"`
+		ReasonHeader      string         `json:"reason_header,omitempty"`
+		RetryAfter        string         `json:"retry_after,omitempty"`
+		Streaming         bool           `json:"streaming"`
+		Redirect          bool           `json:"redirect"`
+		DebugHeader       string         `json:"debug_header,omitempty"`
+		PolicyHeader      string         `json:"policy_header,omitempty"`
+		Filters           int            `json:"filters,omitempty"`
+		PartialResponse   int            `json:"partial_response,omitempty"`
+		AlertThreshold    int            `json:"alert_threshold,omitempty"`
+		Clamp             string         `json:"clamp,omitempty"`
+		Jitter            float64        `json:"jitter,omitempty"`
+		MaxHeaderCount    int            `json:"max_header_count,omitempty"`
+		MaxHeaderSize     int            `json:"max_header_size,omitempty"`
+		MicroCache        string         `json:"micro_cache,omitempty"`
+		ServeStale        string         `json:"serve_stale,omitempty"`
+		ReadPhase         string         `json:"read_phase,omitempty"`
+		WritePhase        string         `json:"write_phase,omitempty"`
+		RecentTimeouts    int            `json:"recent_timeouts,omitempty"`
+		InterimInterval   string         `json:"interim_interval,omitempty"`
+		AdmissionFloor    *string        `json:"admission_floor,omitempty"`
+		TimerWheelTick    string         `json:"timer_wheel_tick,omitempty"`
+		ClientHints       bool           `json:"client_hints"`
+		ClientPenalty     bool           `json:"client_penalty"`
+		Precedence        []string       `json:"precedence"`
+		Resolver          bool           `json:"resolver"`
+		Hook              bool           `json:"hook"`
+		WarnHook          bool           `json:"warn_hook"`
+		BeforeFlush       bool           `json:"before_flush"`
+		Snapshot          bool           `json:"snapshot"`
+		Bundle            bool           `json:"diagnostics_bundle"`
+		Emitter           bool           `json:"emitter"`
+		MetricLabels      bool           `json:"metric_labels"`
+		MaxMetricRoutes   int            `json:"max_metric_routes,omitempty"`
+		Diagnostics       bool           `json:"write_diagnostics"`
+		Sampling          float64        `json:"diagnostics_sampling,omitempty"`
+		StrictHeader      bool           `json:"strict_write_header"`
+		StrictLate        string         `json:"strict_late_writes,omitempty"`
+		StripHopByHop     bool           `json:"strip_hop_by_hop"`
+		ETag              bool           `json:"etag"`
+		ContentMD5        bool           `json:"content_md5"`
+		Writer            bool           `json:"custom_writer"`
+		Debug             bool           `json:"debug"`
+		Abort             bool           `json:"abort_on_timeout"`
+		Close             bool           `json:"close_on_timeout"`
+		Maintenance       bool           `json:"maintenance"`
+		DrainFactor       float64        `json:"drain_factor,omitempty"`
+		DisabledRoutes    []string       `json:"disabled_routes,omitempty"`
+	}{
+		Default:         c.Default.String(),
+		StatusCode:      c.StatusCode,
+		HeadersOnly:     c.HeadersOnly,
+		ReasonHeader:    c.ReasonHeader,
+		Streaming:       c.Streaming,
+		Redirect:        c.Redirect,
+		DebugHeader:     c.DebugHeader,
+		PolicyHeader:    c.PolicyHeader,
+		Filters:         c.Filters,
+		PartialResponse: c.PartialResponse,
+		AlertThreshold:  c.AlertThreshold,
+		RecentTimeouts:  c.RecentTimeouts,
+		MaxHeaderCount:  c.MaxHeaderCount,
+		Jitter:          c.Jitter,
+		MaxHeaderSize:   c.MaxHeaderSize,
+		ClientHints:     c.ClientHints,
+		ClientPenalty:   c.ClientPenalty,
+		Precedence:      make([]string, len(c.Precedence)),
+		Resolver:        c.Resolver,
+		Hook:            c.Hook,
+		WarnHook:        c.WarnHook,
+		BeforeFlush:     c.BeforeFlush,
+		Snapshot:        c.Snapshot,
+		Bundle:          c.DiagnosticsBundle,
+		Emitter:         c.Emitter,
+		MetricLabels:    c.MetricLabels,
+		MaxMetricRoutes: c.MaxMetricRoutes,
+		Diagnostics:     c.WriteDiagnostics,
+		Sampling:        c.DiagnosticsSampling,
+		StrictHeader:    c.StrictWriteHeader,
+		StrictLate:      c.StrictLateWrites,
+		StripHopByHop:   c.StripHopByHop,
+		ETag:            c.ETag,
+		ContentMD5:      c.ContentMD5,
+		Writer:          c.Writer,
+		Debug:           c.Debug,
+		Abort:           c.AbortOnTimeout,
+		Close:           c.CloseOnTimeout,
+		Maintenance:     c.Maintenance,
+		DrainFactor:     c.DrainFactor,
+		DisabledRoutes:  c.DisabledRoutes,
+	}
+	for i, s := range c.Precedence {
+		v.Precedence[i] = s.String()
+	}
+	if len(c.SourceStatus) > 0 {
+		v.SourceStatus = make(map[string]int, len(c.SourceStatus))
+		for src, code := range c.SourceStatus {
+			v.SourceStatus[src.String()] = code
+		}
+	}
+	if c.SLO != nil {
+		v.SLO = &sloJSON{
+			Target:    c.SLO.Target,
+			Window:    c.SLO.Window.String(),
+			MinFactor: c.SLO.MinFactor,
+			MaxFactor: c.SLO.MaxFactor,
+		}
+	}
+	if c.Admission {
+		floor := c.AdmissionFloor.String()
+		v.AdmissionFloor = &floor
+	}
+	if c.RetryAfter > 0 {
+		v.RetryAfter = c.RetryAfter.String()
+	}
+	if c.ResponseTimeout > 0 {
+		v.ResponseTimeout = c.ResponseTimeout.String()
+	}
+	if c.ErrorWriteTimeout > 0 {
+		v.ErrorWriteTimeout = c.ErrorWriteTimeout.String()
+	}
+	if c.TimerWheelTick > 0 {
+		v.TimerWheelTick = c.TimerWheelTick.String()
+	}
+	if c.Clamp > 0 {
+		v.Clamp = c.Clamp.String()
+	}
+	if c.MicroCache > 0 {
+		v.MicroCache = c.MicroCache.String()
+	}
+	if c.ServeStale > 0 {
+		v.ServeStale = c.ServeStale.String()
+	}
+	if c.Phases.Read > 0 {
+		v.ReadPhase = c.Phases.Read.String()
+	}
+	if c.Phases.Write > 0 {
+		v.WritePhase = c.Phases.Write.String()
+	}
+	if c.InterimInterval > 0 {
+		v.InterimInterval = c.InterimInterval.String()
+	}
+	return json.Marshal(v)
+}
+
+type sloJSON struct {
+	Target    float64 `json:"target"`
+	Window    string  `json:"window"`
+	MinFactor float64 `json:"min_factor"`
+	MaxFactor float64 `json:"max_factor"`
+}
+
+// noResolver is the [Resolver] used when none is configured.
+type noResolver struct{}
+
+func (noResolver) Resolve(fox.Context) (time.Duration, bool) {
+	return 0, false
+}
@@ -0,0 +1,99 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tigerwill90/fox"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestTimeout_Config(t *testing.T) {
+	assert.Equal(t, Config{Default: time.Second, StatusCode: http.StatusServiceUnavailable, ErrorWriteTimeout: DefaultErrorWriteTimeout, Precedence: defaultPrecedence}, New(time.Second).Config())
+
+	tm := New(
+		time.Second,
+		WithFilter(func(c fox.Context) bool { return false }),
+		WithTimeoutResolver(TimeoutResolverFunc(func(c fox.Context) (time.Duration, bool) { return 0, false })),
+		WithSLO(SLO{Target: 0.99}),
+		WithTimerWheel(0, 0),
+		WithAdmission(10*time.Millisecond, nil),
+		WithDebugHeader(""),
+	)
+	tm.SetPolicy(Policy{Default: 2 * time.Second})
+	tm.SetMaintenance(true, "")
+
+	assert.Equal(t, Config{
+		Default:           2 * time.Second,
+		StatusCode:        http.StatusServiceUnavailable,
+		ErrorWriteTimeout: DefaultErrorWriteTimeout,
+		SLO:               &SLO{Target: 0.99, Window: time.Minute, MinFactor: defaultSLOMinFactor, MaxFactor: defaultSLOMaxFactor},
+		DebugHeader:       DefaultDebugHeader,
+		Filters:           1,
+		AdmissionFloor:    10 * time.Millisecond,
+		TimerWheelTick:    defaultWheelTick,
+		Precedence:        defaultPrecedence,
+		Resolver:          true,
+		Admission:         true,
+		Maintenance:       true,
+	}, tm.Config())
+}
+
+func TestTimeout_String(t *testing.T) {
+	assert.Equal(t, "foxtimeout{default=1s}", New(time.Second).String())
+
+	tm := New(
+		2*time.Second,
+		WithTimeoutResolver(TimeoutResolverFunc(func(c fox.Context) (time.Duration, bool) { return 0, false })),
+		WithSLO(SLO{Target: 0.999}),
+		WithAdmission(10*time.Millisecond, nil),
+		WithTimeoutHook(func(c fox.Context, e *Event) {}),
+		WithPrecedence(SourceRoute, SourceRequest, SourceResolver),
+	)
+	tm.SetMaintenance(true, "")
+	assert.Equal(t, "foxtimeout{default=2s resolver precedence=route>request>resolver slo=0.999 admission=10ms hook maintenance}", tm.String())
+}
+
+func TestTimeout_MarshalJSON(t *testing.T) {
+	tm := New(time.Second, WithAdmission(0, nil), WithTimerWheel(5*time.Millisecond, 0), WithSLO(SLO{Target: 0.99}))
+	b, err := json.Marshal(tm)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"default": "1s",
+		"slo": {"target": 0.99, "window": "1m0s", "min_factor": 0.5, "max_factor": 2},
+		"admission_floor": "0s",
+		"timer_wheel_tick": "5ms",
+		"status_code": 503,
+		"error_write_timeout": "5s",
+		"headers_only": false,
+		"streaming": false,
+		"redirect": false,
+		"client_hints": false,
+		"client_penalty": false,
+		"precedence": ["request", "resolver", "route"],
+		"resolver": false,
+		"hook": false,
+		"warn_hook": false,
+		"before_flush": false,
+		"snapshot": false,
+		"diagnostics_bundle": false,
+		"emitter": false,
+		"metric_labels": false,
+		"write_diagnostics": false,
+		"strict_write_header": false,
+		"strip_hop_by_hop": false,
+		"etag": false,
+		"content_md5": false,
+		"custom_writer": false,
+		"debug": false,
+		"abort_on_timeout": false,
+		"close_on_timeout": false,
+		"maintenance": false
+	}`, string(b))
+}
@@ -0,0 +1,265 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"context"
+	"errors"
+	"github.com/tigerwill90/fox"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrTimeout is returned by helpers when the remaining time budget of the request is exhausted or insufficient.
+var ErrTimeout = errors.New("foxtimeout: insufficient time budget")
+
+// ErrWriterReleased is returned by writes attempted after the response has been sent, e.g. from a goroutine that
+// outlived the handler. The buffer is owned by the writer until it is released, so such writes are rejected rather than
+// corrupting a buffer reused by another request.
+var ErrWriterReleased = errors.New("foxtimeout: write after the response was sent")
+
+type requestTimeoutKey struct{}
+
+// WithRequestTimeout returns a copy of ctx that carries the timeout duration to apply to the request. This allows
+// an earlier middleware (e.g. authentication or tenant loader) to stamp the desired budget into the request context,
+// which the timeout middleware honors over the resolver and the default timeout. If dt is zero or negative, ctx is
+// returned unchanged.
+func WithRequestTimeout(ctx context.Context, dt time.Duration) context.Context {
+	if dt <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, requestTimeoutKey{}, dt)
+}
+
+func requestTimeout(ctx context.Context) (time.Duration, bool) {
+	dt, ok := ctx.Value(requestTimeoutKey{}).(time.Duration)
+	return dt, ok
+}
+
+type stateKey struct{}
+
+// requestState holds the per-request information of a request handled with a deadline. It is carried by the
+// context of the request passed to the next handler.
+type requestState struct {
+	start    time.Time
+	segments []Segment
+	budget   time.Duration
+	fallback fox.HandlerFunc
+	mu       sync.Mutex
+	source   Source
+	// stream reports whether the response is not buffered, see [WithStreaming] and [Stream].
+	stream bool
+	// activity is called each time the handler writes to the response, see [IdleAfter].
+	activity func()
+	// detach is called once the handler continues detached after a redirection, see [WithRedirectOnTimeout].
+	detach func()
+	// endRead ends the read phase once the handler writes to the response or returns, see [WithPhases].
+	endRead func()
+	// reading reports whether the request body is still being read within the read phase, see [WithPhases].
+	reading atomic.Bool
+	// detached counts the background tasks started with [Detach], so that [Timeout.Shutdown] waits for them.
+	detached *counter
+}
+
+func stateFrom(ctx context.Context) *requestState {
+	st, _ := ctx.Value(stateKey{}).(*requestState)
+	return st
+}
+
+// Segment describes how much of the budget a phase of the handler consumed, see [StartSegment].
+type Segment struct {
+	start time.Time
+	end   time.Time
+	// Name is the name of the phase.
+	Name string
+	// Elapsed is the duration of the phase, or the time elapsed until the deadline if the phase was still running
+	// when the deadline fired.
+	Elapsed time.Duration
+	// Running reports whether the phase was still running when the deadline fired.
+	Running bool
+}
+
+// AttemptKind identifies why the handler was invoked, see [Attempt].
+type AttemptKind uint8
+
+const (
+	// AttemptInitial is the first invocation of the handler.
+	AttemptInitial AttemptKind = iota
+	// AttemptHedge is a second invocation started for a hedgeable route, see [Hedge].
+	AttemptHedge
+	// AttemptRetry is an invocation started after the first one exceeded its sub-budget, see [Retry].
+	AttemptRetry
+)
+
+// String returns the name of the kind.
+func (k AttemptKind) String() string {
+	switch k {
+	case AttemptInitial:
+		return "initial"
+	case AttemptHedge:
+		return "hedge"
+	case AttemptRetry:
+		return "retry"
+	default:
+		return "unknown"
+	}
+}
+
+// Attempt describes how much of the budget an invocation of the handler consumed, when the request is hedged or
+// retried.
+type Attempt struct {
+	// Kind is the reason of the invocation.
+	Kind AttemptKind
+	// Start is the time elapsed between the start of the request and the invocation.
+	Start time.Duration
+	// Budget is the budget granted to the invocation: the sub-budget of the first invocation of a retried route, or
+	// the remaining budget of the request otherwise.
+	Budget time.Duration
+	// Elapsed is the duration of the invocation, until it returned, was canceled or abandoned, or until the deadline
+	// fired if it was still running.
+	Elapsed time.Duration
+	// Running reports whether the invocation was still running when the deadline fired.
+	Running bool
+	// Won reports whether the response of the invocation was sent.
+	Won bool
+}
+
+// StartSegment marks the beginning of a named phase of the handler (e.g. "db") and returns a function that marks its
+// end. When the request exceeds its deadline, the [Event] passed to the timeout hook reports how much of the budget each
+// phase consumed, which pinpoints the culprit dependency. It is a no-op if the request is not handled with a deadline.
+//
+//	defer foxtimeout.StartSegment(c, "db")()
+func StartSegment(c fox.Context, name string) (end func()) {
+	st := stateFrom(c.Request().Context())
+	if st == nil {
+		return func() {}
+	}
+
+	st.mu.Lock()
+	i := len(st.segments)
+	st.segments = append(st.segments, Segment{Name: name, start: time.Now()})
+	st.mu.Unlock()
+
+	return func() {
+		now := time.Now()
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		if seg := &st.segments[i]; seg.end.IsZero() {
+			seg.end = now
+		}
+	}
+}
+
+// snapshotSegments returns a copy of the segments as they were at the given instant. Phases ending after that
+// instant are reported as running, since the handler may observe the deadline before the middleware does.
+func (st *requestState) snapshotSegments(at time.Time) []Segment {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if len(st.segments) == 0 {
+		return nil
+	}
+	segments := slices.Clone(st.segments)
+	for i := range segments {
+		seg := &segments[i]
+		if seg.end.IsZero() || seg.end.After(at) {
+			seg.Running = true
+			seg.Elapsed = at.Sub(seg.start)
+			continue
+		}
+		seg.Elapsed = seg.end.Sub(seg.start)
+	}
+	return segments
+}
+
+// SetFallback registers a fallback handler rendering a partial or degraded result (e.g. a cached subset) if the
+// deadline fires, instead of the timeout response. The fallback is invoked by the middleware with the original
+// [fox.Context], concurrently with the handler which may still be running, so any state shared with the handler must be
+// synchronized. A later call replaces the fallback, and a nil fallback restores the timeout response. It is a no-op if
+// the request is not handled with a deadline.
+func SetFallback(c fox.Context, fallback fox.HandlerFunc) {
+	st := stateFrom(c.Request().Context())
+	if st == nil {
+		return
+	}
+	st.mu.Lock()
+	st.fallback = fallback
+	st.mu.Unlock()
+}
+
+func (st *requestState) fallbackHandler() fox.HandlerFunc {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.fallback
+}
+
+// Detach returns a context for background work intentionally outliving the request (e.g. sending an email or
+// warming a cache), which is neither canceled by the deadline of the middleware nor when the request completes, but
+// preserves the values of the request context (e.g. trace spans or the authenticated user). Unlike a context created
+// with [context.WithoutCancel] directly, the task is tracked by the middleware: it is reported by [Stats] and
+// [Timeout.Shutdown] waits for it to finish. The returned function must be called exactly once when the task
+// completes. Detached tasks are not bounded by the middleware, so they should set their own deadline.
+//
+//	ctx, done := foxtimeout.Detach(c)
+//	go func() {
+//		defer done()
+//		// ...
+//	}()
+func Detach(c fox.Context) (context.Context, func()) {
+	ctx := context.WithoutCancel(c.Request().Context())
+	st := stateFrom(ctx)
+	if st == nil || st.detached == nil {
+		return ctx, func() {}
+	}
+	detached := st.detached
+	detached.add(1)
+	var once sync.Once
+	return ctx, func() {
+		once.Do(func() { detached.add(-1) })
+	}
+}
+
+// EffectiveTimeout returns the budget actually applied to the request, after route options, resolvers, SLO scaling and
+// client hints, so that handlers can log it or propagate it in downstream headers. It returns false if the request is
+// not handled with a deadline.
+func EffectiveTimeout(c fox.Context) (dt time.Duration, ok bool) {
+	st := stateFrom(c.Request().Context())
+	if st == nil {
+		return 0, false
+	}
+	return st.budget, true
+}
+
+// CheckRemaining returns [ErrTimeout] if the remaining time budget of the request is lower than need. Handlers can
+// call it before an expensive step to fail fast, avoiding work that can't finish anyway. It returns nil if the
+// request has no deadline.
+func CheckRemaining(c fox.Context, need time.Duration) error {
+	ctx := c.Request().Context()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return nil
+	}
+	if ctx.Err() != nil || time.Until(deadline) < need {
+		return ErrTimeout
+	}
+	return nil
+}
+
+// Portion returns a context bounded to the given fraction of the remaining time budget of the request (e.g. 0.6 for
+// 60%), so that handlers can split the deadline between their phases (e.g. database, cache and rendering)
+// consistently, whatever the budget of the request. The fraction is clamped to the [0, 1] range. If the request has no
+// deadline, the returned context is only canceled with the request. As with [context.WithTimeout], the returned
+// cancel function must be called once the phase completes.
+func Portion(c fox.Context, fraction float64) (context.Context, context.CancelFunc) {
+	ctx := c.Request().Context()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+	fraction = min(max(fraction, 0), 1)
+	remaining := time.Until(deadline)
+	return context.WithTimeout(ctx, time.Duration(float64(remaining)*fraction))
+}
@@ -0,0 +1,51 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"context"
+	"errors"
+	"github.com/tigerwill90/fox"
+	"io"
+)
+
+// Copy copies from src to dst like [io.Copy], but in chunks, checking the time budget of the request before each of
+// them. It aborts with [ErrTimeout] as soon as the budget is exhausted, or with the error of the request context if
+// the request is canceled, so that large copies (e.g. proxying a download) stop working for a request that already
+// gave up. It returns the number of bytes written. A single read or write is not interrupted, so src and dst should
+// be bounded by the request context themselves if they may block for long (e.g. an outgoing request built with
+// [http.NewRequestWithContext]).
+func Copy(c fox.Context, dst io.Writer, src io.Reader) (written int64, err error) {
+	ctx := c.Request().Context()
+	bufPtr := copyBufPool.Get().(*[]byte)
+	defer copyBufPool.Put(bufPtr)
+	buf := *bufPtr
+
+	for {
+		if err := ctx.Err(); err != nil {
+			if errors.Is(err, context.DeadlineExceeded) {
+				return written, ErrTimeout
+			}
+			return written, err
+		}
+		nr, rerr := src.Read(buf)
+		if nr > 0 {
+			nw, werr := dst.Write(buf[:nr])
+			written += int64(max(nw, 0))
+			if werr != nil {
+				return written, werr
+			}
+			if nw != nr {
+				return written, io.ErrShortWrite
+			}
+		}
+		if rerr != nil {
+			if rerr == io.EOF {
+				return written, nil
+			}
+			return written, rerr
+		}
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tigerwill90/fox"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCopy(t *testing.T) {
+	f, err := fox.New(fox.WithMiddleware(Middleware(30 * time.Millisecond)))
+	require.NoError(t, err)
+	payload := strings.Repeat("a", 100*1024)
+	f.MustHandle(http.MethodGet, "/fast", func(c fox.Context) {
+		buf := new(bytes.Buffer)
+		n, err := Copy(c, buf, strings.NewReader(payload))
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(payload)), n)
+		assert.Equal(t, payload, buf.String())
+		c.Writer().WriteHeader(http.StatusOK)
+	})
+	errs := make(chan error, 1)
+	f.MustHandle(http.MethodGet, "/slow", func(c fox.Context) {
+		// Each chunk is read slowly, so the budget is exhausted before the end of the copy.
+		n, err := Copy(c, io.Discard, &slowReader{delay: 10 * time.Millisecond, r: strings.NewReader(payload)})
+		assert.Less(t, n, int64(len(payload)))
+		errs <- err
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/fast", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/slow", nil)
+	w = httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.ErrorIs(t, <-errs, ErrTimeout)
+}
@@ -0,0 +1,86 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"github.com/tigerwill90/fox"
+	"log/slog"
+	"time"
+)
+
+// Outcomes of a request reported by the debug mode, in addition to the reasons reported by the header enabled with
+// [WithReasonHeader].
+const (
+	decisionFiltered  = "filtered"
+	decisionDisabled  = "disabled"
+	decisionCompleted = "completed"
+	decisionTimeout   = "timeout"
+	decisionCanceled  = "canceled"
+	decisionPanic     = "panic"
+	decisionCached    = "cached"
+)
+
+// decision records how the middleware handled a request, see [WithDebug]. All methods are no-op on a nil decision, so
+// that the handler records decisions unconditionally.
+type decision struct {
+	start   time.Time
+	st      *requestState
+	outcome string
+	filters int
+}
+
+// filter records the evaluation of a filter.
+func (d *decision) filter() {
+	if d != nil {
+		d.filters++
+	}
+}
+
+// resolved records the budget of the request and its source.
+func (d *decision) resolved(st *requestState) {
+	if d != nil {
+		d.st = st
+	}
+}
+
+// done records the outcome of the request.
+func (d *decision) done(outcome string) {
+	if d != nil {
+		d.outcome = outcome
+	}
+}
+
+// logDecision logs the decision made for the request at the debug level. A decision without outcome is reported as
+// a panic, since it's logged while the panic unwinds the handler.
+func (t *Timeout) logDecision(c fox.Context, d *decision) {
+	ctx := c.Request().Context()
+	if !t.cfg.logger.Enabled(ctx, slog.LevelDebug) {
+		return
+	}
+	attrs := make([]slog.Attr, 0, 8)
+	attrs = append(attrs,
+		slog.String("method", c.Request().Method),
+		slog.String("path", c.Request().URL.Path),
+	)
+	if route := c.Route(); route != nil {
+		attrs = append(attrs, slog.String("route", route.Pattern()))
+	}
+	outcome := d.outcome
+	if outcome == "" {
+		outcome = decisionPanic
+	}
+	attrs = append(attrs,
+		slog.String("outcome", outcome),
+		slog.Int("filters", d.filters),
+	)
+	if d.st != nil {
+		attrs = append(attrs,
+			slog.Duration("budget", d.st.budget),
+			slog.String("source", d.st.source.String()),
+		)
+	}
+	attrs = append(attrs, slog.Duration("elapsed", time.Since(d.start)))
+	t.cfg.logger.LogAttrs(ctx, slog.LevelDebug, "foxtimeout: request", attrs...)
+}
@@ -0,0 +1,188 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"cmp"
+	"math/rand/v2"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// maxLateWriteSites bounds the number of distinct (route, caller) pairs tracked by the write diagnostics.
+const maxLateWriteSites = 1024
+
+// maxStackSize bounds the size of the stack traces captured with [WithWriteStackSampling].
+const maxStackSize = 8 * 1024
+
+// LateWrite aggregates the writes attempted after the deadline from the same call site of the same route,
+// see [WithWriteDiagnostics].
+type LateWrite struct {
+	// Route is the route pattern, or empty if the request did not match any route.
+	Route string
+	// Function is the fully qualified name of the function that attempted the writes.
+	Function string
+	// File and Line locate the call site.
+	File string
+	Line int
+	// Count is the number of writes attempted after the deadline.
+	Count int64
+	// Bytes is the number of bytes dropped by these writes.
+	Bytes int64
+	// Stack is the most recently sampled stack trace of the goroutine attempting the writes, if enabled with
+	// [WithWriteStackSampling].
+	Stack string
+}
+
+type lateWriteSite struct {
+	route    string
+	function string
+	file     string
+	line     int
+}
+
+type lateWriteStat struct {
+	stack string
+	count int64
+	bytes int64
+}
+
+// lateWrites records the call sites of writes attempted after the deadline.
+type lateWrites struct {
+	sites map[lateWriteSite]*lateWriteStat
+	mu    sync.Mutex
+}
+
+// sampling is the fraction of the timeouts whose expensive diagnostics are captured, see [WithDiagnosticsSampling].
+type sampling struct {
+	rate float64
+}
+
+// keep reports whether the diagnostics of a timeout are captured. It always returns true if s is nil.
+func (s *sampling) keep() bool {
+	return s == nil || s.rate >= 1 || rand.Float64() < s.rate
+}
+
+func newLateWrites() *lateWrites {
+	return &lateWrites{
+		sites: make(map[lateWriteSite]*lateWriteStat),
+	}
+}
+
+// record records a write of n bytes after the deadline, and captures its stack trace for the given fraction of the
+// writes, see [WithWriteStackSampling].
+func (l *lateWrites) record(route string, n int, stackRate float64) {
+	frame := writeCaller()
+	site := lateWriteSite{route: route, function: frame.Function, file: frame.File, line: frame.Line}
+	var stack string
+	if stackRate > 0 && rand.Float64() < stackRate {
+		stack = captureStack()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s, ok := l.sites[site]
+	if !ok {
+		if len(l.sites) >= maxLateWriteSites {
+			return
+		}
+		s = new(lateWriteStat)
+		l.sites[site] = s
+	}
+	s.count++
+	s.bytes += int64(n)
+	if stack != "" {
+		s.stack = stack
+	}
+}
+
+func (l *lateWrites) report() []LateWrite {
+	l.mu.Lock()
+	report := make([]LateWrite, 0, len(l.sites))
+	for site, s := range l.sites {
+		report = append(report, LateWrite{
+			Route:    site.route,
+			Function: site.function,
+			File:     site.file,
+			Line:     site.line,
+			Count:    s.count,
+			Bytes:    s.bytes,
+			Stack:    s.stack,
+		})
+	}
+	l.mu.Unlock()
+
+	slices.SortFunc(report, func(a, b LateWrite) int {
+		return cmp.Or(
+			cmp.Compare(b.Count, a.Count),
+			cmp.Compare(a.Route, b.Route),
+			cmp.Compare(a.Function, b.Function),
+			cmp.Compare(a.Line, b.Line),
+		)
+	})
+	return report
+}
+
+// LateWrites returns the aggregated report of the writes attempted after the deadline, per route and call site,
+// ordered by decreasing number of writes. It returns nil unless [WithWriteDiagnostics] is enabled.
+func (t *Timeout) LateWrites() []LateWrite {
+	if t.cfg.lateWrites == nil {
+		return nil
+	}
+	return t.cfg.lateWrites.report()
+}
+
+// writeCaller returns the first frame of the user code that attempted a write, skipping the writer of this package,
+// fox and the standard library (e.g. fmt.Fprintf or io.Copy).
+func writeCaller() runtime.Frame {
+	pc := make([]uintptr, 32)
+	n := runtime.Callers(2, pc)
+	frames := runtime.CallersFrames(pc[:n])
+	var frame runtime.Frame
+	for {
+		f, more := frames.Next()
+		if !isWriterFrame(f.Function) && !strings.HasPrefix(f.Function, "github.com/tigerwill90/fox.") && !isStdlib(f.Function) {
+			return f
+		}
+		if !more {
+			break
+		}
+	}
+	return frame
+}
+
+// captureStack returns the stack trace of the current goroutine, truncated to maxStackSize bytes.
+func captureStack() string {
+	buf := make([]byte, maxStackSize)
+	return string(buf[:runtime.Stack(buf, false)])
+}
+
+// isWriterFrame reports whether the fully qualified function name belongs to the response writer of this package, or
+// to the reporting of its misuses.
+func isWriterFrame(function string) bool {
+	for _, prefix := range []string{".(*timeoutWriter).", ".(*Writer).", ".onlyWrite.", ".(*lateWrites).", ".writeCaller", ".(*Timeout).lateWrite."} {
+		if strings.HasPrefix(function, pkgPath+prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// isStdlib reports whether the fully qualified function name belongs to the standard library, whose import paths
+// have no dot in their first element.
+func isStdlib(function string) bool {
+	if strings.HasPrefix(function, "main.") {
+		return false
+	}
+	elem := function
+	if i := strings.IndexByte(elem, '/'); i >= 0 {
+		elem = elem[:i]
+	} else if i := strings.IndexByte(elem, '.'); i >= 0 {
+		elem = elem[:i]
+	}
+	return !strings.Contains(elem, ".")
+}
@@ -0,0 +1,83 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tigerwill90/fox"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func lateWriter(c fox.Context) {
+	<-c.Request().Context().Done()
+	// Give the middleware a chance to respond first.
+	time.Sleep(5 * time.Millisecond)
+	_, _ = fmt.Fprint(c.Writer(), "hello")
+	_, _ = fmt.Fprint(c.Writer(), "hello")
+}
+
+func TestMiddleware_WithWriteDiagnostics(t *testing.T) {
+	tm := New(10*time.Millisecond, WithWriteDiagnostics())
+	f, err := fox.New(fox.WithMiddleware(tm.Timeout))
+	require.NoError(t, err)
+	returned := make(chan struct{})
+	f.MustHandle(http.MethodGet, "/foo/{id}", func(c fox.Context) {
+		defer close(returned)
+		lateWriter(c)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/foo/1", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	<-returned
+
+	report := tm.LateWrites()
+	require.Len(t, report, 2)
+	for _, lw := range report {
+		assert.Equal(t, "/foo/{id}", lw.Route)
+		assert.Equal(t, "github.com/tigerwill90/foxtimeout.lateWriter", lw.Function)
+		assert.Contains(t, lw.File, "diagnostics_test.go")
+		assert.Equal(t, int64(1), lw.Count)
+		assert.Equal(t, int64(5), lw.Bytes)
+		assert.Empty(t, lw.Stack)
+	}
+	assert.Less(t, report[0].Line, report[1].Line)
+
+	assert.Nil(t, New(time.Second).LateWrites())
+}
+
+func TestMiddleware_WithWriteStackSampling(t *testing.T) {
+	tm := New(10*time.Millisecond, WithWriteStackSampling(1))
+	f, err := fox.New(fox.WithMiddleware(tm.Timeout))
+	require.NoError(t, err)
+	returned := make(chan struct{})
+	f.MustHandle(http.MethodGet, "/foo", func(c fox.Context) {
+		defer close(returned)
+		lateWriter(c)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	<-returned
+
+	report := tm.LateWrites()
+	require.Len(t, report, 2)
+	for _, lw := range report {
+		assert.Contains(t, lw.Stack, "foxtimeout.lateWriter")
+	}
+}
+
+func TestIsStdlib(t *testing.T) {
+	assert.True(t, isStdlib("fmt.Fprint"))
+	assert.True(t, isStdlib("net/http.(*conn).serve"))
+	assert.False(t, isStdlib("main.handler"))
+	assert.False(t, isStdlib("github.com/tigerwill90/fox.(*Router).ServeHTTP"))
+}
@@ -0,0 +1,120 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidDuration is returned by the [DurationParser] provided by this package for values they can't parse.
+var ErrInvalidDuration = errors.New("foxtimeout: invalid duration")
+
+// DurationParser parses a duration from its wire format, e.g. the value of a header, see [HeaderResolver].
+// [time.ParseDuration] is a DurationParser for Go durations (e.g. "1.5s").
+type DurationParser func(v string) (time.Duration, error)
+
+// ParseMillis parses a bare number of milliseconds (e.g. "1500"), possibly fractional (e.g. "1.5").
+func ParseMillis(v string) (time.Duration, error) {
+	ms, err := strconv.ParseFloat(v, 64)
+	if err != nil || math.IsNaN(ms) || math.IsInf(ms, 0) || strings.ContainsAny(v, "eExXpP_") {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidDuration, v)
+	}
+	return floatDuration(ms, time.Millisecond), nil
+}
+
+// ParseISO8601 parses an ISO-8601 duration (e.g. "PT1.5S" or "P1DT2H"). Years and months are rejected, since their
+// length varies. Only the seconds may be fractional.
+func ParseISO8601(v string) (time.Duration, error) {
+	s, neg := strings.CutPrefix(v, "-")
+	s, ok := strings.CutPrefix(s, "P")
+	if !ok || s == "" || s == "T" {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidDuration, v)
+	}
+
+	var (
+		d       float64
+		inTime  bool
+		designs = "WD"
+	)
+	for s != "" {
+		if s[0] == 'T' {
+			if inTime {
+				return 0, fmt.Errorf("%w: %q", ErrInvalidDuration, v)
+			}
+			inTime, designs, s = true, "HMS", s[1:]
+			if s == "" {
+				return 0, fmt.Errorf("%w: %q", ErrInvalidDuration, v)
+			}
+			continue
+		}
+		i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+		if i <= 0 {
+			return 0, fmt.Errorf("%w: %q", ErrInvalidDuration, v)
+		}
+		num, design := s[:i], s[i]
+		// Designators must appear in order and at most once, which is enforced by consuming them.
+		j := strings.IndexByte(designs, design)
+		if j < 0 || strings.Contains(num, ".") && design != 'S' {
+			return 0, fmt.Errorf("%w: %q", ErrInvalidDuration, v)
+		}
+		designs = designs[j+1:]
+		n, err := strconv.ParseFloat(num, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %q", ErrInvalidDuration, v)
+		}
+		switch design {
+		case 'W':
+			d += n * float64(7*24*time.Hour)
+		case 'D':
+			d += n * float64(24*time.Hour)
+		case 'H':
+			d += n * float64(time.Hour)
+		case 'M':
+			d += n * float64(time.Minute)
+		case 'S':
+			d += n * float64(time.Second)
+		}
+		s = s[i+1:]
+	}
+	if neg {
+		d = -d
+	}
+	return floatDuration(d, 1), nil
+}
+
+// AnyDuration returns a [DurationParser] trying each parser in order, and returning the result of the first that
+// succeeds. This accepts the formats of upstream systems that disagree on the wire format. If no parser is given,
+// bare milliseconds, Go durations and ISO-8601 durations are accepted, in this order.
+func AnyDuration(parsers ...DurationParser) DurationParser {
+	if len(parsers) == 0 {
+		parsers = []DurationParser{ParseMillis, time.ParseDuration, ParseISO8601}
+	}
+	return func(v string) (time.Duration, error) {
+		for _, parse := range parsers {
+			if d, err := parse(v); err == nil {
+				return d, nil
+			}
+		}
+		return 0, fmt.Errorf("%w: %q", ErrInvalidDuration, v)
+	}
+}
+
+// floatDuration converts n units to a duration, saturating on overflow.
+func floatDuration(n float64, unit time.Duration) time.Duration {
+	d := n * float64(unit)
+	switch {
+	case d >= math.MaxInt64:
+		return math.MaxInt64
+	case d <= math.MinInt64:
+		return math.MinInt64
+	default:
+		return time.Duration(d)
+	}
+}
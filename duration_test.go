@@ -0,0 +1,56 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestDurationParsers(t *testing.T) {
+	cases := []struct {
+		name    string
+		parse   DurationParser
+		v       string
+		want    time.Duration
+		wantErr bool
+	}{
+		{name: "millis", parse: ParseMillis, v: "1500", want: 1500 * time.Millisecond},
+		{name: "millis fractional", parse: ParseMillis, v: "1.5", want: 1500 * time.Microsecond},
+		{name: "millis overflow", parse: ParseMillis, v: "99999999999999999999", want: math.MaxInt64},
+		{name: "millis exponent", parse: ParseMillis, v: "1e3", wantErr: true},
+		{name: "millis infinity", parse: ParseMillis, v: "Inf", wantErr: true},
+		{name: "millis unit", parse: ParseMillis, v: "2s", wantErr: true},
+		{name: "iso seconds", parse: ParseISO8601, v: "PT1.5S", want: 1500 * time.Millisecond},
+		{name: "iso full", parse: ParseISO8601, v: "P1DT2H3M4S", want: 26*time.Hour + 3*time.Minute + 4*time.Second},
+		{name: "iso weeks", parse: ParseISO8601, v: "P1W", want: 7 * 24 * time.Hour},
+		{name: "iso negative", parse: ParseISO8601, v: "-PT1M", want: -time.Minute},
+		{name: "iso months", parse: ParseISO8601, v: "P1M", wantErr: true},
+		{name: "iso years", parse: ParseISO8601, v: "P1Y", wantErr: true},
+		{name: "iso order", parse: ParseISO8601, v: "PT1S2M", wantErr: true},
+		{name: "iso fractional hours", parse: ParseISO8601, v: "PT1.5H", wantErr: true},
+		{name: "iso empty time", parse: ParseISO8601, v: "P1DT", wantErr: true},
+		{name: "iso empty", parse: ParseISO8601, v: "P", wantErr: true},
+		{name: "any millis", parse: AnyDuration(), v: "250", want: 250 * time.Millisecond},
+		{name: "any go", parse: AnyDuration(), v: "1m30s", want: 90 * time.Second},
+		{name: "any iso", parse: AnyDuration(), v: "PT2S", want: 2 * time.Second},
+		{name: "any invalid", parse: AnyDuration(), v: "soon", wantErr: true},
+		{name: "any restricted", parse: AnyDuration(ParseISO8601), v: "250", wantErr: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			d, err := tc.parse(tc.v)
+			if tc.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidDuration)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, d)
+		})
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"bytes"
+	"github.com/tigerwill90/fox"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metric names sent to an [Emitter].
+const (
+	MetricRequests  = "requests"
+	MetricTimeouts  = "timeouts"
+	MetricCanceled  = "canceled"
+	MetricDuration  = "duration"
+	MetricDiscarded = "discarded_bytes"
+)
+
+// Emitter defines the interface for sending metrics to a statsd-style backend. Implementations must be safe for
+// concurrent use, as the bytes discarded after a timeout are reported from the handler goroutine.
+type Emitter interface {
+	// Count adds value to the named counter.
+	Count(name string, value int64, tags []string)
+	// Timing records a duration for the named timer.
+	Timing(name string, d time.Duration, tags []string)
+}
+
+type emitter struct {
+	e    Emitter
+	tags []string
+}
+
+func (e *emitter) emit(c fox.Context, l *labeler, o outcome, elapsed time.Duration) {
+	tags := e.tagsOf(c, l)
+
+	e.e.Count(MetricRequests, 1, tags)
+	switch o {
+	case outcomeTimeout:
+		e.e.Count(MetricTimeouts, 1, tags)
+	case outcomeCanceled:
+		e.e.Count(MetricCanceled, 1, tags)
+	}
+	e.e.Timing(MetricDuration, elapsed, tags)
+}
+
+func (e *emitter) discard(c fox.Context, l *labeler, n int64) {
+	e.e.Count(MetricDiscarded, n, e.tagsOf(c, l))
+}
+
+// tagsOf returns the tags of the metrics of the request. The route tag is computed by l if set with
+// [WithMetricLabels], and is otherwise the route pattern, or the request path if the request does not match any route.
+func (e *emitter) tagsOf(c fox.Context, l *labeler) []string {
+	var pattern string
+	switch route := c.Route(); {
+	case l != nil:
+		pattern = l.label(c)
+	case route != nil:
+		pattern = route.Pattern()
+	default:
+		pattern = c.Path()
+	}
+	tags := make([]string, 0, len(e.tags)+2)
+	tags = append(tags, e.tags...)
+	return append(tags, "route:"+pattern, "method:"+c.Request().Method)
+}
+
+// DogStatsd is an [Emitter] writing metrics in the DogStatsD datagram format. Each metric is written with a
+// single call to the underlying writer, which is typically a UDP connection obtained with net.Dial.
+type DogStatsd struct {
+	w      io.Writer
+	prefix string
+	buf    bytes.Buffer
+	mu     sync.Mutex
+}
+
+// NewDogStatsd returns a [DogStatsd] emitter writing to w. Metric names are prefixed with the given prefix
+// followed by a dot, unless the prefix is empty.
+func NewDogStatsd(w io.Writer, prefix string) *DogStatsd {
+	if prefix != "" && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+	return &DogStatsd{
+		w:      w,
+		prefix: prefix,
+	}
+}
+
+// Count sends a counter metric.
+func (d *DogStatsd) Count(name string, value int64, tags []string) {
+	d.send(name, strconv.FormatInt(value, 10), "c", tags)
+}
+
+// Timing sends a timer metric, in milliseconds.
+func (d *DogStatsd) Timing(name string, dt time.Duration, tags []string) {
+	d.send(name, strconv.FormatFloat(float64(dt)/float64(time.Millisecond), 'f', -1, 64), "ms", tags)
+}
+
+func (d *DogStatsd) send(name, value, typ string, tags []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.buf.Reset()
+	d.buf.WriteString(d.prefix)
+	d.buf.WriteString(name)
+	d.buf.WriteByte(':')
+	d.buf.WriteString(value)
+	d.buf.WriteByte('|')
+	d.buf.WriteString(typ)
+	for i, tag := range tags {
+		if i == 0 {
+			d.buf.WriteString("|#")
+		} else {
+			d.buf.WriteByte(',')
+		}
+		d.buf.WriteString(tag)
+	}
+	// Metrics are best effort.
+	_, _ = d.w.Write(d.buf.Bytes())
+}
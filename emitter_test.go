@@ -0,0 +1,83 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tigerwill90/fox"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type datagrams []string
+
+func (d *datagrams) Write(p []byte) (int, error) {
+	*d = append(*d, string(p))
+	return len(p), nil
+}
+
+func TestDogStatsd(t *testing.T) {
+	var out datagrams
+	d := NewDogStatsd(&out, "foxtimeout")
+	d.Count(MetricTimeouts, 1, []string{"env:prod", "route:/foo"})
+	d.Timing(MetricDuration, 1500*time.Microsecond, nil)
+
+	assert.Equal(t, datagrams{
+		"foxtimeout.timeouts:1|c|#env:prod,route:/foo",
+		"foxtimeout.duration:1.5|ms",
+	}, out)
+}
+
+func TestMiddleware_WithEmitter(t *testing.T) {
+	var out datagrams
+	f, err := fox.New(fox.WithMiddleware(Middleware(50*time.Microsecond, WithEmitter(NewDogStatsd(&out, ""), "env:test"))))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo/{id}", func(c fox.Context) {
+		<-c.Request().Context().Done()
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/foo/1", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+
+	require.Len(t, out, 3)
+	assert.Equal(t, "requests:1|c|#env:test,route:/foo/{id},method:GET", out[0])
+	assert.Equal(t, "timeouts:1|c|#env:test,route:/foo/{id},method:GET", out[1])
+	assert.True(t, strings.HasPrefix(out[2], "duration:"))
+}
+
+func TestMiddleware_WithMetricLabels(t *testing.T) {
+	var out datagrams
+	f, err := fox.New(fox.WithMiddleware(Middleware(time.Second, WithEmitter(NewDogStatsd(&out, "")), WithMetricLabels(nil, 2))))
+	require.NoError(t, err)
+	for _, pattern := range []string{"/foo", "/bar", "/baz"} {
+		f.MustHandle(http.MethodGet, pattern, func(c fox.Context) {
+			c.Writer().WriteHeader(http.StatusOK)
+		})
+	}
+
+	for _, path := range []string{"/foo", "/bar", "/baz", "/foo"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, req)
+	}
+
+	var routes []string
+	for _, d := range out {
+		if strings.HasPrefix(d, MetricRequests+":") {
+			routes = append(routes, d)
+		}
+	}
+	assert.Equal(t, []string{
+		"requests:1|c|#route:/foo,method:GET",
+		"requests:1|c|#route:/bar,method:GET",
+		"requests:1|c|#route:other,method:GET",
+		"requests:1|c|#route:/foo,method:GET",
+	}, routes)
+}
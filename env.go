@@ -0,0 +1,46 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Environment variables read by [NewFromEnv].
+const (
+	// EnvDefault overrides the default timeout duration (e.g. FOXTIMEOUT_DEFAULT=2s).
+	EnvDefault = "FOXTIMEOUT_DEFAULT"
+	// EnvDisabled disables the middleware entirely when set to a true value (e.g. FOXTIMEOUT_DISABLED=true).
+	EnvDisabled = "FOXTIMEOUT_DISABLED"
+)
+
+// NewFromEnv creates and initializes a new [Timeout] middleware like [New], but allows the default timeout duration
+// to be overridden by environment variables, so per-environment tuning doesn't require code changes. The given dt is
+// used as fallback when [EnvDefault] is not set. If [EnvDisabled] is set to a true value, the middleware is disabled.
+// An error is returned if any of the environment variables holds an invalid value.
+func NewFromEnv(dt time.Duration, opts ...Option) (*Timeout, error) {
+	if v, ok := os.LookupEnv(EnvDefault); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("foxtimeout: invalid %s value: %w", EnvDefault, err)
+		}
+		dt = d
+	}
+
+	if v, ok := os.LookupEnv(EnvDisabled); ok {
+		disabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("foxtimeout: invalid %s value: %w", EnvDisabled, err)
+		}
+		if disabled {
+			dt = 0
+		}
+	}
+
+	return New(dt, opts...), nil
+}
@@ -0,0 +1,61 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestNewFromEnv(t *testing.T) {
+	cases := []struct {
+		name    string
+		env     map[string]string
+		want    time.Duration
+		wantErr bool
+	}{
+		{
+			name: "fallback to given duration",
+			want: time.Second,
+		},
+		{
+			name: "override default duration",
+			env:  map[string]string{EnvDefault: "2s"},
+			want: 2 * time.Second,
+		},
+		{
+			name: "disabled",
+			env:  map[string]string{EnvDefault: "2s", EnvDisabled: "true"},
+			want: 0,
+		},
+		{
+			name:    "invalid duration",
+			env:     map[string]string{EnvDefault: "foo"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid bool",
+			env:     map[string]string{EnvDisabled: "foo"},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+			tm, err := NewFromEnv(time.Second)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, tm.Policy().Default)
+		})
+	}
+}
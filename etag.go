@@ -0,0 +1,63 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+type etagConfig struct {
+	md5 bool
+}
+
+// setETag sets a strong ETag computed from the buffered body of a successful GET response, and its Content-MD5
+// header if enabled, unless the handler already set them. HEAD responses are skipped since their body is empty.
+func (t *Timeout) setETag(r *http.Request, resp *Response) {
+	if r.Method != http.MethodGet || resp.StatusCode != http.StatusOK {
+		return
+	}
+	if resp.Header.Get("ETag") == "" {
+		sum := sha256.Sum256(resp.Body)
+		resp.Header.Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	}
+	if t.cfg.etag.md5 && resp.Header.Get("Content-MD5") == "" {
+		sum := md5.Sum(resp.Body)
+		resp.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	}
+}
+
+// notModified turns a successful GET response into a 304 Not Modified if its ETag matches the If-None-Match header of
+// the request.
+func notModified(r *http.Request, resp *Response) {
+	if r.Method != http.MethodGet || resp.StatusCode != http.StatusOK {
+		return
+	}
+	if inm, etag := r.Header.Get("If-None-Match"), resp.Header.Get("ETag"); inm != "" && etag != "" && etagMatch(inm, etag) {
+		// Like net/http, the representation headers are removed, since there is no body to describe anymore.
+		for _, k := range []string{"Content-Type", "Content-Length", "Content-Encoding", "Content-MD5", "Last-Modified"} {
+			delete(resp.Header, k)
+		}
+		resp.StatusCode = http.StatusNotModified
+		resp.Body = nil
+	}
+}
+
+// etagMatch reports whether the If-None-Match header value inm matches etag, using the weak comparison required for
+// this header.
+func etagMatch(inm, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(inm, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
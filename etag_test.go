@@ -0,0 +1,97 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tigerwill90/fox"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMiddleware_WithETag(t *testing.T) {
+	tm := New(time.Second, WithETag(true))
+	f, err := fox.New(fox.WithMiddleware(tm.Timeout))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo", func(c fox.Context) {
+		_ = c.String(http.StatusOK, "hello")
+	})
+	f.MustHandle(http.MethodGet, "/bar", func(c fox.Context) {
+		c.Writer().Header().Set("ETag", `"custom"`)
+		_ = c.String(http.StatusOK, "hello")
+	})
+	f.MustHandle(http.MethodPost, "/foo", func(c fox.Context) {
+		_ = c.String(http.StatusOK, "hello")
+	})
+	f.MustHandle(http.MethodGet, "/error", func(c fox.Context) {
+		_ = c.String(http.StatusInternalServerError, "hello")
+	})
+
+	cases := []struct {
+		method   string
+		path     string
+		wantETag string
+		wantMD5  string
+	}{
+		{method: http.MethodGet, path: "/foo", wantETag: `"2cf24dba5fb0a30e26e83b2ac5b9e29e"`, wantMD5: "XUFAKrxLKna5cZ2REBfFkg=="},
+		{method: http.MethodGet, path: "/bar", wantETag: `"custom"`, wantMD5: "XUFAKrxLKna5cZ2REBfFkg=="},
+		{method: http.MethodPost, path: "/foo"},
+		{method: http.MethodGet, path: "/error"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.method+" "+tc.path, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.path, nil)
+			w := httptest.NewRecorder()
+			f.ServeHTTP(w, req)
+			assert.Equal(t, "hello", w.Body.String())
+			assert.Equal(t, tc.wantETag, w.Header().Get("ETag"))
+			assert.Equal(t, tc.wantMD5, w.Header().Get("Content-MD5"))
+		})
+	}
+	assert.Equal(t, "foxtimeout{default=1s etag md5}", tm.String())
+}
+
+func TestMiddleware_WithETag_NotModified(t *testing.T) {
+	f, err := fox.New(fox.WithMiddleware(Middleware(time.Second, WithETag(false))))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo", func(c fox.Context) {
+		_ = c.String(http.StatusOK, "hello")
+	})
+
+	cases := []struct {
+		name string
+		inm  string
+		want int
+	}{
+		{name: "match", inm: `"2cf24dba5fb0a30e26e83b2ac5b9e29e"`, want: http.StatusNotModified},
+		{name: "weak match in list", inm: `"other", W/"2cf24dba5fb0a30e26e83b2ac5b9e29e"`, want: http.StatusNotModified},
+		{name: "wildcard", inm: "*", want: http.StatusNotModified},
+		{name: "mismatch", inm: `"other"`, want: http.StatusOK},
+		{name: "absent", want: http.StatusOK},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+			if tc.inm != "" {
+				req.Header.Set("If-None-Match", tc.inm)
+			}
+			w := httptest.NewRecorder()
+			f.ServeHTTP(w, req)
+			assert.Equal(t, tc.want, w.Code)
+			assert.Equal(t, `"2cf24dba5fb0a30e26e83b2ac5b9e29e"`, w.Header().Get("ETag"))
+			if tc.want == http.StatusNotModified {
+				assert.Empty(t, w.Body.String())
+				assert.Empty(t, w.Header().Get("Content-Type"))
+				return
+			}
+			assert.Equal(t, "hello", w.Body.String())
+		})
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"github.com/tigerwill90/fox"
+	"slices"
+)
+
+// AllOf returns a [Filter] that skips a request only if every filter skips it. Filters are evaluated in order and
+// the evaluation stops at the first filter that doesn't skip the request. Nil filters are ignored, and the returned
+// filter never skips a request if no filters are provided.
+func AllOf(filters ...Filter) Filter {
+	filters = compactFilters(filters)
+	if len(filters) == 0 {
+		return func(c fox.Context) bool { return false }
+	}
+	return func(c fox.Context) bool {
+		for _, f := range filters {
+			if !f(c) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// AnyOf returns a [Filter] that skips a request if at least one filter skips it. Filters are evaluated in order and
+// the evaluation stops at the first filter that skips the request. Nil filters are ignored.
+func AnyOf(filters ...Filter) Filter {
+	filters = compactFilters(filters)
+	return func(c fox.Context) bool {
+		for _, f := range filters {
+			if f(c) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Not returns a [Filter] that skips a request only if f doesn't skip it. If f is nil, the returned filter never skips
+// a request.
+func Not(f Filter) Filter {
+	if f == nil {
+		return func(c fox.Context) bool { return false }
+	}
+	return func(c fox.Context) bool {
+		return !f(c)
+	}
+}
+
+// compactFilters returns a copy of filters without the nil filters, so that the caller can't modify the filters of
+// a combinator after its creation.
+func compactFilters(filters []Filter) []Filter {
+	return slices.DeleteFunc(slices.Clone(filters), func(f Filter) bool {
+		return f == nil
+	})
+}
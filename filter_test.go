@@ -0,0 +1,64 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tigerwill90/fox"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFilterCombinators(t *testing.T) {
+	internal := func(c fox.Context) bool {
+		return strings.HasPrefix(c.Request().URL.Path, "/internal/")
+	}
+	get := func(c fox.Context) bool {
+		return c.Request().Method == http.MethodGet
+	}
+	export := func(c fox.Context) bool {
+		return c.Request().URL.Query().Has("export")
+	}
+
+	f, err := fox.New(fox.WithMiddleware(Middleware(
+		50*time.Microsecond,
+		WithFilter(AllOf(internal, Not(get))),
+		WithFilter(AnyOf(export, nil)),
+	)))
+	require.NoError(t, err)
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		f.MustHandle(method, "/internal/job", success201response)
+		f.MustHandle(method, "/public", success201response)
+	}
+
+	cases := []struct {
+		name   string
+		method string
+		target string
+		want   int
+	}{
+		{name: "all of", method: http.MethodPost, target: "/internal/job", want: http.StatusCreated},
+		{name: "not", method: http.MethodGet, target: "/internal/job", want: http.StatusServiceUnavailable},
+		{name: "none", method: http.MethodPost, target: "/public", want: http.StatusServiceUnavailable},
+		{name: "appended", method: http.MethodGet, target: "/public?export", want: http.StatusCreated},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.target, nil)
+			w := httptest.NewRecorder()
+			f.ServeHTTP(w, req)
+			assert.Equal(t, tc.want, w.Code)
+		})
+	}
+
+	assert.False(t, AllOf()(nil))
+	assert.False(t, AnyOf()(nil))
+	assert.False(t, Not(nil)(nil))
+}
@@ -5,6 +5,7 @@ go 1.23.0
 require (
 	github.com/stretchr/testify v1.10.0
 	github.com/tigerwill90/fox v0.20.0
+	golang.org/x/sync v0.9.0
 )
 
 require (
@@ -0,0 +1,97 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"context"
+	"github.com/tigerwill90/fox"
+	"golang.org/x/sync/errgroup"
+	"sync"
+	"time"
+)
+
+// Group is an [errgroup.Group] running the parallel sub-tasks of a fan-out handler, where each sub-task is bounded by
+// its share of the remaining time budget of the request, see [NewGroup] and [NewWeightedGroup]. As with
+// [errgroup.WithContext], the first sub-task to return an error cancels the others.
+type Group struct {
+	g         *errgroup.Group
+	ctx       context.Context
+	start     time.Time
+	remaining time.Duration
+	weights   []float64
+	total     float64
+	next      int
+	mu        sync.Mutex
+	limited   bool
+}
+
+// NewGroup returns a [Group] dividing the remaining time budget of the request equally between n sub-tasks, and the
+// context canceled when a sub-task fails or [Group.Wait] returns. If n is lower than 1, a single sub-task is expected.
+func NewGroup(c fox.Context, n int) (*Group, context.Context) {
+	weights := make([]float64, max(n, 1))
+	for i := range weights {
+		weights[i] = 1
+	}
+	return NewWeightedGroup(c, weights...)
+}
+
+// NewWeightedGroup returns a [Group] dividing the remaining time budget of the request between sub-tasks
+// proportionally to their weight (e.g. 2, 1, 1 gives half of the budget to the first sub-task, and a quarter to the
+// others), and the context canceled when a sub-task fails or [Group.Wait] returns. The weights are assigned to the
+// sub-tasks in the order they are started with [Group.Go]. Negative weights are treated as zero, and if all weights
+// are zero, the budget is divided equally.
+func NewWeightedGroup(c fox.Context, weights ...float64) (*Group, context.Context) {
+	g, ctx := errgroup.WithContext(c.Request().Context())
+	grp := &Group{
+		g:       g,
+		ctx:     ctx,
+		start:   time.Now(),
+		weights: make([]float64, len(weights)),
+	}
+	for i, w := range weights {
+		grp.weights[i] = max(w, 0)
+		grp.total += grp.weights[i]
+	}
+	if grp.total == 0 {
+		for i := range grp.weights {
+			grp.weights[i] = 1
+		}
+		grp.total = float64(len(grp.weights))
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		grp.limited = true
+		grp.remaining = deadline.Sub(grp.start)
+	}
+	return grp, ctx
+}
+
+// Go runs f in a new goroutine with a context bounded by the share of the budget of the next sub-task. If the request
+// has no deadline, the context is only canceled with the group. Go panics if it is called more times than the number
+// of sub-tasks the group was created for.
+func (g *Group) Go(f func(ctx context.Context) error) {
+	g.mu.Lock()
+	i := g.next
+	g.next++
+	g.mu.Unlock()
+	if i >= len(g.weights) {
+		panic("foxtimeout: more sub-tasks than budget shares in the group")
+	}
+
+	if !g.limited {
+		g.g.Go(func() error { return f(g.ctx) })
+		return
+	}
+	share := time.Duration(float64(g.remaining) * g.weights[i] / g.total)
+	g.g.Go(func() error {
+		ctx, cancel := context.WithDeadline(g.ctx, g.start.Add(share))
+		defer cancel()
+		return f(ctx)
+	})
+}
+
+// Wait blocks until all the sub-tasks returned, and returns the first non-nil error returned by one of them.
+func (g *Group) Wait() error {
+	return g.g.Wait()
+}
@@ -0,0 +1,72 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tigerwill90/fox"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestGroup(t *testing.T) {
+	f, err := fox.New(fox.WithMiddleware(Middleware(time.Second)))
+	require.NoError(t, err)
+
+	budgets := func(g *Group) []time.Duration {
+		out := make([]time.Duration, len(g.weights))
+		for i := range out {
+			g.Go(func(ctx context.Context) error {
+				deadline, ok := ctx.Deadline()
+				require.True(t, ok)
+				out[i] = time.Until(deadline)
+				return nil
+			})
+		}
+		require.NoError(t, g.Wait())
+		return out
+	}
+
+	f.MustHandle(http.MethodGet, "/equal", func(c fox.Context) {
+		g, _ := NewGroup(c, 4)
+		for _, dt := range budgets(g) {
+			assert.InDelta(t, 250*time.Millisecond, dt, float64(50*time.Millisecond))
+		}
+		assert.Panics(t, func() {
+			g.Go(func(ctx context.Context) error { return nil })
+		})
+	})
+	f.MustHandle(http.MethodGet, "/weighted", func(c fox.Context) {
+		g, _ := NewWeightedGroup(c, 2, 1, 1)
+		dts := budgets(g)
+		assert.InDelta(t, 500*time.Millisecond, dts[0], float64(50*time.Millisecond))
+		assert.InDelta(t, 250*time.Millisecond, dts[1], float64(50*time.Millisecond))
+		assert.InDelta(t, 250*time.Millisecond, dts[2], float64(50*time.Millisecond))
+	})
+	f.MustHandle(http.MethodGet, "/error", func(c fox.Context) {
+		g, ctx := NewGroup(c, 2)
+		errFailed := errors.New("failed")
+		g.Go(func(ctx context.Context) error {
+			return errFailed
+		})
+		g.Go(func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		})
+		assert.ErrorIs(t, g.Wait(), errFailed)
+		assert.ErrorIs(t, ctx.Err(), context.Canceled)
+	})
+
+	for _, path := range []string{"/equal", "/weighted", "/error"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, req)
+	}
+}
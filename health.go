@@ -0,0 +1,83 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"github.com/tigerwill90/fox"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// maxHealthWindow is the longest window supported by the timeout rate tracking, with a one-second resolution.
+const maxHealthWindow = 5 * time.Minute
+
+// Healthy reports whether the timeout rate, measured over the given sliding window, is below or equal to the
+// threshold (e.g. 0.05 for 5%). The window has a one-second resolution and is capped to five minutes. If no request
+// completed during the window, Healthy returns true.
+func (t *Timeout) Healthy(window time.Duration, threshold float64) bool {
+	requests, timeouts := t.window.sum(time.Now(), window)
+	if requests == 0 {
+		return true
+	}
+	return float64(timeouts)/float64(requests) <= threshold
+}
+
+// HealthHandler returns a [fox.HandlerFunc] suitable for readiness probes. It responds with 200 OK when the
+// middleware is [Timeout.Healthy] given the window and threshold, and with 503 Service Unavailable otherwise.
+func (t *Timeout) HealthHandler(window time.Duration, threshold float64) fox.HandlerFunc {
+	return func(c fox.Context) {
+		if t.Healthy(window, threshold) {
+			_ = c.String(http.StatusOK, "ok\n")
+			return
+		}
+		_ = c.String(http.StatusServiceUnavailable, "degraded\n")
+	}
+}
+
+type rateBucket struct {
+	sec      atomic.Int64
+	requests atomic.Int64
+	timeouts atomic.Int64
+}
+
+// slidingWindow tracks completed requests and timeouts in one-second buckets. Buckets are recycled without locking,
+// so a few updates may be lost when a bucket rotates under concurrent traffic, which is acceptable for rate estimation.
+type slidingWindow struct {
+	buckets []rateBucket
+}
+
+func newSlidingWindow(size time.Duration) *slidingWindow {
+	return &slidingWindow{
+		buckets: make([]rateBucket, int(size/time.Second)),
+	}
+}
+
+func (w *slidingWindow) record(now time.Time, timeout bool) {
+	sec := now.Unix()
+	b := &w.buckets[sec%int64(len(w.buckets))]
+	if cur := b.sec.Load(); cur != sec && b.sec.CompareAndSwap(cur, sec) {
+		b.requests.Store(0)
+		b.timeouts.Store(0)
+	}
+	b.requests.Add(1)
+	if timeout {
+		b.timeouts.Add(1)
+	}
+}
+
+func (w *slidingWindow) sum(now time.Time, window time.Duration) (requests, timeouts int64) {
+	n := min(int64(window/time.Second), int64(len(w.buckets)))
+	sec := now.Unix()
+	for i := int64(0); i < n; i++ {
+		b := &w.buckets[(sec-i)%int64(len(w.buckets))]
+		if b.sec.Load() != sec-i {
+			continue
+		}
+		requests += b.requests.Load()
+		timeouts += b.timeouts.Load()
+	}
+	return
+}
@@ -0,0 +1,62 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tigerwill90/fox"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSlidingWindow(t *testing.T) {
+	w := newSlidingWindow(10 * time.Second)
+	now := time.Unix(1000, 0)
+
+	w.record(now, true)
+	w.record(now.Add(time.Second), false)
+	w.record(now.Add(2*time.Second), false)
+
+	requests, timeouts := w.sum(now.Add(2*time.Second), 3*time.Second)
+	assert.Equal(t, int64(3), requests)
+	assert.Equal(t, int64(1), timeouts)
+
+	requests, timeouts = w.sum(now.Add(2*time.Second), 2*time.Second)
+	assert.Equal(t, int64(2), requests)
+	assert.Equal(t, int64(0), timeouts)
+
+	// The bucket of the first second is recycled.
+	w.record(now.Add(10*time.Second), false)
+	requests, timeouts = w.sum(now.Add(10*time.Second), time.Minute)
+	assert.Equal(t, int64(3), requests)
+	assert.Equal(t, int64(0), timeouts)
+}
+
+func TestTimeout_HealthHandler(t *testing.T) {
+	tm := New(50 * time.Microsecond)
+	f, err := fox.New()
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo", success201response, fox.WithMiddleware(tm.Timeout))
+	f.MustHandle(http.MethodGet, "/health", tm.HealthHandler(time.Minute, 0.5))
+
+	req := httptest.NewRequest(http.MethodGet, "/health", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/foo", nil)
+	w = httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/health", nil)
+	w = httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "degraded\n", w.Body.String())
+}
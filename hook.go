@@ -0,0 +1,180 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"github.com/tigerwill90/fox"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// EventKind identifies what happened to the request described by an [Event].
+type EventKind uint8
+
+const (
+	// EventTimeout reports a request that exceeded its deadline. It is the only kind passed to the timeout hook.
+	EventTimeout EventKind = iota
+	// EventCanceled reports a request canceled before its deadline (e.g. client gone).
+	EventCanceled
+	// EventLateCompletion reports an abandoned handler returning after the deadline or the cancellation of its
+	// request.
+	EventLateCompletion
+	// EventSuperfluousWriteHeader reports a handler calling WriteHeader more than once, if enabled with
+	// [WithStrictWriteHeader]. It is delivered to the warn hook, see [WithWarnHook].
+	EventSuperfluousWriteHeader
+	// EventWarning reports a request still running after the warn threshold of its route, see [Thresholds].
+	EventWarning
+)
+
+// String returns the name of the kind.
+func (k EventKind) String() string {
+	switch k {
+	case EventTimeout:
+		return "timeout"
+	case EventCanceled:
+		return "canceled"
+	case EventLateCompletion:
+		return "late_completion"
+	case EventSuperfluousWriteHeader:
+		return "superfluous_write_header"
+	case EventWarning:
+		return "warning"
+	default:
+		return "unknown"
+	}
+}
+
+// Event describes a request that exceeded its deadline or its warn threshold, was canceled, or whose handler completed
+// late or misbehaved, see [WithTimeoutHook], [WithWarnHook] and [Timeout.Watch].
+type Event struct {
+	// Err is the [*WriteAfterTimeoutError] returned to the handler on subsequent writes.
+	Err error
+	// Kind is what happened to the request.
+	Kind EventKind
+	// Method is the request method.
+	Method string
+	// Pattern is the matched route pattern, if any.
+	Pattern string
+	// Partial holds the first bytes the handler had already buffered before the deadline, if enabled
+	// with [WithPartialResponse].
+	Partial []byte
+	// Segments reports how much of the budget each phase marked with [StartSegment] consumed.
+	Segments []Segment
+	// Budget is the timeout duration applied to the request.
+	Budget time.Duration
+	// Source is the policy that decided the budget, see [WithPrecedence].
+	Source Source
+	// Elapsed is the time elapsed between the start of the request and the deadline, or until the abandoned handler
+	// returned for late completion events.
+	Elapsed time.Duration
+	// Status is the status code written by the handler before the deadline, or zero if none.
+	Status int
+	// Attempts reports how the budget was split across the invocations of the handler, if the request was hedged or
+	// retried (see [Hedge] and [Retry]), or nil if the handler was invoked only once.
+	Attempts []Attempt
+}
+
+// lateEvent returns the event reporting that the abandoned handler returned. It must be called once the handler
+// returned.
+func (t *Timeout) lateEvent(c fox.Context, tw *timeoutWriter, st *requestState) *Event {
+	tw.mu.RLock()
+	defer tw.mu.RUnlock()
+	e := &Event{
+		Kind:    EventLateCompletion,
+		Err:     tw.err,
+		Method:  c.Request().Method,
+		Budget:  st.budget,
+		Source:  st.source,
+		Elapsed: time.Since(st.start),
+	}
+	if route := c.Route(); route != nil {
+		e.Pattern = route.Pattern()
+	}
+	if tw.written {
+		e.Status = tw.code
+	}
+	return e
+}
+
+// newWarnEvent returns the event reporting a request still running after the warn threshold of its route.
+func newWarnEvent(c fox.Context, st *requestState) *Event {
+	now := time.Now()
+	e := &Event{
+		Kind:     EventWarning,
+		Method:   c.Request().Method,
+		Segments: st.snapshotSegments(now),
+		Budget:   st.budget,
+		Source:   st.source,
+		Elapsed:  now.Sub(st.start),
+	}
+	if route := c.Route(); route != nil {
+		e.Pattern = route.Pattern()
+	}
+	return e
+}
+
+// newSuperfluousEvent returns the event reporting a superfluous WriteHeader call.
+func newSuperfluousEvent(c fox.Context, st *requestState, err *SuperfluousWriteHeaderError) *Event {
+	e := &Event{
+		Kind:    EventSuperfluousWriteHeader,
+		Err:     err,
+		Method:  c.Request().Method,
+		Budget:  st.budget,
+		Source:  st.source,
+		Elapsed: time.Since(st.start),
+		Status:  err.Status,
+	}
+	if route := c.Route(); route != nil {
+		e.Pattern = route.Pattern()
+	}
+	return e
+}
+
+// TimeoutHook is a function invoked when a request exceeds its deadline, see [WithTimeoutHook].
+type TimeoutHook func(c fox.Context, e *Event)
+
+// Response is the buffered response of a handler that completed within its deadline, see [WithBeforeFlush].
+type Response struct {
+	// Header is the header of the response. It can be modified in place.
+	Header http.Header
+	// Body is the buffered body of the response. It can be replaced, but must not be retained after the hook
+	// returns, since the buffer is recycled.
+	Body []byte
+	// StatusCode is the status code of the response. It can be replaced.
+	StatusCode int
+}
+
+// FlushHook is a function invoked with the buffered response of a handler before it is sent, see [WithBeforeFlush].
+type FlushHook func(c fox.Context, r *Response)
+
+// newEvent must be called while holding the writer lock.
+func (t *Timeout) newEvent(c fox.Context, tw *timeoutWriter, st *requestState, attempts []Attempt) *Event {
+	now := time.Now()
+	deadline := st.start.Add(st.budget)
+	if now.Before(deadline) {
+		// The request inherited a sooner deadline from its parent context.
+		deadline = now
+	}
+	e := &Event{
+		Err:      tw.err,
+		Method:   c.Request().Method,
+		Segments: st.snapshotSegments(deadline),
+		Budget:   st.budget,
+		Source:   st.source,
+		Elapsed:  now.Sub(st.start),
+		Attempts: attempts,
+	}
+	if route := c.Route(); route != nil {
+		e.Pattern = route.Pattern()
+	}
+	if tw.written {
+		e.Status = tw.code
+	}
+	if n := t.cfg.partial; n > 0 && !tw.unsampled && tw.buf != nil && tw.buf.Len() > 0 {
+		e.Partial = slices.Clone(tw.buf.Bytes()[:min(n, tw.buf.Len())])
+	}
+	return e
+}
@@ -0,0 +1,51 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"github.com/tigerwill90/fox"
+	"sync"
+	"sync/atomic"
+)
+
+// OtherLabel is the route label of the requests beyond the bound set with [WithMetricLabels].
+const OtherLabel = "other"
+
+// RoutePattern is a [KeyFunc] that identifies a request by its route pattern, or by an empty string if the request
+// does not match any route. Unlike the request path, route patterns have a bounded cardinality.
+func RoutePattern(c fox.Context) string {
+	if route := c.Route(); route != nil {
+		return route.Pattern()
+	}
+	return ""
+}
+
+// labeler computes the route label of the metrics, see [WithMetricLabels].
+type labeler struct {
+	fn    KeyFunc
+	seen  sync.Map
+	count atomic.Int64
+	max   int64
+}
+
+// label returns the route label of the request, or [OtherLabel] if the request has a new label and the number of
+// distinct labels already reached the bound.
+func (l *labeler) label(c fox.Context) string {
+	v := l.fn(c)
+	if l.max <= 0 {
+		return v
+	}
+	if _, ok := l.seen.Load(v); ok {
+		return v
+	}
+	if l.count.Add(1) > l.max {
+		l.count.Add(-1)
+		return OtherLabel
+	}
+	if _, loaded := l.seen.LoadOrStore(v, struct{}{}); loaded {
+		l.count.Add(-1)
+	}
+	return v
+}
@@ -0,0 +1,168 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/tigerwill90/fox"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// OpenMetricsContentType is the content type of the OpenMetrics text exposition format.
+const OpenMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// durationBuckets are the upper bounds, in seconds, of the request duration histogram.
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// TraceIDFunc returns the trace id of the request, or an empty string if the request is not traced.
+type TraceIDFunc func(c fox.Context) string
+
+// TraceParentID is a [TraceIDFunc] that extracts the trace id from the W3C traceparent request header.
+func TraceParentID(c fox.Context) string {
+	// e.g. 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+	v := c.Request().Header.Get("traceparent")
+	if len(v) < 55 || v[2] != '-' || v[35] != '-' {
+		return ""
+	}
+	return v[3:35]
+}
+
+// MetricsHandler returns a [fox.HandlerFunc] that serves the middleware's metrics in the OpenMetrics text format,
+// for users who don't run the Prometheus client library. The handler is ready to be mounted on any route.
+// When a trace is present, the timeout counter and the duration histogram carry exemplars with the trace id
+// of a recent request, so that a spike in a dashboard links directly to example traces.
+func (t *Timeout) MetricsHandler() fox.HandlerFunc {
+	return func(c fox.Context) {
+		buf := bufp.Get().(*bytes.Buffer)
+		buf.Reset()
+		defer bufp.Put(buf)
+
+		t.writeMetrics(buf)
+		_ = c.Blob(http.StatusOK, OpenMetricsContentType, buf.Bytes())
+	}
+}
+
+func (t *Timeout) writeMetrics(buf *bytes.Buffer) {
+	s := t.Stats()
+	writeMetric(buf, "foxtimeout_requests", "counter", "Number of requests handled with a deadline.", s.Requests, nil)
+	writeMetric(buf, "foxtimeout_timeouts", "counter", "Number of requests that exceeded their deadline.", s.Timeouts, t.stats.timeoutExemplar.Load())
+	writeMetric(buf, "foxtimeout_canceled", "counter", "Number of requests canceled before their deadline.", s.Canceled, nil)
+	writeMetric(buf, "foxtimeout_rejected", "counter", "Number of requests rejected without calling the handler.", s.Rejected, nil)
+	writeMetric(buf, "foxtimeout_inflight", "gauge", "Number of handlers currently running.", s.Inflight, nil)
+	writeMetric(buf, "foxtimeout_abandoned", "gauge", "Number of handlers still running after their deadline.", s.Abandoned, nil)
+	writeMetric(buf, "foxtimeout_detached", "gauge", "Number of background tasks detached from their request.", s.Detached, nil)
+	writeMetric(buf, "foxtimeout_warnings", "counter", "Number of requests still running after their warn threshold.", s.Warnings, nil)
+	writeMetric(buf, "foxtimeout_hedges", "counter", "Number of second invocations started for hedgeable routes.", s.Hedges, nil)
+	writeMetric(buf, "foxtimeout_retries", "counter", "Number of handlers invoked again after exceeding their sub-budget.", s.Retries, nil)
+	t.writeDiscarded(buf)
+	t.stats.duration.write(buf, "foxtimeout_request_duration_seconds", "Duration of requests handled with a deadline.")
+	buf.WriteString("# EOF\n")
+}
+
+func (t *Timeout) writeDiscarded(buf *bytes.Buffer) {
+	const name = "foxtimeout_discarded_bytes"
+	_, _ = fmt.Fprintf(buf, "# TYPE %s counter\n", name)
+	_, _ = fmt.Fprintf(buf, "# HELP %s Number of bytes written by handlers after their deadline.\n", name)
+	discarded := t.DiscardedBytes()
+	for _, route := range slices.Sorted(maps.Keys(discarded)) {
+		_, _ = fmt.Fprintf(buf, "%s_total{route=\"%s\"} %d\n", name, labelEscaper.Replace(route), discarded[route])
+	}
+}
+
+func writeMetric(buf *bytes.Buffer, name, typ, help string, value int64, e *exemplar) {
+	_, _ = fmt.Fprintf(buf, "# TYPE %s %s\n", name, typ)
+	_, _ = fmt.Fprintf(buf, "# HELP %s %s\n", name, help)
+	if typ == "counter" {
+		_, _ = fmt.Fprintf(buf, "%s_total %d", name, value)
+	} else {
+		_, _ = fmt.Fprintf(buf, "%s %d", name, value)
+	}
+	e.write(buf)
+	buf.WriteByte('\n')
+}
+
+type exemplar struct {
+	ts      time.Time
+	traceID string
+	value   float64
+}
+
+func (e *exemplar) write(buf *bytes.Buffer) {
+	if e == nil {
+		return
+	}
+	_, _ = fmt.Fprintf(
+		buf,
+		` # {trace_id="%s"} %s %s`,
+		labelEscaper.Replace(e.traceID),
+		formatFloat(e.value),
+		formatFloat(float64(e.ts.UnixMilli())/1e3),
+	)
+}
+
+// histogram is a lock-free histogram of durations, with the latest exemplar kept for each bucket.
+type histogram struct {
+	counts    []counter
+	exemplars []atomic.Pointer[exemplar]
+	sum       counter
+}
+
+func newHistogram() histogram {
+	h := histogram{
+		counts:    make([]counter, len(durationBuckets)+1),
+		exemplars: make([]atomic.Pointer[exemplar], len(durationBuckets)+1),
+		sum:       newCounter(),
+	}
+	for i := range h.counts {
+		h.counts[i] = newCounter()
+	}
+	return h
+}
+
+func (h *histogram) observe(d time.Duration, e *exemplar) {
+	i := len(durationBuckets)
+	for j, le := range durationBuckets {
+		if d.Seconds() <= le {
+			i = j
+			break
+		}
+	}
+	h.counts[i].add(1)
+	h.sum.add(int64(d))
+	if e != nil {
+		h.exemplars[i].Store(e)
+	}
+}
+
+func (h *histogram) write(buf *bytes.Buffer, name, help string) {
+	_, _ = fmt.Fprintf(buf, "# TYPE %s histogram\n", name)
+	_, _ = fmt.Fprintf(buf, "# HELP %s %s\n", name, help)
+	var cumulative int64
+	for i := range h.counts {
+		cumulative += h.counts[i].load()
+		le := "+Inf"
+		if i < len(durationBuckets) {
+			le = formatFloat(durationBuckets[i])
+		}
+		_, _ = fmt.Fprintf(buf, "%s_bucket{le=\"%s\"} %d", name, le, cumulative)
+		h.exemplars[i].Load().write(buf)
+		buf.WriteByte('\n')
+	}
+	_, _ = fmt.Fprintf(buf, "%s_sum %s\n", name, formatFloat(time.Duration(h.sum.load()).Seconds()))
+	_, _ = fmt.Fprintf(buf, "%s_count %d\n", name, cumulative)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
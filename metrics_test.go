@@ -0,0 +1,123 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tigerwill90/fox"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTimeout_MetricsHandler(t *testing.T) {
+	tm := New(50 * time.Microsecond)
+	f, err := fox.New()
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo", success201response, fox.WithMiddleware(tm.Timeout))
+	f.MustHandle(http.MethodGet, "/metrics", tm.MetricsHandler())
+
+	req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	w = httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, OpenMetricsContentType, w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), "# TYPE foxtimeout_requests counter\n")
+	assert.Contains(t, w.Body.String(), "foxtimeout_requests_total 1\n")
+	assert.Contains(t, w.Body.String(), "foxtimeout_timeouts_total 1\n")
+	assert.Contains(t, w.Body.String(), "# TYPE foxtimeout_inflight gauge\n")
+	assert.Regexp(t, "# EOF\n$", w.Body.String())
+}
+
+func TestTimeout_MetricsHandlerWithExemplars(t *testing.T) {
+	tm := New(50 * time.Microsecond)
+	f, err := fox.New()
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo", success201response, fox.WithMiddleware(tm.Timeout))
+	f.MustHandle(http.MethodGet, "/metrics", tm.MetricsHandler())
+
+	req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	w = httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+
+	assert.Regexp(t, `foxtimeout_timeouts_total 1 # \{trace_id="4bf92f3577b34da6a3ce929d0e0e4736"\} 1 \d+(\.\d+)?\n`, w.Body.String())
+	assert.Regexp(t, `foxtimeout_request_duration_seconds_bucket\{le="[^"]+"\} 1 # \{trace_id="4bf92f3577b34da6a3ce929d0e0e4736"\} [\d.]+ [\d.]+\n`, w.Body.String())
+	assert.Contains(t, w.Body.String(), "foxtimeout_request_duration_seconds_bucket{le=\"+Inf\"} 1\n")
+	assert.Contains(t, w.Body.String(), "foxtimeout_request_duration_seconds_count 1\n")
+}
+
+func TestTimeout_DiscardedBytes(t *testing.T) {
+	tm := New(10 * time.Millisecond)
+	f, err := fox.New()
+	require.NoError(t, err)
+	served := make(chan struct{})
+	returned := make(chan struct{})
+	f.MustHandle(http.MethodGet, "/foo/{id}", func(c fox.Context) {
+		defer close(returned)
+		<-served
+		_, _ = c.Writer().Write([]byte("hello"))
+	}, fox.WithMiddleware(tm.Timeout))
+	f.MustHandle(http.MethodGet, "/metrics", tm.MetricsHandler())
+
+	req := httptest.NewRequest(http.MethodGet, "/foo/1", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	close(served)
+	<-returned
+
+	assert.Eventually(t, func() bool {
+		return tm.Stats().Discarded == 5
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, map[string]int64{"/foo/{id}": 5}, tm.DiscardedBytes())
+
+	req = httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	w = httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Contains(t, w.Body.String(), "foxtimeout_discarded_bytes_total{route=\"/foo/{id}\"} 5\n")
+}
+
+func TestTimeout_InflightAndAbandoned(t *testing.T) {
+	tm := New(10 * time.Millisecond)
+	f, err := fox.New()
+	require.NoError(t, err)
+	release := make(chan struct{})
+	f.MustHandle(http.MethodGet, "/foo", func(c fox.Context) {
+		<-release
+	}, fox.WithMiddleware(tm.Timeout))
+	f.MustHandle(http.MethodGet, "/metrics", tm.MetricsHandler())
+
+	req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, int64(1), tm.Inflight())
+	assert.Equal(t, int64(1), tm.Abandoned())
+
+	req = httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	w = httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Contains(t, w.Body.String(), "# TYPE foxtimeout_abandoned gauge\n")
+	assert.Contains(t, w.Body.String(), "foxtimeout_abandoned 1\n")
+
+	close(release)
+	assert.Eventually(t, func() bool {
+		return tm.Inflight() == 0 && tm.Abandoned() == 0
+	}, time.Second, time.Millisecond)
+}
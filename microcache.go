@@ -0,0 +1,184 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"github.com/tigerwill90/fox"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxCachedResponses bounds the number of responses kept by the micro-cache. Once full, expired responses are evicted,
+// and new responses are not cached until room is made.
+const maxCachedResponses = 1024
+
+// maxCachedBody is the largest body kept by the micro-cache, so that it only holds small hot responses.
+const maxCachedBody = maxPooledBuffer
+
+// RequestURIKey is a [KeyFunc] that identifies a request by its method and request URI, including the query.
+func RequestURIKey(c fox.Context) string {
+	return c.Request().Method + " " + c.Request().URL.RequestURI()
+}
+
+type cachedResponse struct {
+	stored time.Time
+	header http.Header
+	body   []byte
+	code   int
+}
+
+type microCache struct {
+	key     KeyFunc
+	now     func() time.Time
+	entries map[string]*cachedResponse
+	ttl     time.Duration
+	// retain is how long responses are kept after they expired, to be served on timeout. The cache may be shared
+	// with scopes having their own window, see [WithServeStale], so it is the largest of them.
+	retain atomic.Int64
+	mu     sync.RWMutex
+}
+
+func newMicroCache(ttl time.Duration, key KeyFunc) *microCache {
+	if key == nil {
+		key = RequestURIKey
+	}
+	return &microCache{
+		key:     key,
+		ttl:     ttl,
+		now:     time.Now,
+		entries: make(map[string]*cachedResponse),
+	}
+}
+
+// timeToLive returns the time to live of the cached responses, or zero if the cache is nil.
+func (m *microCache) timeToLive() time.Duration {
+	if m == nil {
+		return 0
+	}
+	return m.ttl
+}
+
+// retainStale keeps the expired responses for at least d, so that they can be served on timeout.
+func (m *microCache) retainStale(d time.Duration) {
+	for {
+		cur := m.retain.Load()
+		if int64(d) <= cur || m.retain.CompareAndSwap(cur, int64(d)) {
+			return
+		}
+	}
+}
+
+// cacheKey returns the key of the request, scoped to its route, or false if the request can't be cached.
+func (m *microCache) cacheKey(c fox.Context) (string, bool) {
+	r := c.Request()
+	// Credentials sent with the request, either explicitly or with cookies, may personalize the response.
+	if r.Method != http.MethodGet || r.Header.Get("Authorization") != "" || r.Header.Get("Cookie") != "" {
+		return "", false
+	}
+	return RouteKey(c) + "\x00" + m.key(c), true
+}
+
+// lookup returns the response cached for the request, if any and still fresh, with its age.
+func (m *microCache) lookup(c fox.Context) (*cachedResponse, time.Duration, bool) {
+	return m.lookupWithin(c, m.ttl)
+}
+
+// lookupStale returns the response cached for the request, if any and not expired for longer than window, with its
+// age. It returns false if the cache is nil.
+func (m *microCache) lookupStale(c fox.Context, window time.Duration) (*cachedResponse, time.Duration, bool) {
+	if m == nil || window <= 0 {
+		return nil, 0, false
+	}
+	return m.lookupWithin(c, m.ttl+window)
+}
+
+func (m *microCache) lookupWithin(c fox.Context, maxAge time.Duration) (*cachedResponse, time.Duration, bool) {
+	k, ok := m.cacheKey(c)
+	if !ok {
+		return nil, 0, false
+	}
+	m.mu.RLock()
+	e := m.entries[k]
+	m.mu.RUnlock()
+	if e == nil {
+		return nil, 0, false
+	}
+	age := m.now().Sub(e.stored)
+	if age >= maxAge {
+		return nil, 0, false
+	}
+	return e, age, true
+}
+
+// store caches a copy of a successful response, unless it is private or too large.
+func (m *microCache) store(c fox.Context, resp *Response) {
+	if resp.StatusCode != http.StatusOK || len(resp.Body) > maxCachedBody || !cacheable(resp.Header) {
+		return
+	}
+	k, ok := m.cacheKey(c)
+	if !ok {
+		return
+	}
+	now := m.now()
+	e := &cachedResponse{
+		stored: now,
+		header: resp.Header.Clone(),
+		body:   slices.Clone(resp.Body),
+		code:   resp.StatusCode,
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, found := m.entries[k]; !found && len(m.entries) >= maxCachedResponses {
+		m.evictLocked(now)
+		if len(m.entries) >= maxCachedResponses {
+			return
+		}
+	}
+	m.entries[k] = e
+}
+
+// evictLocked removes the expired responses, past the stale window.
+func (m *microCache) evictLocked(now time.Time) {
+	for k, e := range m.entries {
+		if now.Sub(e.stored) >= m.ttl+time.Duration(m.retain.Load()) {
+			delete(m.entries, k)
+		}
+	}
+}
+
+// cacheable reports whether a response with the given header can be shared between clients.
+func cacheable(h http.Header) bool {
+	// A response varying on request headers (e.g. Accept-Encoding or Accept-Language) can't be served to every client
+	// with the same key.
+	if h.Get("Set-Cookie") != "" || h.Get("Vary") != "" {
+		return false
+	}
+	cc := strings.ToLower(h.Get("Cache-Control"))
+	return !strings.Contains(cc, "no-store") && !strings.Contains(cc, "private") && !strings.Contains(cc, "no-cache")
+}
+
+// serveCached sends a cached response, with its Age header. A stale response also carries the Warning header.
+func (t *Timeout) serveCached(c fox.Context, e *cachedResponse, age time.Duration, stale bool) {
+	resp := Response{Header: e.header.Clone(), Body: e.body, StatusCode: e.code}
+	resp.Header.Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	if stale {
+		resp.Header.Set("Warning", `110 - "Response is Stale"`)
+	}
+	if t.cfg.etag != nil {
+		notModified(c.Request(), &resp)
+	}
+	w := c.Writer()
+	dst := w.Header()
+	for k, vv := range resp.Header {
+		dst[k] = vv
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, _ = w.Write(resp.Body)
+}
@@ -0,0 +1,130 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tigerwill90/fox"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMiddleware_WithMicroCache(t *testing.T) {
+	tm := New(time.Second, WithMicroCache(time.Minute, nil))
+	now := time.Now()
+	tm.cfg.cache.now = func() time.Time { return now }
+
+	var calls atomic.Int32
+	f, err := fox.New(fox.WithMiddleware(tm.Timeout))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo", func(c fox.Context) {
+		calls.Add(1)
+		_ = c.String(http.StatusOK, "%s", c.Request().URL.Query().Get("q"))
+	})
+	f.MustHandle(http.MethodGet, "/cookie", func(c fox.Context) {
+		calls.Add(1)
+		http.SetCookie(c.Writer(), &http.Cookie{Name: "session", Value: "secret"})
+		_ = c.String(http.StatusOK, "cookie")
+	})
+
+	f.MustHandle(http.MethodGet, "/vary", func(c fox.Context) {
+		calls.Add(1)
+		c.Writer().Header().Set("Vary", "Accept-Language")
+		_ = c.String(http.StatusOK, "%s", c.Request().Header.Get("Accept-Language"))
+	})
+
+	serve := func(path string, h http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		for k, v := range h {
+			req.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve("/foo?q=a", nil)
+	assert.Equal(t, "a", w.Body.String())
+	assert.Empty(t, w.Header().Get("Age"))
+
+	now = now.Add(2 * time.Second)
+	w = serve("/foo?q=a", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "a", w.Body.String())
+	assert.Equal(t, "2", w.Header().Get("Age"))
+	assert.Equal(t, int32(1), calls.Load())
+
+	assert.Equal(t, "b", serve("/foo?q=b", nil).Body.String())
+	assert.Equal(t, int32(2), calls.Load())
+
+	serve("/foo?q=a", http.Header{"Authorization": {"Bearer token"}})
+	assert.Equal(t, int32(3), calls.Load())
+
+	serve("/cookie", nil)
+	serve("/cookie", nil)
+	assert.Equal(t, int32(5), calls.Load())
+
+	// A request authenticated with a cookie may get a personalized response, which is neither served from nor stored
+	// in the cache.
+	assert.Equal(t, "c", serve("/foo?q=c", http.Header{"Cookie": {"session=secret"}}).Body.String())
+	assert.Equal(t, int32(6), calls.Load())
+	assert.Equal(t, "c", serve("/foo?q=c", nil).Body.String())
+	assert.Equal(t, int32(7), calls.Load())
+	serve("/foo?q=a", http.Header{"Cookie": {"session=secret"}})
+	assert.Equal(t, int32(8), calls.Load())
+
+	serve("/vary", http.Header{"Accept-Language": {"fr"}})
+	w = serve("/vary", http.Header{"Accept-Language": {"en"}})
+	assert.Equal(t, "en", w.Body.String())
+	assert.Equal(t, int32(10), calls.Load())
+
+	now = now.Add(time.Minute)
+	serve("/foo?q=a", nil)
+	assert.Equal(t, int32(11), calls.Load())
+	assert.Equal(t, "foxtimeout{default=1s cache=1m0s}", tm.String())
+}
+
+func TestMiddleware_WithServeStale(t *testing.T) {
+	tm := New(20*time.Millisecond, WithMicroCache(time.Second, nil), WithServeStale(time.Minute))
+	now := time.Now()
+	tm.cfg.cache.now = func() time.Time { return now }
+
+	var calls atomic.Int32
+	f, err := fox.New(fox.WithMiddleware(tm.Timeout))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo", func(c fox.Context) {
+		if calls.Add(1) > 1 {
+			<-c.Request().Context().Done()
+			return
+		}
+		_ = c.String(http.StatusOK, "v1")
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, "v1", w.Body.String())
+
+	now = now.Add(2 * time.Second)
+	req = httptest.NewRequest(http.MethodGet, "/foo", nil)
+	w = httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "v1", w.Body.String())
+	assert.Equal(t, "2", w.Header().Get("Age"))
+	assert.Equal(t, `110 - "Response is Stale"`, w.Header().Get("Warning"))
+	assert.Equal(t, int32(2), calls.Load())
+
+	now = now.Add(2 * time.Minute)
+	req = httptest.NewRequest(http.MethodGet, "/foo", nil)
+	w = httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "foxtimeout{default=20ms cache=1s stale=1m0s}", tm.String())
+}
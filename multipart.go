@@ -0,0 +1,151 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// newPartReader returns a reader of the body of a multipart request, or nil if the request is not multipart
+// or has no body.
+func newPartReader(r *http.Request) *partReader {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") || params["boundary"] == "" {
+		return nil
+	}
+	return &partReader{
+		ReadCloser: r.Body,
+		delim:      []byte("--" + params["boundary"]),
+	}
+}
+
+// partReader resets the deadline each time a delimiter is read, i.e. each time a part of the body completes.
+// The delimiter may span several reads, so the last bytes read are kept to match it across reads.
+type partReader struct {
+	io.ReadCloser
+	reset func()
+	delim []byte
+	tail  []byte
+	seam  []byte
+}
+
+func (r *partReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n == 0 {
+		return n, err
+	}
+
+	// The read is scanned in place, and only a delimiter spanning the previous read is matched on a copy of the kept
+	// bytes stitched with the start of this read, so that large uploads are not copied.
+	keep := len(r.delim) - 1
+	found := bytes.Contains(p[:n], r.delim)
+	if !found && len(r.tail) > 0 {
+		r.seam = append(append(r.seam[:0], r.tail...), p[:min(n, keep)]...)
+		found = bytes.Contains(r.seam, r.delim)
+	}
+	if found {
+		r.reset()
+	}
+
+	if n >= keep {
+		r.tail = append(r.tail[:0], p[n-keep:n]...)
+	} else {
+		r.tail = append(r.tail, p[:n]...)
+		if len(r.tail) > keep {
+			r.tail = append(r.tail[:0], r.tail[len(r.tail)-keep:]...)
+		}
+	}
+	return n, err
+}
+
+// resetContext is a context whose deadline can be pushed back, see [PerPart].
+type resetContext struct {
+	context.Context
+	cancel   context.CancelFunc
+	timer    *time.Timer
+	deadline time.Time
+	mu       sync.Mutex
+	dt       time.Duration
+	expired  bool
+}
+
+// withResetTimeout is the equivalent of [context.WithTimeout], but the returned context deadline is pushed back by
+// dt each time it is reset.
+func withResetTimeout(parent context.Context, dt time.Duration) *resetContext {
+	ctx, cancel := context.WithCancel(parent)
+	c := &resetContext{
+		Context:  ctx,
+		cancel:   cancel,
+		deadline: time.Now().Add(dt),
+		dt:       dt,
+	}
+	c.mu.Lock()
+	c.timer = time.AfterFunc(dt, func() {
+		c.mu.Lock()
+		c.expired = true
+		c.mu.Unlock()
+		cancel()
+	})
+	c.mu.Unlock()
+	return c
+}
+
+// stop releases the resources associated with the context, like a [context.CancelFunc].
+func (c *resetContext) stop() {
+	c.timer.Stop()
+	c.cancel()
+}
+
+func (c *resetContext) Deadline() (time.Time, bool) {
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+	if cur, ok := c.Context.Deadline(); ok && cur.Before(deadline) {
+		return cur, true
+	}
+	return deadline, true
+}
+
+func (c *resetContext) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.expired {
+		return context.DeadlineExceeded
+	}
+	return c.Context.Err()
+}
+
+// reset pushes the deadline back by dt from now, unless the deadline has already fired.
+func (c *resetContext) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.resetLocked()
+}
+
+// resetTo is like reset, but also replaces dt for the subsequent resets.
+func (c *resetContext) resetTo(dt time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dt = dt
+	c.resetLocked()
+}
+
+func (c *resetContext) resetLocked() {
+	if c.expired || !c.timer.Stop() {
+		return
+	}
+	c.deadline = time.Now().Add(c.dt)
+	c.timer.Reset(c.dt)
+}
@@ -0,0 +1,125 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tigerwill90/fox"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestPerPart(t *testing.T) {
+	f, err := fox.New(fox.WithMiddleware(Middleware(time.Second)))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodPost, "/upload", func(c fox.Context) {
+		mr, err := c.Request().MultipartReader()
+		if err != nil {
+			_ = c.String(http.StatusBadRequest, "%s", err)
+			return
+		}
+		var n int
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return
+			}
+			_, _ = io.Copy(io.Discard, part)
+			n++
+		}
+		_ = c.String(http.StatusOK, "%d", n)
+	}, PerPart(100*time.Millisecond))
+
+	cases := []struct {
+		name     string
+		delays   []time.Duration
+		wantCode int
+		wantBody string
+	}{
+		{
+			name:     "each part within budget",
+			delays:   []time.Duration{40 * time.Millisecond, 40 * time.Millisecond, 40 * time.Millisecond},
+			wantCode: http.StatusOK,
+			wantBody: "3",
+		},
+		{
+			name:     "stalled part",
+			delays:   []time.Duration{40 * time.Millisecond, 300 * time.Millisecond},
+			wantCode: http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			pr, pw := io.Pipe()
+			mw := multipart.NewWriter(pw)
+			go func() {
+				for i, d := range tc.delays {
+					time.Sleep(d)
+					w, err := mw.CreateFormField("field")
+					if err != nil {
+						return
+					}
+					if _, err := w.Write([]byte{byte('a' + i)}); err != nil {
+						return
+					}
+				}
+				_ = mw.Close()
+				_ = pw.Close()
+			}()
+			defer pr.Close()
+
+			req := httptest.NewRequest(http.MethodPost, "/upload", pr)
+			req.Header.Set("Content-Type", mw.FormDataContentType())
+			w := httptest.NewRecorder()
+			f.ServeHTTP(w, req)
+			assert.Equal(t, tc.wantCode, w.Code)
+			if tc.wantBody != "" {
+				assert.Equal(t, tc.wantBody, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestPartReader(t *testing.T) {
+	body := "--bound\r\nfoo\r\n--bound\r\n" + strings.Repeat("x", 1024) + "\r\n--bound--\r\n"
+	newReader := func(r io.Reader) (*partReader, *int) {
+		var resets int
+		return &partReader{
+			ReadCloser: io.NopCloser(r),
+			reset:      func() { resets++ },
+			delim:      []byte("--bound"),
+		}, &resets
+	}
+
+	t.Run("delimiters spanning reads", func(t *testing.T) {
+		pr, resets := newReader(iotest.OneByteReader(strings.NewReader(body)))
+		_, err := io.Copy(io.Discard, pr)
+		require.NoError(t, err)
+		assert.Equal(t, 3, *resets)
+	})
+
+	t.Run("reads are scanned in place", func(t *testing.T) {
+		pr, resets := newReader(strings.NewReader(strings.Repeat(body, 1024)))
+		buf := make([]byte, 4096)
+		// Warm up the kept bytes, which are then reused.
+		_, _ = pr.Read(buf)
+		allocs := testing.AllocsPerRun(100, func() {
+			_, _ = pr.Read(buf)
+		})
+		assert.Zero(t, allocs)
+		assert.Positive(t, *resets)
+	})
+}
@@ -5,15 +5,113 @@
 package foxtimeout
 
 import (
+	"cmp"
+	"fmt"
 	"github.com/tigerwill90/fox"
+	"log/slog"
 	"net/http"
+	"slices"
+	"strings"
 	"time"
 )
 
 type config struct {
-	resolver Resolver
-	resp     fox.HandlerFunc
-	filters  []Filter
+	resolver        Resolver
+	resp            fox.HandlerFunc
+	respTimeout     time.Duration
+	errWrite        time.Duration
+	headersOnly     bool
+	headers         http.Header
+	wheel           *timerWheel
+	slo             *SLO
+	alert           *alertWatcher
+	snapshot        *snapshotConfig
+	hook            TimeoutHook
+	emitter         *emitter
+	labels          *labeler
+	traceID         TraceIDFunc
+	logger          *slog.Logger
+	lateWrites      *lateWrites
+	stackRate       float64
+	sampling        *sampling
+	admission       *admission
+	debugHeader     string
+	filters         []Filter
+	errs            []error
+	partial         int
+	requireRecovery bool
+	abort           bool
+	closeConn       bool
+	behaviors       map[int]Behavior
+	reasonHeader    string
+	retryAfter      time.Duration
+	status          int
+	stream          bool
+	hints           *ClientHints
+	penalty         *penalties
+	bundle          *bundleWatcher
+	redirect        func(c fox.Context) string
+	recent          *recentTimeouts
+	precedence      []Source
+	strictHeader    bool
+	interim         *interimConfig
+	sourceStatus    map[Source]int
+	warnHook        TimeoutHook
+	clamp           time.Duration
+	jitter          float64
+	phases          Phases
+	policyHeader    string
+	strictLate      strictLate
+	debug           bool
+	writer          func(w *Writer) fox.ResponseWriter
+	beforeFlush     FlushHook
+	etag            *etagConfig
+	cache           *microCache
+	stale           time.Duration
+	headerLimits    *headerLimits
+	stripHop        bool
+}
+
+// strictLate is the strict mode for writes after the deadline, see [WithStrictLateWrites].
+type strictLate uint8
+
+const (
+	strictLateOff strictLate = iota
+	strictLateLog
+	strictLatePanic
+)
+
+func (s strictLate) String() string {
+	switch s {
+	case strictLateLog:
+		return "log"
+	case strictLatePanic:
+		return "panic"
+	default:
+		return ""
+	}
+}
+
+type interimConfig struct {
+	interval time.Duration
+	code     int
+}
+
+const (
+	// DefaultDebugHeader is the name of the debug header enabled with [WithDebugHeader].
+	DefaultDebugHeader = "X-Timeout-Decision"
+	// DefaultPolicyHeader is the name of the policy header enabled with [WithPolicyHeader].
+	DefaultPolicyHeader = "Timeout-Policy"
+	// DefaultReasonHeader is the name of the reason header enabled with [WithReasonHeader].
+	DefaultReasonHeader = "X-Timeout-Reason"
+	// DefaultErrorWriteTimeout is the default time allowed to send the timeout response, see
+	// [WithErrorWriteTimeout].
+	DefaultErrorWriteTimeout = 5 * time.Second
+)
+
+type admission struct {
+	queue func(c fox.Context) time.Duration
+	floor time.Duration
 }
 
 type Option interface {
@@ -44,30 +142,108 @@ func (f optionFunc) apply(c *config) {
 	f(c)
 }
 
+// invalid records an invalid option value, reported by [NewStrict]. Other constructors silently ignore or adjust
+// such values, as documented by each option.
+func (c *config) invalid(format string, args ...any) {
+	c.errs = append(c.errs, fmt.Errorf("foxtimeout: "+format, args...))
+}
+
 func defaultConfig() *config {
 	return &config{
-		resp: DefaultTimeoutResponse,
+		resp:       DefaultTimeoutResponse,
+		status:     http.StatusServiceUnavailable,
+		traceID:    TraceParentID,
+		logger:     slog.Default(),
+		precedence: defaultPrecedence,
+		errWrite:   DefaultErrorWriteTimeout,
 	}
 }
 
-// WithFilter appends the provided filters to the middleware's filter list.
-// A filter returning true will exclude the request from using the timeout handler. If no filters
-// are provided, all requests will be handled. Keep in mind that filters are invoked for each request,
-// so they should be simple and efficient.
+// WithFilter appends the provided filters to the middleware's filter list, so that filters from several options
+// add up. A filter returning true will exclude the request from using the timeout handler. If no filters
+// are provided, all requests will be handled. Use [AllOf], [AnyOf] and [Not] to combine filters into more complex
+// skip logic. Keep in mind that filters are invoked for each request, so they should be simple and efficient.
 func WithFilter(f ...Filter) Option {
 	return optionFunc(func(c *config) {
-		c.filters = f
+		c.filters = slices.Clip(c.filters)
+		for i := range f {
+			if f[i] == nil {
+				c.invalid("nil filter at index %d", i)
+				continue
+			}
+			c.filters = append(c.filters, f[i])
+		}
 	})
 }
 
+// wellKnownPaths are the infrastructure endpoints excluded by [SkipWellKnown].
+var wellKnownPaths = []string{"/healthz", "/livez", "/readyz", "/metrics", "/debug/pprof"}
+
+// SkipWellKnown returns an [Option] that excludes the common infrastructure endpoints from the timeout handler:
+// /healthz, /livez, /readyz, /metrics and /debug/pprof, along with the paths below them (e.g. /debug/pprof/profile,
+// which runs for 30 seconds by default). The filter is added to the filters registered with [WithFilter].
+func SkipWellKnown() Option {
+	return optionFunc(func(c *config) {
+		c.filters = append(slices.Clip(c.filters), skipWellKnown)
+	})
+}
+
+func skipWellKnown(c fox.Context) bool {
+	path := c.Request().URL.Path
+	for _, p := range wellKnownPaths {
+		if strings.HasPrefix(path, p) && (len(path) == len(p) || path[len(p)] == '/') {
+			return true
+		}
+	}
+	return false
+}
+
 // WithResponse sets a custom response handler function for the middleware.
 // This function will be invoked when a timeout occurs, allowing for custom responses
-// to be sent back to the client. If not set, the middleware use [DefaultTimeoutResponse].
+// to be sent back to the client. If not set, the middleware use [DefaultTimeoutResponse]. If the handler panics,
+// the panic is recovered and logged, and [DefaultTimeoutResponse] is sent instead unless a response was already written.
 func WithResponse(h fox.HandlerFunc) Option {
 	return optionFunc(func(c *config) {
-		if h != nil {
-			c.resp = h
+		if h == nil {
+			c.invalid("nil response handler")
+			return
 		}
+		c.resp = h
+		c.status = 0
+	})
+}
+
+// WithResponseTimeout bounds the execution of the response handlers, i.e. the handler set with [WithResponse],
+// the fallback set with [SetFallback] and the redirection of [WithRedirectOnTimeout], so that a buggy or blocking
+// renderer (e.g. one doing I/O) can't hang the request that was supposed to be giving up. The handler runs with
+// a buffered response writer and a request context limited to d, which doesn't inherit the cancellation of the
+// request. If it doesn't return within d, its writes are discarded and the timeout response, or else
+// [DefaultTimeoutResponse], is sent instead. If d is zero or negative, response handlers are not bounded.
+func WithResponseTimeout(d time.Duration) Option {
+	return optionFunc(func(c *config) {
+		c.respTimeout = max(d, 0)
+	})
+}
+
+// WithHeadersOnly sends the timeout responses rendered by the middleware with an empty body, and with the given
+// static headers (e.g. a Cache-Control or a custom error code header), for machine-to-machine APIs where any body is
+// wasted bytes and some clients choke on unexpected payloads. It applies to the status codes set with
+// [WithStatusCode], [WithSourceStatus] and [StatusCode], while a handler set with [WithResponse] still renders its
+// own response. The headers are copied, so later modifications don't affect the middleware.
+func WithHeadersOnly(headers http.Header) Option {
+	return optionFunc(func(c *config) {
+		c.headersOnly = true
+		c.headers = headers.Clone()
+	})
+}
+
+// WithErrorWriteTimeout sets the write deadline of the timeout response, so that a client too slow to receive it,
+// or not reading at all, gets its connection closed instead of holding the request once its budget is exhausted. The
+// deadline is cleared after the response is sent. It defaults to [DefaultErrorWriteTimeout]. If d is zero or
+// negative, the timeout response has no write deadline.
+func WithErrorWriteTimeout(d time.Duration) Option {
+	return optionFunc(func(c *config) {
+		c.errWrite = max(d, 0)
 	})
 }
 
@@ -81,6 +257,719 @@ func DefaultTimeoutResponse(c fox.Context) {
 // so they should be simple and efficient.
 func WithTimeoutResolver(resolver Resolver) Option {
 	return optionFunc(func(c *config) {
+		if resolver == nil {
+			c.invalid("nil timeout resolver")
+		}
 		c.resolver = resolver
 	})
 }
+
+// WithCostResolver sets a [CostResolver] mapping the cost of each request to its timeout duration with the given
+// curve, so that GraphQL or search endpoints grant more time to expensive queries and less to trivial ones. It is
+// a shorthand for [WithTimeoutResolver] and replaces any resolver previously set.
+func WithCostResolver(cost CostFunc, curve CostCurve) Option {
+	return optionFunc(func(c *config) {
+		if cost == nil || curve == nil {
+			c.invalid("cost resolver requires a non-nil cost function and curve")
+			return
+		}
+		c.resolver = CostResolver(cost, curve)
+	})
+}
+
+// WithTimerWheel enables an opt-in deadline engine based on a shared hashed timing wheel, instead of arming one
+// runtime timer per request with [context.WithTimeout]. At very high request rates, this reduces the timer heap
+// pressure at the cost of precision: deadlines fire with a granularity of one tick. The wheel has the given
+// number of slots, each covering a tick duration. If tick or slots are zero or negative, defaults of 10ms
+// and 512 slots are used.
+func WithTimerWheel(tick time.Duration, slots int) Option {
+	return optionFunc(func(c *config) {
+		if tick < 0 || slots < 0 {
+			c.invalid("negative timer wheel tick %s or slots %d", tick, slots)
+		}
+		c.wheel = newTimerWheel(tick, slots)
+	})
+}
+
+// WithSLO enables the adaptive enforcement of the given [SLO]. The middleware measures the burn rate of the error
+// budget over the SLO window and scales the resolved timeout accordingly: budgets are loosened while the error budget
+// burns too fast, and tightened back while there is room to spare, so the middleware actively defends the SLO.
+// An SLO with a target outside the (0, 1) range is ignored.
+func WithSLO(slo SLO) Option {
+	return optionFunc(func(c *config) {
+		switch {
+		case slo.Target <= 0 || slo.Target >= 1:
+			c.invalid("SLO target %v outside the (0, 1) range", slo.Target)
+			return
+		case slo.Window < 0 || slo.MinFactor < 0 || slo.MaxFactor < 0:
+			c.invalid("negative SLO window or factor")
+		case slo.MinFactor > 0 && slo.MaxFactor > 0 && slo.MinFactor > slo.MaxFactor:
+			c.invalid("SLO min factor %v greater than max factor %v", slo.MinFactor, slo.MaxFactor)
+		}
+		c.slo = &slo
+	})
+}
+
+// WithAlert registers a callback invoked when the number of timeouts within a one-minute window reaches the given
+// threshold, along with a breakdown per route. The callback is invoked at most once per window, in its own goroutine,
+// which enables direct paging or webhook integration without an external metrics pipeline. A threshold lower than
+// one or a nil callback disables the alert.
+func WithAlert(threshold int, fn AlertFunc) Option {
+	return optionFunc(func(c *config) {
+		if threshold < 1 || fn == nil {
+			c.invalid("alert requires a positive threshold and a non-nil callback")
+			return
+		}
+		c.alert = newAlertWatcher(threshold, fn)
+	})
+}
+
+// WithDiagnosticsBundle registers a one-shot callback invoked with a diagnostics [Bundle] (recent latencies,
+// goroutine count and goroutine stacks) the first time a route times out threshold times within the given window,
+// so that it can be attached to incidents automatically. The callback is invoked at most once per route, in its own
+// goroutine. Requests that don't match any route are not tracked. A threshold lower than one, a non-positive window
+// or a nil callback disables the bundle.
+func WithDiagnosticsBundle(threshold int, window time.Duration, fn BundleFunc) Option {
+	return optionFunc(func(c *config) {
+		if threshold < 1 || window <= 0 || fn == nil {
+			c.invalid("diagnostics bundle requires a positive threshold and window, and a non-nil callback")
+			return
+		}
+		c.bundle = newBundleWatcher(threshold, window, fn)
+	})
+}
+
+// WithSnapshot registers a sink invoked with a bounded [Snapshot] of every request that exceeds its deadline
+// (method, request URI, route pattern, the given headers and up to maxBody bytes of the body read by the handler).
+// It pairs naturally with request dumping middleware such as foxdump, so slow requests can be reproduced offline.
+// The sink is invoked synchronously after the timeout response is sent, so it should be simple and efficient.
+func WithSnapshot(fn SnapshotFunc, maxBody int, headers ...string) Option {
+	return optionFunc(func(c *config) {
+		if fn == nil {
+			c.invalid("nil snapshot sink")
+			return
+		}
+		if maxBody < 0 {
+			c.invalid("negative snapshot body size %d", maxBody)
+		}
+		canonical := make([]string, 0, len(headers))
+		for _, h := range headers {
+			canonical = append(canonical, http.CanonicalHeaderKey(h))
+		}
+		c.snapshot = &snapshotConfig{
+			fn:      fn,
+			maxBody: max(maxBody, 0),
+			headers: canonical,
+		}
+	})
+}
+
+// WithTimeoutHook registers a hook invoked with an [Event] describing every request that exceeds its deadline.
+// The hook is invoked synchronously after the timeout response is sent, so it should be simple and efficient.
+func WithTimeoutHook(fn TimeoutHook) Option {
+	return optionFunc(func(c *config) {
+		if fn == nil {
+			c.invalid("nil timeout hook")
+		}
+		c.hook = fn
+	})
+}
+
+// WithPartialResponse includes up to the first n bytes the handler had already buffered before the deadline in the
+// [Event] passed to the timeout hook. This often reveals exactly how far the handler got before stalling.
+func WithPartialResponse(n int) Option {
+	return optionFunc(func(c *config) {
+		if n < 0 {
+			c.invalid("negative partial response size %d", n)
+		}
+		c.partial = max(n, 0)
+	})
+}
+
+// WithEmitter sends per-route counters and timers to the given [Emitter] (e.g. [DogStatsd]) for every request
+// handled with a deadline, for environments not running Prometheus. Each metric is tagged with the route pattern,
+// the request method and the given static tags (e.g. "env:prod").
+func WithEmitter(e Emitter, tags ...string) Option {
+	return optionFunc(func(c *config) {
+		if e == nil {
+			c.invalid("nil emitter")
+			return
+		}
+		c.emitter = &emitter{e: e, tags: tags}
+	})
+}
+
+// WithMetricLabels controls the cardinality of the route label of the metrics, i.e. the route tag sent to the
+// [Emitter] and the route label of the discarded bytes exposed by [Timeout.MetricsHandler]. The label is computed by
+// label, e.g. to group routes by team or API version, or by [RoutePattern] if label is nil. At most maxRoutes distinct
+// labels are tracked, and requests with other labels are grouped under [OtherLabel], so that large routers don't
+// overwhelm the metrics backend. If maxRoutes is zero or negative, the number of labels is not bounded.
+func WithMetricLabels(label KeyFunc, maxRoutes int) Option {
+	return optionFunc(func(c *config) {
+		if label == nil {
+			label = RoutePattern
+		}
+		c.labels = &labeler{fn: label, max: int64(max(maxRoutes, 0))}
+	})
+}
+
+// WithTraceID sets the function used to extract the trace id of a request, which is attached as an exemplar to the
+// timeout counter and the duration histogram exposed by [Timeout.MetricsHandler]. By default, the trace id is read
+// from the W3C traceparent header with [TraceParentID].
+func WithTraceID(fn TraceIDFunc) Option {
+	return optionFunc(func(c *config) {
+		if fn == nil {
+			c.invalid("nil trace id function")
+			return
+		}
+		c.traceID = fn
+	})
+}
+
+// WithAdmission rejects a request immediately with the timeout response, without calling the next handler, if its
+// resolved budget minus the expected queueing delay returned by queue is below the given floor. This sheds hopeless
+// requests before spawning the handler goroutine. A nil queue function is treated as no expected queueing.
+func WithAdmission(floor time.Duration, queue func(c fox.Context) time.Duration) Option {
+	return optionFunc(func(c *config) {
+		if floor < 0 {
+			c.invalid("negative admission floor %s", floor)
+		}
+		if queue == nil {
+			queue = func(c fox.Context) time.Duration { return 0 }
+		}
+		c.admission = &admission{floor: floor, queue: queue}
+	})
+}
+
+// WithDebugHeader enables a debug response header, with the given name, describing which [Source] decided the timeout
+// duration of the request and its value (e.g. "source=route; budget=2s"). This is invaluable when several policies
+// overlap. If name is empty, [DefaultDebugHeader] is used.
+func WithDebugHeader(name string) Option {
+	return optionFunc(func(c *config) {
+		c.debugHeader = cmp.Or(name, DefaultDebugHeader)
+	})
+}
+
+// WithPolicyHeader advertises the policy applied to the request on every response, with the given header name, e.g.
+// "Timeout-Policy: budget=2s; source=route". API consumers can then program their client-side timeout slightly above
+// the budget of the server, rather than aborting requests the server is still willing to answer. Unlike the debug
+// header, it is meant to be exposed to clients. If name is empty, [DefaultPolicyHeader] is used.
+func WithPolicyHeader(name string) Option {
+	return optionFunc(func(c *config) {
+		c.policyHeader = cmp.Or(name, DefaultPolicyHeader)
+	})
+}
+
+// WithDebug enables a verbose diagnostics mode logging the decisions made for every request at the debug level,
+// through the logger set with [WithLogger]: the resolved budget and its [Source], the number of filters evaluated,
+// the outcome and the elapsed time. This helps troubleshooting policy issues, e.g. in staging, but is too verbose for
+// production.
+func WithDebug(enable bool) Option {
+	return optionFunc(func(c *config) {
+		c.debug = enable
+	})
+}
+
+// WithLogger sets the logger used to report configuration warnings and recovered panics. By default, [slog.Default]
+// is used.
+func WithLogger(logger *slog.Logger) Option {
+	return optionFunc(func(c *config) {
+		if logger == nil {
+			c.invalid("nil logger")
+			return
+		}
+		c.logger = logger
+	})
+}
+
+// WithRequireRecovery enforces that the middleware runs inside a recovery middleware, such as the one registered
+// with [fox.DefaultOptions]. The ordering is checked on the first request, and a warning is logged when no recovery
+// middleware is found. With this option, the middleware also panics with [ErrNoRecovery] on every request, so that
+// a misordered middleware chain can't go unnoticed.
+func WithRequireRecovery() Option {
+	return optionFunc(func(c *config) {
+		c.requireRecovery = true
+	})
+}
+
+// WithWriteDiagnostics enables a diagnostics mode recording the route and the caller of every write attempted after
+// the deadline. The aggregated report, available with [Timeout.LateWrites], helps finding handlers that ignore the
+// cancellation of the request context and keep computing. Recording a write walks the call stack, so this mode is
+// meant for troubleshooting rather than permanent use.
+func WithWriteDiagnostics() Option {
+	return optionFunc(func(c *config) {
+		if c.lateWrites == nil {
+			c.lateWrites = newLateWrites()
+		}
+	})
+}
+
+// WithWriteStackSampling enables the write diagnostics, like [WithWriteDiagnostics], and captures the stack trace of
+// a sample of the writes attempted after the deadline, so that the offending code path inside large handlers can be
+// located without guessing. The rate is the fraction of writes sampled, in the [0, 1] range. Capturing a stack trace
+// is expensive, so a low rate (e.g. 0.01) is recommended under significant traffic.
+func WithWriteStackSampling(rate float64) Option {
+	return optionFunc(func(c *config) {
+		if rate < 0 || rate > 1 {
+			c.invalid("stack sampling rate %v outside the [0, 1] range", rate)
+		}
+		if c.lateWrites == nil {
+			c.lateWrites = newLateWrites()
+		}
+		c.stackRate = min(max(rate, 0), 1)
+	})
+}
+
+// WithDiagnosticsSampling captures the expensive diagnostics of a timeout only for the given fraction of the timeouts,
+// in the (0, 1] range, so that their overhead stays bounded during timeout storms. Sampling applies to the snapshots
+// taken with [WithSnapshot], the partial response captured with [WithPartialResponse], and the stack traces of the
+// writes after the deadline captured with [WithWriteStackSampling], which are further sampled by their own rate.
+// The timeout hook, watchers and statistics still see every timeout.
+func WithDiagnosticsSampling(rate float64) Option {
+	return optionFunc(func(c *config) {
+		if rate <= 0 || rate > 1 {
+			c.invalid("diagnostics sampling rate %v outside the (0, 1] range", rate)
+			return
+		}
+		c.sampling = &sampling{rate: rate}
+	})
+}
+
+// WithAbortOnTimeout aborts the response by panicking with [http.ErrAbortHandler] when the deadline fires, instead of
+// sending the timeout response. The server then closes the connection (or resets the stream with HTTP/2) without
+// writing anything, which is appropriate when any response would be misleading, e.g. partially materialized downloads.
+// Recovery middlewares, such as fox's, re-panic [http.ErrAbortHandler] so that it reaches the server.
+func WithAbortOnTimeout(enable bool) Option {
+	return optionFunc(func(c *config) {
+		c.abort = enable
+	})
+}
+
+// WithCloseOnTimeout sets the "Connection: close" header on timeout responses to HTTP/1.x requests, so that the server
+// closes the connection after the response instead of reusing it for subsequent requests. This avoids head-of-line
+// blocking on keep-alive pools when the peer proved slow. It has no effect on HTTP/2 and later, which multiplex
+// requests over a single connection.
+func WithCloseOnTimeout(enable bool) Option {
+	return optionFunc(func(c *config) {
+		c.closeConn = enable
+	})
+}
+
+// WithProtocolBehavior sets the [Behavior] of the middleware on timeout for requests with the given major protocol
+// version (1 for HTTP/1.x, 2 for HTTP/2 and 3 for HTTP/3), since the right failure signal differs between them, e.g.
+// resetting the stream with HTTP/2 and sending the timeout response before closing the connection with HTTP/1.1.
+// It takes precedence over [WithAbortOnTimeout] and [WithCloseOnTimeout] for this protocol.
+func WithProtocolBehavior(major int, b Behavior) Option {
+	return optionFunc(func(c *config) {
+		if b < BehaviorRespond || b > BehaviorAbort {
+			c.invalid("unknown timeout behavior %d for HTTP/%d", b, major)
+			return
+		}
+		if c.behaviors == nil {
+			c.behaviors = make(map[int]Behavior)
+		}
+		c.behaviors[major] = b
+	})
+}
+
+// WithStatusCode sets the status code of the timeout response (e.g. 504 Gateway Timeout), with the status text in
+// its body. It replaces any response handler set with [WithResponse].
+func WithStatusCode(code int) Option {
+	return optionFunc(func(c *config) {
+		if code < 100 || code > 999 {
+			c.invalid("invalid status code %d", code)
+			return
+		}
+		c.status = code
+		c.resp = func(c fox.Context) {
+			http.Error(c.Writer(), http.StatusText(code), code)
+		}
+	})
+}
+
+// WithSourceStatus sets the status code of the timeout response for requests whose budget was decided by the given
+// source, so that the semantics match who owns the deadline: e.g. 408 Request Timeout when the budget was supplied by
+// the client through [WithRequestTimeout], and 503 or 504 when it comes from server policy. The status text is sent in
+// the body. It takes precedence over [WithStatusCode] and [WithResponse] for this source, but not over a fallback
+// registered with [SetFallback] or [WithRedirectOnTimeout].
+func WithSourceStatus(src Source, code int) Option {
+	return optionFunc(func(c *config) {
+		if src > SourceRequest {
+			c.invalid("unknown source %d", src)
+			return
+		}
+		if code < 100 || code > 999 {
+			c.invalid("invalid status code %d", code)
+			return
+		}
+		if c.sourceStatus == nil {
+			c.sourceStatus = make(map[Source]int)
+		}
+		c.sourceStatus[src] = code
+	})
+}
+
+// WithReasonHeader enables a response header, with the given name, set on the responses sent by the middleware
+// instead of the handler, and describing why: "deadline" when the deadline fired, "canceled" when the request was
+// canceled, "rejected" for routes configured with [Reject], "admission" for requests rejected by the admission
+// control, "maintenance" when the maintenance mode is enabled, and "shutdown" once [Timeout.Shutdown] is called. If name
+// is empty, [DefaultReasonHeader] is used.
+func WithReasonHeader(name string) Option {
+	return optionFunc(func(c *config) {
+		c.reasonHeader = cmp.Or(name, DefaultReasonHeader)
+	})
+}
+
+// WithRetryAfter sets the Retry-After header, rounded up to the second, on the responses sent by the middleware
+// instead of the handler, except for canceled requests. This tells well-behaved clients when to retry.
+func WithRetryAfter(d time.Duration) Option {
+	return optionFunc(func(c *config) {
+		if d < 0 {
+			c.invalid("negative retry after %s", d)
+		}
+		c.retryAfter = max(d, 0)
+	})
+}
+
+// WithStreaming disables the buffering of the response, so that it is sent to the client as the handler writes it,
+// which is required for streaming responses (e.g. server-sent events or a proxied upstream). The handler can flush
+// the response with [http.Flusher]. If the deadline fires after the handler started writing, the timeout response
+// can't be sent anymore, and the response is aborted instead, so that the client can tell it is truncated.
+func WithStreaming(enable bool) Option {
+	return optionFunc(func(c *config) {
+		c.stream = enable
+	})
+}
+
+// Well-known limits after which edges and load balancers give up on the response of the origin.
+const (
+	// CloudflareTimeout is the time Cloudflare waits for the origin to respond, before answering 524.
+	CloudflareTimeout = 100 * time.Second
+	// ALBIdleTimeout is the default idle timeout of the AWS Application Load Balancer.
+	ALBIdleTimeout = 60 * time.Second
+	// CloudFrontTimeout is the default origin response timeout of AWS CloudFront.
+	CloudFrontTimeout = 30 * time.Second
+)
+
+// edgeMargin is the margin kept below the limit of an edge by the clamp presets, so that the timeout response reaches
+// the edge before it gives up.
+const edgeMargin = time.Second
+
+// WithClamp caps the budget of every request to limit, whatever its source, after SLO scaling and client hints. If
+// limit is zero, budgets are not capped.
+func WithClamp(limit time.Duration) Option {
+	return optionFunc(func(c *config) {
+		if limit < 0 {
+			c.invalid("negative clamp %s", limit)
+			return
+		}
+		c.clamp = limit
+	})
+}
+
+// WithJitter randomizes the budget of every request within the given fraction of the budget (e.g. 0.1 for ±10%),
+// before clamping with [WithClamp], so that requests fanning out to the same backend don't all give up at the same
+// instant. The [Jitter] route option overrides the fraction for a route. If fraction is zero, budgets are not
+// randomized.
+func WithJitter(fraction float64) Option {
+	return optionFunc(func(c *config) {
+		if fraction < 0 || fraction >= 1 {
+			c.invalid("jitter fraction must be in the range [0, 1), got %g", fraction)
+			return
+		}
+		c.jitter = fraction
+	})
+}
+
+// Phases declares the budgets of the phases of a request enforced on top of the budget of the handler, see
+// [WithPhases]. A zero or negative duration disables the budget of the phase.
+type Phases struct {
+	// Read is the budget for reading the request body. The budget of the handler starts once the body is read.
+	Read time.Duration
+	// Write is the budget for sending the buffered response to the client.
+	Write time.Duration
+}
+
+// WithPhases splits the budget of a request into separate phases enforced together, so that slow clients are told
+// apart from slow handlers. The resolved budget only bounds the handler compute phase.
+//
+// While the handler reads a request body, the deadline is Phases.Read, and the budget of the handler starts once the
+// body is read to the end or closed, or once the handler writes to the response or returns, whichever comes first. If
+// the read deadline fires first, the request is answered with 408 Request Timeout and the connection is closed,
+// instead of the timeout response. Handlers of routes accepting a body must therefore read it before doing their work.
+//
+// Once the handler completes, the buffered response must be sent within Phases.Write, after which the connection
+// is closed. The write phase is not enforced in streaming mode, since the response is sent as the handler writes it.
+func WithPhases(p Phases) Option {
+	return optionFunc(func(c *config) {
+		c.phases = Phases{Read: max(p.Read, 0), Write: max(p.Write, 0)}
+	})
+}
+
+// BehindCloudflare returns a preset [Option] clamping budgets below the time Cloudflare waits for the origin to
+// respond, so that handlers never keep working after Cloudflare has already given up on the request. If timeout is
+// zero or negative (e.g. not raised on an Enterprise plan), [CloudflareTimeout] is used.
+func BehindCloudflare(timeout time.Duration) Option {
+	if timeout <= 0 {
+		timeout = CloudflareTimeout
+	}
+	return WithClamp(max(timeout-edgeMargin, timeout/2))
+}
+
+// BehindALB returns a preset [Option] clamping budgets below the idle timeout of an AWS Application Load Balancer. If
+// idle is zero or negative, [ALBIdleTimeout] is used.
+func BehindALB(idle time.Duration) Option {
+	if idle <= 0 {
+		idle = ALBIdleTimeout
+	}
+	return WithClamp(max(idle-edgeMargin, idle/2))
+}
+
+// BehindCloudFront returns a preset [Option] clamping budgets below the origin response timeout of AWS CloudFront. If
+// timeout is zero or negative, [CloudFrontTimeout] is used.
+func BehindCloudFront(timeout time.Duration) Option {
+	if timeout <= 0 {
+		timeout = CloudFrontTimeout
+	}
+	return WithClamp(max(timeout-edgeMargin, timeout/2))
+}
+
+// Gateway returns a preset [Option] for reverse proxies and gateways. It responds with 504 Gateway Timeout, sets the
+// [DefaultReasonHeader] header and the Retry-After header from retryAfter (if positive), and disables the buffering
+// of the response so that streaming upstreams are relayed as they come, see [WithStreaming]. Options given after the
+// preset override it.
+func Gateway(retryAfter time.Duration) Option {
+	return optionFunc(func(c *config) {
+		for _, opt := range []Option{
+			WithStatusCode(http.StatusGatewayTimeout),
+			WithReasonHeader(DefaultReasonHeader),
+			WithRetryAfter(retryAfter),
+			WithStreaming(true),
+		} {
+			opt.apply(c)
+		}
+	})
+}
+
+// WithClientHints adapts budgets to the network conditions reported by the client with the RTT, Downlink and
+// Save-Data client hint headers, when present, as described by [ClientHints]. Browsers only send these hints to
+// servers advertising them, e.g. with the "Accept-CH: RTT, Downlink, Save-Data" response header.
+func WithClientHints(h ClientHints) Option {
+	return optionFunc(func(c *config) {
+		if h.RoundTrips < 0 || h.SlowDownlink < 0 || h.MaxExtra < 0 {
+			c.invalid("negative client hints setting")
+		}
+		h = h.withDefaults()
+		c.hints = &h
+	})
+}
+
+// WithClientPenalty shrinks the budgets of clients that repeatedly exceed their deadline, as described by
+// [ClientPenalty], and restores them after good behavior. This is a lightweight abuse-mitigation layer: a client
+// sending expensive requests in a loop ends up with small budgets, while other clients are unaffected.
+func WithClientPenalty(p ClientPenalty) Option {
+	return optionFunc(func(c *config) {
+		if p.Threshold < 0 || p.Min < 0 || p.Recovery < 0 || p.MaxClients < 0 {
+			c.invalid("negative client penalty setting")
+		}
+		if p.Factor < 0 || p.Factor >= 1 {
+			c.invalid("client penalty factor must be in the range (0, 1), got %g", p.Factor)
+		}
+		c.penalty = newPenalties(p.withDefaults())
+	})
+}
+
+// WithRedirectOnTimeout implements the asynchronous redirect pattern for slow operations: when the deadline fires,
+// the middleware responds with 303 See Other to the status URL returned by fn for the request, while the handler
+// continues detached. Until then, the context of the handler reports the deadline as usual, see [CheckRemaining] and
+// [EffectiveTimeout]. Once the redirection is sent, it no longer has a deadline and is never canceled by the
+// middleware, nor when the request completes, and the handler is expected to publish its result where the status
+// URL can serve it, since its writes are discarded. If fn returns an empty URL, the timeout response is sent instead
+// and the context of the handler is canceled.
+func WithRedirectOnTimeout(fn func(c fox.Context) string) Option {
+	return optionFunc(func(c *config) {
+		if fn == nil {
+			c.invalid("nil redirect function")
+			return
+		}
+		c.redirect = fn
+	})
+}
+
+// WithRecentTimeouts keeps the last n requests that exceeded their deadline in memory, with their route, elapsed time,
+// budget and client, see [Timeout.RecentTimeouts] and [Timeout.RecentTimeoutsHandler].
+func WithRecentTimeouts(n int) Option {
+	return optionFunc(func(c *config) {
+		if n <= 0 {
+			c.invalid("recent timeouts capacity must be positive, got %d", n)
+			return
+		}
+		c.recent = newRecentTimeouts(n)
+	})
+}
+
+// WithPrecedence sets the order in which the sources of a timeout duration are consulted when several of them supply
+// a budget for a request: the first source supplying one wins. The order must list [SourceRequest], [SourceResolver]
+// and [SourceRoute] exactly once. By default, a timeout set in the request context with [WithRequestTimeout] takes
+// precedence over the [Resolver], which takes precedence over the route option. The winning source is reported by
+// [Event.Source] and by the debug header.
+func WithPrecedence(order ...Source) Option {
+	return optionFunc(func(c *config) {
+		if len(order) != len(defaultPrecedence) || !slices.Contains(order, SourceRequest) ||
+			!slices.Contains(order, SourceResolver) || !slices.Contains(order, SourceRoute) {
+			c.invalid("precedence must list the request, resolver and route sources exactly once, got %v", order)
+			return
+		}
+		c.precedence = slices.Clone(order)
+	})
+}
+
+// WithStrictWriteHeader turns superfluous WriteHeader calls by the handler into a [*SuperfluousWriteHeaderError]
+// returned by its subsequent writes, and an [EventSuperfluousWriteHeader] delivered to the hook registered with
+// [WithWarnHook] and to [Timeout.Watch], instead of only a log line, so that integration tests catch the bug. It is
+// disabled by default.
+func WithStrictWriteHeader(enable bool) Option {
+	return optionFunc(func(c *config) {
+		c.strictHeader = enable
+	})
+}
+
+// WithBeforeFlush registers a hook invoked with the buffered [Response] of every handler completing within its deadline,
+// before it is sent to the client. Since the whole response is buffered anyway, this allows post-processing responses
+// in one place (e.g. stamping headers or signing the body) at no extra cost. The hook is invoked synchronously, so it
+// should be simple and efficient. It is not invoked in streaming mode, where the response is not buffered.
+func WithBeforeFlush(fn FlushHook) Option {
+	return optionFunc(func(c *config) {
+		if fn == nil {
+			c.invalid("nil before flush hook")
+		}
+		c.beforeFlush = fn
+	})
+}
+
+// WithETag sets a strong ETag header computed from the buffered body of successful GET responses, unless the handler
+// already set one. If md5 is true, the Content-MD5 header is also set. When the ETag matches the If-None-Match header
+// of the request, a 304 Not Modified response is sent with an empty body instead, saving bandwidth. Since the
+// middleware buffers the whole response anyway, no extra copy is needed. The ETag is computed after the hook registered
+// with [WithBeforeFlush], and is not set in streaming mode, where the response is not buffered.
+func WithETag(md5 bool) Option {
+	return optionFunc(func(c *config) {
+		c.etag = &etagConfig{md5: md5}
+	})
+}
+
+// WithMicroCache enables a tiny in-memory cache of the successful buffered responses to GET requests, so that identical
+// hot requests within ttl are served from memory without calling the handler, amortizing the buffering cost the
+// middleware already incurs. Responses are cached per route and per key, as returned by the given [KeyFunc], or by
+// [RequestURIKey] if key is nil. Requests with an Authorization or a Cookie header, responses setting cookies, varying
+// on request headers or marked private, no-store or no-cache, and responses larger than 64KB are not cached, since
+// they may be personalized. Served responses carry an Age header. If ttl is zero or negative, the cache is disabled.
+func WithMicroCache(ttl time.Duration, key KeyFunc) Option {
+	return optionFunc(func(c *config) {
+		if ttl <= 0 {
+			c.cache = nil
+			return
+		}
+		c.cache = newMicroCache(ttl, key)
+	})
+}
+
+// WithServeStale degrades gracefully on timeout for read endpoints: when the cache enabled with [WithMicroCache] still
+// holds a previous successful response for the request, expired for less than maxStale, it is served with the Age and
+// Warning headers instead of the timeout response. A fallback set with [SetFallback] takes precedence. This option has
+// no effect without [WithMicroCache]. If maxStale is zero or negative, stale responses are never served.
+func WithServeStale(maxStale time.Duration) Option {
+	return optionFunc(func(c *config) {
+		c.stale = max(maxStale, 0)
+	})
+}
+
+// staleWindow returns how long expired responses are served on timeout, or zero without a cache.
+func (c *config) staleWindow() time.Duration {
+	if c.cache == nil {
+		return 0
+	}
+	return c.stale
+}
+
+// WithHeaderLimit bounds the number of response header values a handler can set, and their total size in bytes
+// including the keys, to protect against handlers accidentally accumulating unbounded header values. The limits are
+// checked when the status code is written. Beyond them, the headers are discarded, a 500 Internal Server Error is sent
+// instead, and the writes of the handler fail with a [*HeaderLimitError]. A zero or negative limit is unbounded.
+func WithHeaderLimit(maxCount, maxSize int) Option {
+	return optionFunc(func(c *config) {
+		if maxCount <= 0 && maxSize <= 0 {
+			c.headerLimits = nil
+			return
+		}
+		c.headerLimits = &headerLimits{count: max(maxCount, 0), size: max(maxSize, 0)}
+	})
+}
+
+// WithStripHopByHop strips the hop-by-hop headers (e.g. Connection, Keep-Alive and Transfer-Encoding, and those
+// listed by the Connection header) set by handlers, when the buffered headers are copied to the response. Handlers
+// should never set them, and they could corrupt the connection behind proxies. The headers are stripped before the
+// hook registered with [WithBeforeFlush] is invoked. It is disabled by default.
+func WithStripHopByHop(enable bool) Option {
+	return optionFunc(func(c *config) {
+		c.stripHop = enable
+	})
+}
+
+// WithWriter registers a constructor of custom response writers, called for each invocation of the handler with
+// the [Writer] of the middleware. The returned writer is passed to the handler instead, and typically embeds the
+// [Writer] to inherit its timeout-safety machinery, see [Writer] for an example.
+func WithWriter(fn func(w *Writer) fox.ResponseWriter) Option {
+	return optionFunc(func(c *config) {
+		c.writer = fn
+	})
+}
+
+// WithStrictLateWrites is a development mode for catching handlers that ignore the cancellation of the request
+// context, which must not be enabled in production. The first write attempted by a handler after the deadline is
+// logged at the error level with its caller, instead of only failing with a [*WriteAfterTimeoutError]. If panics is
+// true, every such write panics with the [*WriteAfterTimeoutError] instead, and since the response was already sent,
+// the panic is re-raised by the middleware in the goroutine of the handler, which crashes the program. This is only
+// meant for tests, where it fails the run. The writes of an attempt superseded by a retry or a hedge, see [Retry] and
+// [Hedge], are expected and never reported.
+func WithStrictLateWrites(panics bool) Option {
+	return optionFunc(func(c *config) {
+		c.strictLate = strictLateLog
+		if panics {
+			c.strictLate = strictLatePanic
+		}
+	})
+}
+
+// WithInterimResponses emits an interim response with the given informational status code every interval while the
+// handler runs, preventing intermediaries from dropping the connection on idle timeout for legitimately slow endpoints
+// running under a long budget. If code is zero, 102 Processing is used. Interim responses are not sent to HTTP/1.0
+// clients, which don't support them, nor once the handler started streaming its response.
+func WithInterimResponses(interval time.Duration, code int) Option {
+	return optionFunc(func(c *config) {
+		code = cmp.Or(code, http.StatusProcessing)
+		if interval <= 0 {
+			c.invalid("interim response interval must be positive, got %s", interval)
+			return
+		}
+		if code < 100 || code > 199 || code == http.StatusSwitchingProtocols {
+			c.invalid("interim response status code must be informational, got %d", code)
+			return
+		}
+		c.interim = &interimConfig{interval: interval, code: code}
+	})
+}
+
+// WithWarnHook registers a hook invoked with an [EventWarning] when a request of a route configured with [Thresholds]
+// is still running after its warn threshold, and with an [EventSuperfluousWriteHeader] if enabled with
+// [WithStrictWriteHeader]. The hook is invoked synchronously, by the middleware while the handler keeps running, or by
+// the handler itself on a superfluous WriteHeader call, so it should return quickly.
+func WithWarnHook(hook TimeoutHook) Option {
+	return optionFunc(func(c *config) {
+		if hook == nil {
+			c.invalid("nil warn hook")
+			return
+		}
+		c.warnHook = hook
+	})
+}
@@ -0,0 +1,164 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"errors"
+	"github.com/tigerwill90/fox"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPenaltyThreshold  = 3
+	defaultPenaltyFactor     = 0.5
+	defaultPenaltyRecovery   = 5
+	defaultPenaltyMaxClients = 10000
+	// maxPenaltySteps bounds how many times the budget of a client is shrunk by the penalty factor.
+	maxPenaltySteps = 8
+)
+
+// ClientPenalty configures how the budgets of clients repeatedly exceeding their deadline are shrunk, see
+// [WithClientPenalty]. Each timeout of a client adds a strike, and each [ClientPenalty.Recovery] requests completed
+// within their budget remove one. Once a client reaches [ClientPenalty.Threshold] strikes, its budgets are multiplied
+// by [ClientPenalty.Factor] for each strike from the threshold, so the work a misbehaving client can tie up shrinks
+// quickly and is restored after good behavior.
+type ClientPenalty struct {
+	// Key identifies the client of a request. It defaults to [ClientIPKey]. Requests with an empty key are not
+	// tracked.
+	Key KeyFunc
+	// Threshold is the number of strikes from which budgets are shrunk. It defaults to 3.
+	Threshold int
+	// Factor is the factor applied to the budget for each strike from the threshold, in the range (0, 1). It defaults
+	// to 0.5.
+	Factor float64
+	// Min is the minimum budget of a penalized client. Zero leaves the budget unbounded below.
+	Min time.Duration
+	// Recovery is the number of requests completed within their budget that removes one strike. It defaults to 5.
+	Recovery int
+	// MaxClients bounds the number of penalized clients tracked in memory. It defaults to 10000.
+	MaxClients int
+}
+
+func (p ClientPenalty) withDefaults() ClientPenalty {
+	if p.Key == nil {
+		p.Key = ClientIPKey
+	}
+	if p.Threshold <= 0 {
+		p.Threshold = defaultPenaltyThreshold
+	}
+	if p.Factor <= 0 || p.Factor >= 1 {
+		p.Factor = defaultPenaltyFactor
+	}
+	if p.Recovery <= 0 {
+		p.Recovery = defaultPenaltyRecovery
+	}
+	if p.MaxClients <= 0 {
+		p.MaxClients = defaultPenaltyMaxClients
+	}
+	return p
+}
+
+// ClientIPKey is a [KeyFunc] that identifies the client of a request by its IP address, as returned by
+// [fox.Context.ClientIP], or by the address of the peer if no client IP resolver is configured on the router. The key
+// is empty if the address can't be determined.
+func ClientIPKey(c fox.Context) string {
+	ip, err := c.ClientIP()
+	if errors.Is(err, fox.ErrNoClientIPResolver) {
+		// A failing resolver must not fall back to the peer address, which is the address of the proxy for all the
+		// clients behind it.
+		ip, err = c.RemoteIP(), nil
+	}
+	if err != nil || ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+type clientRecord struct {
+	strikes int
+	good    int
+}
+
+// penalties tracks the strikes of the clients exceeding their deadline.
+type penalties struct {
+	clients map[string]*clientRecord
+	cfg     ClientPenalty
+	mu      sync.Mutex
+}
+
+func newPenalties(p ClientPenalty) *penalties {
+	return &penalties{
+		clients: make(map[string]*clientRecord),
+		cfg:     p,
+	}
+}
+
+// scale shrinks the budget dt of the client of the request according to its strikes.
+func (p *penalties) scale(c fox.Context, dt time.Duration) time.Duration {
+	k := p.cfg.Key(c)
+	if k == "" {
+		return dt
+	}
+	p.mu.Lock()
+	r := p.clients[k]
+	var strikes int
+	if r != nil {
+		strikes = r.strikes
+	}
+	p.mu.Unlock()
+
+	if strikes < p.cfg.Threshold {
+		return dt
+	}
+	steps := min(strikes-p.cfg.Threshold+1, maxPenaltySteps)
+	shrunk := time.Duration(float64(dt) * math.Pow(p.cfg.Factor, float64(steps)))
+	return min(dt, max(shrunk, p.cfg.Min))
+}
+
+// record updates the strikes of the client of the request according to the outcome of the request.
+func (p *penalties) record(c fox.Context, o outcome) {
+	if o != outcomeTimeout && o != outcomeCompleted {
+		return
+	}
+	k := p.cfg.Key(c)
+	if k == "" {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	r := p.clients[k]
+	if o == outcomeCompleted {
+		// Only penalized clients are tracked, so that well-behaved clients don't use memory.
+		if r == nil {
+			return
+		}
+		r.good++
+		if r.good >= p.cfg.Recovery {
+			r.good = 0
+			r.strikes--
+			if r.strikes == 0 {
+				delete(p.clients, k)
+			}
+		}
+		return
+	}
+
+	if r == nil {
+		if len(p.clients) >= p.cfg.MaxClients {
+			// Evict an arbitrary client to bound the memory used by clients rotating their keys.
+			for victim := range p.clients {
+				delete(p.clients, victim)
+				break
+			}
+		}
+		r = &clientRecord{}
+		p.clients[k] = r
+	}
+	r.good = 0
+	r.strikes = min(r.strikes+1, p.cfg.Threshold+maxPenaltySteps-1)
+}
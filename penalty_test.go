@@ -0,0 +1,88 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tigerwill90/fox"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMiddleware_WithClientPenalty(t *testing.T) {
+	tm := New(40*time.Millisecond, WithPolicyHeader(""), WithClientPenalty(ClientPenalty{
+		Key: func(c fox.Context) string {
+			return c.Request().Header.Get("X-Client")
+		},
+		Threshold: 2,
+		Recovery:  2,
+	}))
+	f, err := fox.New(fox.WithMiddleware(tm.Timeout))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/fast", func(c fox.Context) {
+		c.Writer().WriteHeader(http.StatusOK)
+	})
+	f.MustHandle(http.MethodGet, "/slow", func(c fox.Context) {
+		<-c.Request().Context().Done()
+	})
+
+	serve := func(client, path string) (int, string) {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("X-Client", client)
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, req)
+		return w.Code, w.Header().Get(DefaultPolicyHeader)
+	}
+
+	for range 2 {
+		code, _ := serve("abuser", "/slow")
+		require.Equal(t, http.StatusServiceUnavailable, code)
+	}
+
+	_, policy := serve("abuser", "/fast")
+	assert.Equal(t, "budget=20ms; source=default", policy)
+	_, policy = serve("other", "/fast")
+	assert.Equal(t, "budget=40ms; source=default", policy)
+
+	// The second request completed within its budget removes a strike, which restores the budget.
+	_, policy = serve("abuser", "/fast")
+	assert.Equal(t, "budget=20ms; source=default", policy)
+	_, policy = serve("abuser", "/fast")
+	assert.Equal(t, "budget=40ms; source=default", policy)
+	assert.Equal(t, "foxtimeout{default=40ms penalty policy=Timeout-Policy}", tm.String())
+}
+
+func TestClientIPKey(t *testing.T) {
+	f, err := fox.New()
+	require.NoError(t, err)
+	var key string
+	f.MustHandle(http.MethodGet, "/foo", func(c fox.Context) {
+		key = ClientIPKey(c)
+	})
+
+	// Without a client IP resolver configured on the router, the peer address is used.
+	req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	f.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "192.0.2.1", key)
+
+	// A failing resolver doesn't fall back to the peer address, which would be the proxy for every client.
+	f, err = fox.New(fox.WithClientIPResolver(fox.ClientIPResolverFunc(func(c fox.Context) (*net.IPAddr, error) {
+		return nil, errors.New("missing forwarded header")
+	})))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo", func(c fox.Context) {
+		key = ClientIPKey(c)
+	})
+	req = httptest.NewRequest(http.MethodGet, "/foo", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	f.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Empty(t, key)
+}
@@ -0,0 +1,47 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"io"
+)
+
+// newPhaseReader returns a reader of the request body which ends the read phase of st, see [WithPhases], by calling
+// done once the body is read to the end or closed. The middleware also calls end once the handler writes to the
+// response or returns.
+func newPhaseReader(body io.ReadCloser, st *requestState, done func()) *phaseReader {
+	st.reading.Store(true)
+	return &phaseReader{
+		ReadCloser: body,
+		st:         st,
+		done:       done,
+	}
+}
+
+type phaseReader struct {
+	io.ReadCloser
+	st   *requestState
+	done func()
+}
+
+func (r *phaseReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err == io.EOF {
+		r.end()
+	}
+	return n, err
+}
+
+func (r *phaseReader) Close() error {
+	r.end()
+	return r.ReadCloser.Close()
+}
+
+// end switches to the compute phase, unless already done.
+func (r *phaseReader) end() {
+	if r.st.reading.CompareAndSwap(true, false) {
+		r.done()
+	}
+}
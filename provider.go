@@ -0,0 +1,54 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"context"
+	"time"
+)
+
+// Policy holds the settings of a [Timeout] middleware that can be updated at runtime.
+type Policy struct {
+	// Default is the default timeout duration. A zero or negative duration disables the middleware.
+	Default time.Duration
+}
+
+// Provider defines the interface for sourcing a [Policy] from an external system such as Consul, etcd
+// or a feature-flag service.
+type Provider interface {
+	// Get returns the current policy.
+	Get(ctx context.Context) (Policy, error)
+	// Watch returns a channel that delivers policy updates until ctx is canceled or the channel is closed.
+	Watch(ctx context.Context) (<-chan Policy, error)
+}
+
+// Sync loads the current policy from the [Provider] and then applies every update received from it, until
+// ctx is canceled or the watch channel is closed. Updates are applied atomically between requests, see [Timeout.SetPolicy].
+// Sync blocks and is typically run in its own goroutine. It returns nil if the watch channel is closed, or the
+// context error if ctx is canceled.
+func (t *Timeout) Sync(ctx context.Context, p Provider) error {
+	policy, err := p.Get(ctx)
+	if err != nil {
+		return err
+	}
+	t.SetPolicy(policy)
+
+	updates, err := p.Watch(ctx)
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case policy, ok := <-updates:
+			if !ok {
+				return nil
+			}
+			t.SetPolicy(policy)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"encoding/json"
+	"github.com/tigerwill90/fox"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RecentTimeout describes a request that recently exceeded its deadline, see [WithRecentTimeouts].
+type RecentTimeout struct {
+	// Time is the time at which the deadline fired.
+	Time time.Time
+	// Method is the request method.
+	Method string
+	// Route is the matched route pattern, if any.
+	Route string
+	// Client is the IP address of the client as returned by [ClientIPKey], or empty if it can't be determined.
+	Client string
+	// Elapsed is the time elapsed between the start of the request and the deadline.
+	Elapsed time.Duration
+	// Budget is the timeout duration applied to the request.
+	Budget time.Duration
+}
+
+// recentTimeouts is a ring buffer of the last timeouts.
+type recentTimeouts struct {
+	entries []RecentTimeout
+	next    int
+	full    bool
+	mu      sync.Mutex
+}
+
+func newRecentTimeouts(n int) *recentTimeouts {
+	return &recentTimeouts{entries: make([]RecentTimeout, n)}
+}
+
+func (r *recentTimeouts) record(c fox.Context, now time.Time, st *requestState) {
+	e := RecentTimeout{
+		Time:    now,
+		Method:  c.Request().Method,
+		Elapsed: now.Sub(st.start),
+		Budget:  st.budget,
+	}
+	if route := c.Route(); route != nil {
+		e.Route = route.Pattern()
+	}
+	e.Client = ClientIPKey(c)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries[r.next] = e
+	r.next++
+	if r.next == len(r.entries) {
+		r.next = 0
+		r.full = true
+	}
+}
+
+// capacity returns the number of timeouts kept in memory, or zero if r is nil.
+func (r *recentTimeouts) capacity() int {
+	if r == nil {
+		return 0
+	}
+	return len(r.entries)
+}
+
+// report returns the recorded timeouts, most recent first.
+func (r *recentTimeouts) report() []RecentTimeout {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := r.next
+	if r.full {
+		n = len(r.entries)
+	}
+	out := make([]RecentTimeout, 0, n)
+	for i := range n {
+		out = append(out, r.entries[(r.next-1-i+len(r.entries))%len(r.entries)])
+	}
+	return out
+}
+
+// RecentTimeouts returns the last requests that exceeded their deadline, most recent first, or nil if not enabled
+// with [WithRecentTimeouts].
+func (t *Timeout) RecentTimeouts() []RecentTimeout {
+	if t.cfg.recent == nil {
+		return nil
+	}
+	return t.cfg.recent.report()
+}
+
+// RecentTimeoutsHandler returns a [fox.HandlerFunc] that dumps the last requests that exceeded their deadline as JSON,
+// most recent first, giving instant visibility on what just timed out during incidents. Durations are encoded as
+// strings (e.g. "2s"). The handler is meant to be mounted on a debug route, since it exposes client addresses.
+func (t *Timeout) RecentTimeoutsHandler() fox.HandlerFunc {
+	type entry struct {
+		Time    time.Time `json:"time"`
+		Method  string    `json:"method"`
+		Route   string    `json:"route"`
+		Client  string    `json:"client,omitempty"`
+		Elapsed string    `json:"elapsed"`
+		Budget  string    `json:"budget"`
+	}
+	return func(c fox.Context) {
+		recent := t.RecentTimeouts()
+		entries := make([]entry, len(recent))
+		for i, e := range recent {
+			entries[i] = entry{
+				Time:    e.Time,
+				Method:  e.Method,
+				Route:   e.Route,
+				Client:  e.Client,
+				Elapsed: e.Elapsed.String(),
+				Budget:  e.Budget.String(),
+			}
+		}
+		b, err := json.Marshal(entries)
+		if err != nil {
+			http.Error(c.Writer(), err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_ = c.Blob(http.StatusOK, "application/json", b)
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tigerwill90/fox"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTimeout_RecentTimeouts(t *testing.T) {
+	tm := New(50*time.Microsecond, WithRecentTimeouts(2))
+	f, err := fox.New()
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo/{id}", success201response, fox.WithMiddleware(tm.Timeout))
+	f.MustHandle(http.MethodGet, "/bar", success201response, fox.WithMiddleware(tm.Timeout))
+	f.MustHandle(http.MethodGet, "/debug/timeouts", tm.RecentTimeoutsHandler())
+
+	for _, path := range []string{"/foo/1", "/foo/2", "/bar"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, req)
+		require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	}
+
+	recent := tm.RecentTimeouts()
+	require.Len(t, recent, 2)
+	assert.Equal(t, "/bar", recent[0].Route)
+	assert.Equal(t, "/foo/{id}", recent[1].Route)
+	assert.Equal(t, "192.0.2.1", recent[0].Client)
+	assert.Equal(t, 50*time.Microsecond, recent[0].Budget)
+
+	req := httptest.NewRequest(http.MethodGet, "/debug/timeouts", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	var entries []map[string]any
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &entries))
+	require.Len(t, entries, 2)
+	assert.Equal(t, "/bar", entries[0]["route"])
+	assert.Equal(t, "GET", entries[0]["method"])
+	assert.Equal(t, "192.0.2.1", entries[0]["client"])
+	assert.Equal(t, "50µs", entries[0]["budget"])
+
+	// A failing client IP resolver doesn't fall back to the peer address.
+	tm = New(50*time.Microsecond, WithRecentTimeouts(1))
+	f, err = fox.New(fox.WithClientIPResolver(fox.ClientIPResolverFunc(func(c fox.Context) (*net.IPAddr, error) {
+		return nil, errors.New("missing forwarded header")
+	})))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo", success201response, fox.WithMiddleware(tm.Timeout))
+	req = httptest.NewRequest(http.MethodGet, "/foo", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	f.ServeHTTP(httptest.NewRecorder(), req)
+	recent = tm.RecentTimeouts()
+	require.Len(t, recent, 1)
+	assert.Empty(t, recent[0].Client)
+}
@@ -0,0 +1,57 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"errors"
+	"runtime"
+	"strings"
+)
+
+const pkgPath = "github.com/tigerwill90/foxtimeout"
+
+// maxRecoveryDepth is the number of caller frames inspected to find a recovery middleware.
+const maxRecoveryDepth = 64
+
+// ErrNoRecovery is the panic value raised on every request when [WithRequireRecovery] is enabled and the middleware
+// doesn't run inside a recovery middleware.
+var ErrNoRecovery = errors.New("foxtimeout: the timeout middleware must run inside a recovery middleware")
+
+// hasRecoveryFrame reports whether the middleware runs inside a recovery middleware. Middlewares are nested calls, so
+// an outer recovery middleware has a frame on the stack between the router and this middleware, and is identified by
+// a function name containing "recover" (e.g. fox.CustomRecoveryWithLogHandler). This is a heuristic: a recovery
+// middleware with another name, or a recovery handler wrapping the router itself, is not detected.
+func hasRecoveryFrame() bool {
+	pc := make([]uintptr, maxRecoveryDepth)
+	n := runtime.Callers(1, pc)
+	frames := runtime.CallersFrames(pc[:n])
+	for {
+		frame, more := frames.Next()
+		switch {
+		case strings.HasPrefix(frame.Function, pkgPath+"."):
+		case strings.HasSuffix(frame.Function, ".ServeHTTP"):
+			return false
+		case strings.Contains(strings.ToLower(frame.Function), "recover"):
+			return true
+		}
+		if !more {
+			return false
+		}
+	}
+}
+
+// checkOrdering runs the middleware ordering sanity check once, on the first request, and reports whether the
+// middleware runs inside a recovery middleware.
+func (t *Timeout) checkOrdering() bool {
+	t.orderingOnce.Do(func() {
+		t.hasRecovery = hasRecoveryFrame()
+		if !t.hasRecovery {
+			t.cfg.logger.Warn(
+				"foxtimeout: the timeout middleware doesn't run inside a recovery middleware, panics in handlers may crash the server",
+			)
+		}
+	})
+	return t.hasRecovery
+}
@@ -0,0 +1,70 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tigerwill90/fox"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMiddleware_RecoveryCheck(t *testing.T) {
+	cases := []struct {
+		name     string
+		outer    []fox.MiddlewareFunc
+		wantWarn bool
+	}{
+		{
+			name:  "inside recovery",
+			outer: []fox.MiddlewareFunc{fox.Recovery()},
+		},
+		{
+			name:     "outside recovery",
+			wantWarn: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			mws := append(tc.outer, Middleware(time.Second, WithLogger(slog.New(slog.NewTextHandler(buf, nil)))))
+			f, err := fox.New(fox.WithMiddleware(mws...))
+			require.NoError(t, err)
+			f.MustHandle(http.MethodGet, "/foo", success201response)
+
+			for range 2 {
+				req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+				w := httptest.NewRecorder()
+				f.ServeHTTP(w, req)
+				assert.Equal(t, http.StatusCreated, w.Code)
+			}
+
+			if tc.wantWarn {
+				assert.Equal(t, 1, bytes.Count(buf.Bytes(), []byte("level=WARN")))
+				return
+			}
+			assert.Empty(t, buf.String())
+		})
+	}
+}
+
+func TestMiddleware_WithRequireRecovery(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(new(bytes.Buffer), nil))
+	f, err := fox.New(fox.WithMiddleware(Middleware(time.Second, WithRequireRecovery(), WithLogger(logger))))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo", success201response)
+
+	req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	w := httptest.NewRecorder()
+	assert.PanicsWithValue(t, ErrNoRecovery, func() {
+		f.ServeHTTP(w, req)
+	})
+}
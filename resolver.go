@@ -0,0 +1,515 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"fmt"
+	"github.com/tigerwill90/fox"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Window describes a recurring time window during which a specific timeout applies. Hours are expressed
+// in the range [0, 24]. The window starts at Start (inclusive) and ends at End (exclusive). If Start is greater
+// than End, the window wraps past midnight and Days refer to the day on which the window starts. If Start equals End,
+// the window spans the whole day. If Days is empty, the window applies every day of the week.
+type Window struct {
+	Days    []time.Weekday
+	Start   int
+	End     int
+	Timeout time.Duration
+}
+
+func (w Window) contains(t time.Time) bool {
+	h := t.Hour()
+	switch {
+	case w.Start == w.End:
+		return w.onDay(t.Weekday())
+	case w.Start < w.End:
+		return h >= w.Start && h < w.End && w.onDay(t.Weekday())
+	default:
+		if h >= w.Start {
+			return w.onDay(t.Weekday())
+		}
+		return h < w.End && w.onDay(t.AddDate(0, 0, -1).Weekday())
+	}
+}
+
+func (w Window) onDay(d time.Weekday) bool {
+	return len(w.Days) == 0 || slices.Contains(w.Days, d)
+}
+
+type scheduleResolver struct {
+	loc     *time.Location
+	windows []Window
+	now     func() time.Time
+}
+
+// ScheduleResolver returns a [Resolver] that applies the timeout of the first [Window] matching the current time
+// in the given location (e.g. looser budgets during nightly batch windows, tighter during peak hours). If no window
+// matches, the default timeout is applied. If loc is nil, [time.Local] is used.
+func ScheduleResolver(loc *time.Location, windows ...Window) Resolver {
+	if loc == nil {
+		loc = time.Local
+	}
+	return &scheduleResolver{
+		loc:     loc,
+		windows: windows,
+		now:     time.Now,
+	}
+}
+
+func (r *scheduleResolver) Resolve(_ fox.Context) (time.Duration, bool) {
+	now := r.now().In(r.loc)
+	for _, w := range r.windows {
+		if w.contains(now) {
+			return w.Timeout, true
+		}
+	}
+	return 0, false
+}
+
+// KeyFunc returns the key identifying a request, e.g. for caching purpose.
+type KeyFunc func(c fox.Context) string
+
+// RouteKey is a [KeyFunc] that identifies a request by its method and route pattern. Requests that do not match any
+// route are only identified by their method, so that clients can't grow the cardinality of the keys with arbitrary
+// paths.
+func RouteKey(c fox.Context) string {
+	if route := c.Route(); route != nil {
+		return c.Request().Method + " " + route.Pattern()
+	}
+	return c.Request().Method
+}
+
+// maxCachedResolutions bounds the number of results kept by [CachedResolver]. Once full, expired results are evicted,
+// and new results are not cached until room is made.
+const maxCachedResolutions = 1024
+
+type cachedResolution struct {
+	expires time.Time
+	dt      time.Duration
+	ok      bool
+}
+
+// resolveCall is a call to the resolver in progress, which concurrent requests with the same key wait for.
+type resolveCall struct {
+	done chan struct{}
+	dt   time.Duration
+	ok   bool
+}
+
+type cachedResolver struct {
+	resolver Resolver
+	key      KeyFunc
+	now      func() time.Time
+	entries  map[string]cachedResolution
+	calls    map[string]*resolveCall
+	ttl      time.Duration
+	mu       sync.RWMutex
+}
+
+// CachedResolver returns a [Resolver] that caches the result of r for the given ttl, so that expensive resolvers
+// (e.g. database or remote lookups) don't add their own latency to every request. Results are keyed by the given
+// [KeyFunc] or by [RouteKey] if key is nil, and concurrent requests with the same key share a single call to r. The
+// cache holds at most 1024 results: once full, expired results are evicted, and results for new keys are not cached
+// until room is made, so the key should have a bounded cardinality.
+func CachedResolver(r Resolver, ttl time.Duration, key KeyFunc) Resolver {
+	if key == nil {
+		key = RouteKey
+	}
+	return &cachedResolver{
+		resolver: r,
+		key:      key,
+		ttl:      ttl,
+		now:      time.Now,
+		entries:  make(map[string]cachedResolution),
+		calls:    make(map[string]*resolveCall),
+	}
+}
+
+func (r *cachedResolver) Resolve(c fox.Context) (time.Duration, bool) {
+	k := r.key(c)
+	now := r.now()
+
+	r.mu.RLock()
+	e, found := r.entries[k]
+	r.mu.RUnlock()
+	if found && now.Before(e.expires) {
+		return e.dt, e.ok
+	}
+
+	r.mu.Lock()
+	if e, found := r.entries[k]; found && now.Before(e.expires) {
+		r.mu.Unlock()
+		return e.dt, e.ok
+	}
+	if call, found := r.calls[k]; found {
+		r.mu.Unlock()
+		<-call.done
+		return call.dt, call.ok
+	}
+	call := &resolveCall{done: make(chan struct{})}
+	r.calls[k] = call
+	r.mu.Unlock()
+
+	completed := false
+	defer func() {
+		// The waiting requests are released even if the resolver panics, in which case they apply the default
+		// timeout.
+		r.mu.Lock()
+		delete(r.calls, k)
+		if completed {
+			r.storeLocked(k, cachedResolution{dt: call.dt, ok: call.ok, expires: now.Add(r.ttl)}, now)
+		}
+		r.mu.Unlock()
+		close(call.done)
+	}()
+	call.dt, call.ok = r.resolver.Resolve(c)
+	completed = true
+	return call.dt, call.ok
+}
+
+// storeLocked caches the result for the key, evicting the expired results if the cache is full.
+func (r *cachedResolver) storeLocked(k string, e cachedResolution, now time.Time) {
+	if _, found := r.entries[k]; !found && len(r.entries) >= maxCachedResolutions {
+		for key, old := range r.entries {
+			if !now.Before(old.expires) {
+				delete(r.entries, key)
+			}
+		}
+		if len(r.entries) >= maxCachedResolutions {
+			return
+		}
+	}
+	r.entries[k] = e
+}
+
+type uploadResolver struct {
+	base time.Duration
+	rate int64
+}
+
+// UploadResolver returns a [Resolver] that scales the timeout with the size of the request body declared by the
+// Content-Length header: the timeout is base plus the time needed to transfer the body at the minimum acceptable
+// throughput, in bytes per second. A 2GB upload gets a proportionate deadline, while stalled transfers are still
+// caught. If the request doesn't declare its body size, or if rate is zero or negative, the default timeout is applied.
+func UploadResolver(base time.Duration, rate int64) Resolver {
+	return &uploadResolver{
+		base: base,
+		rate: rate,
+	}
+}
+
+func (r *uploadResolver) Resolve(c fox.Context) (time.Duration, bool) {
+	cl := c.Request().ContentLength
+	if cl <= 0 || r.rate <= 0 {
+		return 0, false
+	}
+	transfer := float64(cl) / float64(r.rate) * float64(time.Second)
+	if transfer >= float64(math.MaxInt64-r.base) {
+		return math.MaxInt64, true
+	}
+	return r.base + time.Duration(transfer), true
+}
+
+// CostFunc returns the cost of a request (e.g. the estimated complexity of a GraphQL or search query), or a negative
+// value if the cost is unknown.
+type CostFunc func(c fox.Context) int
+
+// CostCurve maps the cost of a request to its timeout duration.
+type CostCurve func(cost int) time.Duration
+
+// LinearCost returns a [CostCurve] granting base plus perUnit for each unit of cost, capped to limit. If limit is zero
+// or negative, the duration is not capped. The duration saturates rather than overflows for huge costs, which may be
+// derived from the request.
+func LinearCost(base, perUnit, limit time.Duration) CostCurve {
+	return func(cost int) time.Duration {
+		dt := time.Duration(math.MaxInt64)
+		if perUnit <= 0 || cost <= 0 || time.Duration(cost) <= (math.MaxInt64-max(base, 0))/perUnit {
+			dt = base + time.Duration(cost)*perUnit
+		}
+		if limit > 0 {
+			dt = min(dt, limit)
+		}
+		return dt
+	}
+}
+
+type costResolver struct {
+	cost  CostFunc
+	curve CostCurve
+}
+
+// CostResolver returns a [Resolver] that grants more time to expensive requests and less to trivial ones, by mapping
+// the cost of each request to a timeout duration with the given curve. If the cost is unknown, the default timeout
+// is applied.
+func CostResolver(cost CostFunc, curve CostCurve) Resolver {
+	return &costResolver{
+		cost:  cost,
+		curve: curve,
+	}
+}
+
+func (r *costResolver) Resolve(c fox.Context) (time.Duration, bool) {
+	cost := r.cost(c)
+	if cost < 0 {
+		return 0, false
+	}
+	return r.curve(cost), true
+}
+
+type paramResolver struct {
+	budgets map[string]time.Duration
+	name    string
+}
+
+// ParamResolver returns a [Resolver] that applies the timeout associated with the value of the named path parameter
+// of the route (e.g. per-report budgets for "/reports/{report}"), since many APIs encode the expensive dimension
+// directly in the path. If the route doesn't have the parameter, or if its value has no associated timeout,
+// the default timeout is applied. The map is copied, so later modifications don't affect the resolver.
+func ParamResolver(name string, budgets map[string]time.Duration) Resolver {
+	return &paramResolver{
+		budgets: maps.Clone(budgets),
+		name:    name,
+	}
+}
+
+func (r *paramResolver) Resolve(c fox.Context) (time.Duration, bool) {
+	v := c.Param(r.name)
+	if v == "" {
+		return 0, false
+	}
+	dt, ok := r.budgets[v]
+	return dt, ok
+}
+
+type acceptResolver struct {
+	budgets map[string]time.Duration
+	types   []string
+}
+
+// AcceptResolver returns a [Resolver] that applies the timeout associated with the media type negotiated from the
+// Accept header of the request (e.g. 60s for "text/csv" and "application/pdf" exports, and 2s for
+// "application/json"), for endpoints whose cost depends on the requested representation. The negotiated type is the
+// one with the highest quality among the types of budgets, matched by the most specific media range of the header
+// (e.g. "text/csv" over "text/*"). Types only matched by "*/*" are not negotiated, since the client has no preference.
+// If the header is absent or doesn't select any of the types, the default timeout is applied. Media types are case
+// insensitive, and the map is copied, so later modifications don't affect the resolver.
+func AcceptResolver(budgets map[string]time.Duration) Resolver {
+	r := &acceptResolver{budgets: make(map[string]time.Duration, len(budgets))}
+	for mt, dt := range budgets {
+		r.budgets[strings.ToLower(strings.TrimSpace(mt))] = dt
+	}
+	// Types are sorted, so that ties are broken deterministically.
+	r.types = slices.Sorted(maps.Keys(r.budgets))
+	return r
+}
+
+func (r *acceptResolver) Resolve(c fox.Context) (time.Duration, bool) {
+	accept := c.Request().Header.Values("Accept")
+	if len(accept) == 0 {
+		return 0, false
+	}
+	var (
+		best     string
+		bestQ    float64
+		bestSpec int
+	)
+	for _, mt := range r.types {
+		q, spec := acceptQuality(accept, mt)
+		if spec < 1 || q <= 0 {
+			continue
+		}
+		if q > bestQ || (q == bestQ && spec > bestSpec) {
+			best, bestQ, bestSpec = mt, q, spec
+		}
+	}
+	if best == "" {
+		return 0, false
+	}
+	return r.budgets[best], true
+}
+
+// acceptQuality returns the quality of the media type mt given by the most specific media range of the Accept header
+// values matching it, and the specificity of that range: 2 for the type itself, 1 for a subtype wildcard (e.g.
+// "text/*"), 0 for "*/*", and -1 if no range matches.
+func acceptQuality(accept []string, mt string) (q float64, spec int) {
+	spec = -1
+	typ, _, _ := strings.Cut(mt, "/")
+	for _, v := range accept {
+		for _, part := range strings.Split(v, ",") {
+			rng, params, _ := strings.Cut(part, ";")
+			rng = strings.ToLower(strings.TrimSpace(rng))
+			s := -1
+			switch rng {
+			case mt:
+				s = 2
+			case typ + "/*":
+				s = 1
+			case "*/*":
+				s = 0
+			}
+			if s > spec {
+				spec, q = s, acceptQ(params)
+			}
+		}
+	}
+	return q, spec
+}
+
+// acceptQ returns the weight of the q parameter of a media range, or 1 if it has none or if it is invalid.
+func acceptQ(params string) float64 {
+	for _, p := range strings.Split(params, ";") {
+		k, v, ok := strings.Cut(p, "=")
+		if !ok || !strings.EqualFold(strings.TrimSpace(k), "q") {
+			continue
+		}
+		q, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil || q < 0 || q > 1 {
+			return 1
+		}
+		return q
+	}
+	return 1
+}
+
+// EnvoyExpectedTimeoutHeader is the header set by Envoy with the timeout it enforces on the request, in milliseconds.
+const EnvoyExpectedTimeoutHeader = "X-Envoy-Expected-Rq-Timeout-Ms"
+
+type envoyResolver struct {
+	envoy Resolver
+	grpc  Resolver
+}
+
+// EnvoyResolver returns a [Resolver] that applies the timeout enforced by Envoy, as declared by the
+// x-envoy-expected-rq-timeout-ms header, falling back to the grpc-timeout header, so that services behind Envoy or
+// Istio automatically align their budgets with what the mesh enforces anyway. Both headers can be set by clients
+// reaching the service without going through the mesh, so they are bounded and trusted according to opts, like with
+// [HeaderResolver]. If neither header is valid and trusted, the default timeout is applied.
+func EnvoyResolver(opts HeaderOptions) Resolver {
+	return &envoyResolver{
+		envoy: HeaderResolver(EnvoyExpectedTimeoutHeader, parseEnvoyTimeout, opts),
+		grpc:  HeaderResolver("Grpc-Timeout", parseGRPCTimeout, opts),
+	}
+}
+
+func (r *envoyResolver) Resolve(c fox.Context) (time.Duration, bool) {
+	if dt, ok := r.envoy.Resolve(c); ok {
+		return dt, true
+	}
+	return r.grpc.Resolve(c)
+}
+
+// parseEnvoyTimeout parses the value of the x-envoy-expected-rq-timeout-ms header, an integer number of milliseconds.
+func parseEnvoyTimeout(v string) (time.Duration, error) {
+	ms, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || ms > math.MaxInt64/int64(time.Millisecond) {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidDuration, v)
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// parseGRPCTimeout parses the value of the grpc-timeout header, an integer of at most 8 digits followed by a unit
+// (e.g. "100m" for 100 milliseconds). Values overflowing a [time.Duration] saturate.
+func parseGRPCTimeout(v string) (time.Duration, error) {
+	if len(v) < 2 || len(v) > 9 {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidDuration, v)
+	}
+	var unit time.Duration
+	switch v[len(v)-1] {
+	case 'H':
+		unit = time.Hour
+	case 'M':
+		unit = time.Minute
+	case 'S':
+		unit = time.Second
+	case 'm':
+		unit = time.Millisecond
+	case 'u':
+		unit = time.Microsecond
+	case 'n':
+		unit = time.Nanosecond
+	default:
+		return 0, fmt.Errorf("%w: %q", ErrInvalidDuration, v)
+	}
+	n, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidDuration, v)
+	}
+	if n > math.MaxInt64/int64(unit) {
+		return math.MaxInt64, nil
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// HeaderOptions configures how strictly [HeaderResolver] and [EnvoyResolver] accept the budgets provided by clients.
+type HeaderOptions struct {
+	// Min and Max bound the accepted budgets. A zero value leaves the bound open.
+	Min time.Duration
+	Max time.Duration
+	// Strict ignores values with surrounding whitespace and budgets out of bounds, so that the default timeout
+	// applies, instead of trimming the value and clamping the budget into bounds.
+	Strict bool
+	// Trust, if set, ignores the budgets it doesn't trust, so that the default timeout applies. See [TrustedProxies]
+	// and [SignedHeader].
+	Trust TrustPolicy
+}
+
+type headerResolver struct {
+	name  string
+	parse DurationParser
+	opts  HeaderOptions
+}
+
+// HeaderResolver returns a [Resolver] that applies the budget provided by the client with the given header, parsed
+// with parse. Upstream systems disagree on the wire format, so parse can accept bare milliseconds ([ParseMillis]),
+// Go durations ([time.ParseDuration]), ISO-8601 durations ([ParseISO8601]), or any of them with [AnyDuration], which
+// is used if parse is nil. If the header is absent, invalid, or not positive, the default timeout is applied.
+func HeaderResolver(name string, parse DurationParser, opts HeaderOptions) Resolver {
+	if parse == nil {
+		parse = AnyDuration()
+	}
+	return &headerResolver{
+		name:  name,
+		parse: parse,
+		opts:  opts,
+	}
+}
+
+func (r *headerResolver) Resolve(c fox.Context) (time.Duration, bool) {
+	v := c.Request().Header.Get(r.name)
+	if !r.opts.Strict {
+		v = strings.TrimSpace(v)
+	}
+	if v == "" {
+		return 0, false
+	}
+	if r.opts.Trust != nil && !r.opts.Trust(c, v) {
+		return 0, false
+	}
+	dt, err := r.parse(v)
+	if err != nil || dt <= 0 {
+		return 0, false
+	}
+	if r.opts.Min > 0 && dt < r.opts.Min {
+		if r.opts.Strict {
+			return 0, false
+		}
+		dt = r.opts.Min
+	}
+	if r.opts.Max > 0 && dt > r.opts.Max {
+		if r.opts.Strict {
+			return 0, false
+		}
+		dt = r.opts.Max
+	}
+	return dt, true
+}
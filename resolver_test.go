@@ -0,0 +1,515 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tigerwill90/fox"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestScheduleResolver(t *testing.T) {
+	r := ScheduleResolver(time.UTC,
+		Window{Days: []time.Weekday{time.Monday}, Start: 22, End: 6, Timeout: time.Minute},
+		Window{Days: []time.Weekday{time.Tuesday, time.Wednesday}, Start: 9, End: 17, Timeout: time.Second},
+		Window{Days: []time.Weekday{time.Sunday}, Timeout: 10 * time.Second},
+	).(*scheduleResolver)
+
+	cases := []struct {
+		name   string
+		now    time.Time
+		want   time.Duration
+		wantOk bool
+	}{
+		{
+			name:   "monday night",
+			now:    time.Date(2024, 1, 1, 23, 0, 0, 0, time.UTC),
+			want:   time.Minute,
+			wantOk: true,
+		},
+		{
+			name:   "wrap past midnight",
+			now:    time.Date(2024, 1, 2, 5, 59, 0, 0, time.UTC),
+			want:   time.Minute,
+			wantOk: true,
+		},
+		{
+			name: "after wrapping window",
+			now:  time.Date(2024, 1, 2, 6, 0, 0, 0, time.UTC),
+		},
+		{
+			name:   "peak hours",
+			now:    time.Date(2024, 1, 3, 9, 0, 0, 0, time.UTC),
+			want:   time.Second,
+			wantOk: true,
+		},
+		{
+			name:   "whole day",
+			now:    time.Date(2024, 1, 7, 3, 0, 0, 0, time.UTC),
+			want:   10 * time.Second,
+			wantOk: true,
+		},
+		{
+			name: "no match",
+			now:  time.Date(2024, 1, 5, 12, 0, 0, 0, time.UTC),
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r.now = func() time.Time { return tc.now }
+			dt, ok := r.Resolve(nil)
+			assert.Equal(t, tc.wantOk, ok)
+			assert.Equal(t, tc.want, dt)
+		})
+	}
+}
+
+func TestCachedResolver(t *testing.T) {
+	var calls int
+	r := CachedResolver(TimeoutResolverFunc(func(c fox.Context) (time.Duration, bool) {
+		calls++
+		return time.Duration(calls) * time.Second, true
+	}), time.Minute, nil).(*cachedResolver)
+
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	f, err := fox.New(fox.WithMiddleware(Middleware(time.Second, WithTimeoutResolver(r))))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo/{id}", func(c fox.Context) {
+		dl, ok := c.Request().Context().Deadline()
+		require.True(t, ok)
+		_ = c.String(http.StatusOK, "%s", time.Until(dl).Round(time.Second))
+	})
+
+	for _, path := range []string{"/foo/1", "/foo/2"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, req)
+		assert.Equal(t, "1s", w.Body.String())
+	}
+	assert.Equal(t, 1, calls)
+
+	now = now.Add(time.Minute)
+	req := httptest.NewRequest(http.MethodGet, "/foo/1", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, "2s", w.Body.String())
+	assert.Equal(t, 2, calls)
+}
+
+func TestCachedResolver_Concurrent(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	r := CachedResolver(TimeoutResolverFunc(func(c fox.Context) (time.Duration, bool) {
+		calls.Add(1)
+		<-release
+		return 2 * time.Second, true
+	}), time.Minute, nil)
+
+	f, err := fox.New(fox.WithMiddleware(Middleware(time.Second, WithTimeoutResolver(r))))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo", func(c fox.Context) {
+		dl, ok := c.Request().Context().Deadline()
+		require.True(t, ok)
+		_ = c.String(http.StatusOK, "%s", time.Until(dl).Round(time.Second))
+	})
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			f.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/foo", nil))
+			assert.Equal(t, "2s", w.Body.String())
+		}()
+	}
+	// Concurrent misses wait for the call in progress instead of calling the resolver again.
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+func TestCachedResolver_Bounded(t *testing.T) {
+	r := CachedResolver(TimeoutResolverFunc(func(c fox.Context) (time.Duration, bool) {
+		return time.Second, true
+	}), time.Minute, func(c fox.Context) string {
+		return c.Param("id")
+	}).(*cachedResolver)
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	f, err := fox.New(fox.WithMiddleware(Middleware(time.Second, WithTimeoutResolver(r))))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo/{id}", func(c fox.Context) {})
+	serve := func(id int) {
+		f.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/foo/"+strconv.Itoa(id), nil))
+	}
+
+	for i := range maxCachedResolutions + 10 {
+		serve(i)
+	}
+	assert.Len(t, r.entries, maxCachedResolutions)
+
+	// Once expired, the results are evicted to make room for new keys.
+	now = now.Add(time.Minute)
+	serve(-1)
+	assert.Len(t, r.entries, 1)
+	assert.Contains(t, r.entries, "-1")
+}
+
+func TestRouteKey(t *testing.T) {
+	var key string
+	f, err := fox.New(fox.WithNoRouteHandler(func(c fox.Context) {
+		key = RouteKey(c)
+	}))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo/{id}", func(c fox.Context) {
+		key = RouteKey(c)
+	})
+
+	f.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/foo/1", nil))
+	assert.Equal(t, "GET /foo/{id}", key)
+	// Unmatched requests are not identified by their path, which is controlled by the client.
+	f.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/random/path", nil))
+	assert.Equal(t, "GET", key)
+}
+
+func TestUploadResolver(t *testing.T) {
+	f, err := fox.New(fox.WithMiddleware(Middleware(time.Second, WithTimeoutResolver(UploadResolver(2*time.Second, 1<<20)))))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodPost, "/upload", func(c fox.Context) {
+		dl, ok := c.Request().Context().Deadline()
+		require.True(t, ok)
+		_ = c.String(http.StatusOK, "%s", time.Until(dl).Round(time.Second))
+	})
+
+	cases := []struct {
+		name string
+		size int64
+		want string
+	}{
+		{
+			name: "proportionate to the declared size",
+			size: 10 << 20,
+			want: "12s",
+		},
+		{
+			name: "undeclared size",
+			size: -1,
+			want: "1s",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/upload", nil)
+			req.ContentLength = tc.size
+			w := httptest.NewRecorder()
+			f.ServeHTTP(w, req)
+			assert.Equal(t, tc.want, w.Body.String())
+		})
+	}
+}
+
+func TestCostResolver(t *testing.T) {
+	cost := func(c fox.Context) int {
+		n, err := strconv.Atoi(c.Request().URL.Query().Get("cost"))
+		if err != nil {
+			return -1
+		}
+		return n
+	}
+	f, err := fox.New(fox.WithMiddleware(Middleware(time.Second, WithCostResolver(cost, LinearCost(2*time.Second, time.Second, 10*time.Second)))))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/graphql", func(c fox.Context) {
+		dl, ok := c.Request().Context().Deadline()
+		require.True(t, ok)
+		_ = c.String(http.StatusOK, "%s", time.Until(dl).Round(time.Second))
+	})
+
+	cases := []struct {
+		query string
+		want  string
+	}{
+		{query: "?cost=0", want: "2s"},
+		{query: "?cost=3", want: "5s"},
+		{query: "?cost=100", want: "10s"},
+		{query: "?cost=" + strconv.Itoa(math.MaxInt), want: "10s"},
+		{query: "", want: "1s"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.query, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/graphql"+tc.query, nil)
+			w := httptest.NewRecorder()
+			f.ServeHTTP(w, req)
+			assert.Equal(t, tc.want, w.Body.String())
+		})
+	}
+}
+
+func TestLinearCost(t *testing.T) {
+	curve := LinearCost(time.Second, time.Millisecond, 0)
+	assert.Equal(t, 3*time.Second, curve(2000))
+	// Huge costs saturate instead of wrapping around to a negative or tiny budget.
+	assert.Equal(t, time.Duration(math.MaxInt64), curve(math.MaxInt))
+	assert.Equal(t, time.Duration(math.MaxInt64), curve(math.MaxInt64/int(time.Millisecond)))
+	assert.Equal(t, time.Minute, LinearCost(time.Second, time.Millisecond, time.Minute)(math.MaxInt))
+}
+
+func TestAcceptResolver(t *testing.T) {
+	resolver := AcceptResolver(map[string]time.Duration{
+		"text/csv":         60 * time.Second,
+		"Application/PDF":  60 * time.Second,
+		"application/json": 2 * time.Second,
+	})
+	f, err := fox.New(fox.WithMiddleware(Middleware(time.Second, WithTimeoutResolver(resolver))))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/export", func(c fox.Context) {
+		dl, ok := c.Request().Context().Deadline()
+		require.True(t, ok)
+		_ = c.String(http.StatusOK, "%s", time.Until(dl).Round(time.Second))
+	})
+
+	cases := []struct {
+		name   string
+		accept []string
+		want   string
+	}{
+		{name: "no accept header", want: "1s"},
+		{name: "exact type", accept: []string{"text/csv"}, want: "1m0s"},
+		{name: "case insensitive", accept: []string{"application/pdf"}, want: "1m0s"},
+		{name: "type with parameters", accept: []string{"application/json; charset=utf-8"}, want: "2s"},
+		{name: "highest quality", accept: []string{"text/csv;q=0.5, application/json;q=0.9"}, want: "2s"},
+		{name: "multiple header values", accept: []string{"text/html", "application/json"}, want: "2s"},
+		{name: "subtype wildcard", accept: []string{"text/*"}, want: "1m0s"},
+		{name: "more specific range wins", accept: []string{"text/*, text/csv;q=0, application/json;q=0.1"}, want: "2s"},
+		{name: "any type only", accept: []string{"*/*"}, want: "1s"},
+		{name: "unknown type", accept: []string{"text/html"}, want: "1s"},
+		{name: "not acceptable", accept: []string{"application/json;q=0"}, want: "1s"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/export", nil)
+			for _, v := range tc.accept {
+				req.Header.Add("Accept", v)
+			}
+			w := httptest.NewRecorder()
+			f.ServeHTTP(w, req)
+			assert.Equal(t, tc.want, w.Body.String())
+		})
+	}
+}
+
+func TestParamResolver(t *testing.T) {
+	resolver := ParamResolver("report", map[string]time.Duration{
+		"sales":     5 * time.Second,
+		"inventory": 10 * time.Second,
+	})
+	f, err := fox.New(fox.WithMiddleware(Middleware(time.Second, WithTimeoutResolver(resolver))))
+	require.NoError(t, err)
+	handler := func(c fox.Context) {
+		dl, ok := c.Request().Context().Deadline()
+		require.True(t, ok)
+		_ = c.String(http.StatusOK, "%s", time.Until(dl).Round(time.Second))
+	}
+	f.MustHandle(http.MethodGet, "/reports/{report}", handler)
+	f.MustHandle(http.MethodGet, "/users/{id}", handler)
+
+	cases := []struct {
+		path string
+		want string
+	}{
+		{path: "/reports/sales", want: "5s"},
+		{path: "/reports/inventory", want: "10s"},
+		{path: "/reports/unknown", want: "1s"},
+		{path: "/users/1", want: "1s"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.path, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			w := httptest.NewRecorder()
+			f.ServeHTTP(w, req)
+			assert.Equal(t, tc.want, w.Body.String())
+		})
+	}
+}
+
+func TestEnvoyResolver(t *testing.T) {
+	f, err := fox.New(fox.WithMiddleware(Middleware(time.Second, WithTimeoutResolver(EnvoyResolver(HeaderOptions{Max: time.Hour})))))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo", func(c fox.Context) {
+		dl, ok := c.Request().Context().Deadline()
+		require.True(t, ok)
+		_ = c.String(http.StatusOK, "%s", time.Until(dl).Round(time.Second))
+	})
+
+	cases := []struct {
+		name   string
+		header http.Header
+		want   string
+	}{
+		{name: "envoy", header: http.Header{EnvoyExpectedTimeoutHeader: {"5000"}}, want: "5s"},
+		{name: "envoy precedence", header: http.Header{EnvoyExpectedTimeoutHeader: {"5000"}, "Grpc-Timeout": {"2S"}}, want: "5s"},
+		{name: "grpc seconds", header: http.Header{"Grpc-Timeout": {"2S"}}, want: "2s"},
+		{name: "grpc milliseconds", header: http.Header{"Grpc-Timeout": {"3000m"}}, want: "3s"},
+		{name: "grpc minutes", header: http.Header{"Grpc-Timeout": {"1M"}}, want: "1m0s"},
+		{name: "invalid envoy", header: http.Header{EnvoyExpectedTimeoutHeader: {"abc"}}, want: "1s"},
+		{name: "invalid grpc unit", header: http.Header{"Grpc-Timeout": {"2s"}}, want: "1s"},
+		{name: "grpc too long", header: http.Header{"Grpc-Timeout": {"123456789S"}}, want: "1s"},
+		{name: "none", header: http.Header{}, want: "1s"},
+		{name: "envoy above max", header: http.Header{EnvoyExpectedTimeoutHeader: {"7200000"}}, want: "1h0m0s"},
+		{name: "grpc saturated", header: http.Header{"Grpc-Timeout": {"99999999H"}}, want: "1h0m0s"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+			req.Header = tc.header
+			w := httptest.NewRecorder()
+			f.ServeHTTP(w, req)
+			assert.Equal(t, tc.want, w.Body.String())
+		})
+	}
+
+	// Budgets sent by untrusted peers are ignored.
+	f, err = fox.New(fox.WithMiddleware(Middleware(time.Second, WithTimeoutResolver(EnvoyResolver(HeaderOptions{
+		Trust: TrustedProxies(netip.MustParsePrefix("10.0.0.0/8")),
+	})))))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo", func(c fox.Context) {
+		dl, ok := c.Request().Context().Deadline()
+		require.True(t, ok)
+		_ = c.String(http.StatusOK, "%s", time.Until(dl).Round(time.Second))
+	})
+	for addr, want := range map[string]string{"10.0.0.1:1234": "5s", "192.0.2.1:1234": "1s"} {
+		req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+		req.RemoteAddr = addr
+		req.Header.Set("Grpc-Timeout", "5S")
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, req)
+		assert.Equal(t, want, w.Body.String(), addr)
+	}
+}
+
+func TestHeaderResolver(t *testing.T) {
+	handler := func(c fox.Context) {
+		dl, ok := c.Request().Context().Deadline()
+		require.True(t, ok)
+		_ = c.String(http.StatusOK, "%s", time.Until(dl).Round(time.Second))
+	}
+	opts := HeaderOptions{Min: 2 * time.Second, Max: 10 * time.Second}
+	lenient, err := fox.New(fox.WithMiddleware(Middleware(time.Second, WithTimeoutResolver(HeaderResolver("X-Budget", nil, opts)))))
+	require.NoError(t, err)
+	lenient.MustHandle(http.MethodGet, "/foo", handler)
+	opts.Strict = true
+	strict, err := fox.New(fox.WithMiddleware(Middleware(time.Second, WithTimeoutResolver(HeaderResolver("X-Budget", nil, opts)))))
+	require.NoError(t, err)
+	strict.MustHandle(http.MethodGet, "/foo", handler)
+
+	cases := []struct {
+		name        string
+		value       string
+		wantLenient string
+		wantStrict  string
+	}{
+		{name: "millis", value: "5000", wantLenient: "5s", wantStrict: "5s"},
+		{name: "go", value: "3s", wantLenient: "3s", wantStrict: "3s"},
+		{name: "iso", value: "PT4S", wantLenient: "4s", wantStrict: "4s"},
+		{name: "whitespace", value: " 3s ", wantLenient: "3s", wantStrict: "1s"},
+		{name: "below min", value: "500", wantLenient: "2s", wantStrict: "1s"},
+		{name: "above max", value: "1m", wantLenient: "10s", wantStrict: "1s"},
+		{name: "invalid", value: "soon", wantLenient: "1s", wantStrict: "1s"},
+		{name: "negative", value: "-3s", wantLenient: "1s", wantStrict: "1s"},
+		{name: "absent", wantLenient: "1s", wantStrict: "1s"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+			if tc.value != "" {
+				req.Header.Set("X-Budget", tc.value)
+			}
+			w := httptest.NewRecorder()
+			lenient.ServeHTTP(w, req)
+			assert.Equal(t, tc.wantLenient, w.Body.String())
+
+			w = httptest.NewRecorder()
+			strict.ServeHTTP(w, req)
+			assert.Equal(t, tc.wantStrict, w.Body.String())
+		})
+	}
+}
+
+func TestHeaderResolver_Trust(t *testing.T) {
+	handler := func(c fox.Context) {
+		dl, ok := c.Request().Context().Deadline()
+		require.True(t, ok)
+		_ = c.String(http.StatusOK, "%s", time.Until(dl).Round(time.Second))
+	}
+	key := []byte("secret")
+	proxies := TrustedProxies(netip.MustParsePrefix("10.0.0.0/8"))
+	signed := SignedHeader("X-Budget-Signature", key)
+	f, err := fox.New(fox.WithMiddleware(Middleware(time.Second, WithTimeoutResolver(HeaderResolver("X-Budget", nil, HeaderOptions{
+		Trust: func(c fox.Context, value string) bool {
+			return proxies(c, value) || signed(c, value)
+		},
+	})))))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo", handler)
+
+	sign := func(value string) string {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(value))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+
+	cases := []struct {
+		name       string
+		remoteAddr string
+		value      string
+		signature  string
+		want       string
+	}{
+		{name: "trusted proxy", remoteAddr: "10.1.2.3:1234", value: "5s", want: "5s"},
+		{name: "trusted mapped proxy", remoteAddr: "[::ffff:10.1.2.3]:1234", value: "5s", want: "5s"},
+		{name: "untrusted client", remoteAddr: "192.0.2.1:1234", value: "5s", want: "1s"},
+		{name: "signed", remoteAddr: "192.0.2.1:1234", value: "5s", signature: sign("5s"), want: "5s"},
+		{name: "inflated", remoteAddr: "192.0.2.1:1234", value: "1m", signature: sign("5s"), want: "1s"},
+		{name: "invalid signature", remoteAddr: "192.0.2.1:1234", value: "5s", signature: "zz", want: "1s"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+			req.RemoteAddr = tc.remoteAddr
+			req.Header.Set("X-Budget", tc.value)
+			if tc.signature != "" {
+				req.Header.Set("X-Budget-Signature", tc.signature)
+			}
+			w := httptest.NewRecorder()
+			f.ServeHTTP(w, req)
+			assert.Equal(t, tc.want, w.Body.String())
+		})
+	}
+}
@@ -0,0 +1,269 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"github.com/tigerwill90/fox"
+	"net/http"
+	"time"
+)
+
+type routeKey struct{}
+
+type hedgeKey struct{}
+
+type retryKey struct{}
+
+type noneIfKey struct{}
+
+type streamKey struct{}
+
+type jitterKey struct{}
+
+type statusKey struct{}
+
+type routeMode uint8
+
+const (
+	modeDefault routeMode = iota
+	modeAfter
+	modeNone
+	modeReject
+	modePerPart
+	modeIdle
+)
+
+type routePolicy struct {
+	dt   time.Duration
+	warn time.Duration
+	mode routeMode
+}
+
+// After returns a [fox.RouteOption] that sets the timeout duration of a route, overriding the default timeout of the
+// middleware. By default, a [Resolver] or a timeout set with [WithRequestTimeout] still takes precedence, see
+// [WithPrecedence]. If dt is zero or negative, the timeout is disabled for the route, like with [None].
+func After(dt time.Duration) fox.RouteOption {
+	if dt <= 0 {
+		return None()
+	}
+	return fox.WithAnnotation(routeKey{}, routePolicy{mode: modeAfter, dt: dt})
+}
+
+// Thresholds returns a [fox.RouteOption] that sets both a soft and a hard threshold on a route with a single
+// annotation. The hard threshold dt is enforced like with [After], while the warn threshold only fires the hook
+// registered with [WithWarnHook], an [EventWarning] delivered to [Timeout.Watch] and the warnings counter, for requests
+// still running after warn. This gives the soft signal without running a separate observability middleware. If warn is
+// zero or negative, or not lower than dt, only the hard threshold applies. If dt is zero or negative, the timeout is
+// disabled for the route, like with [None].
+func Thresholds(warn, dt time.Duration) fox.RouteOption {
+	if dt <= 0 {
+		return None()
+	}
+	if warn >= dt {
+		warn = 0
+	}
+	return fox.WithAnnotation(routeKey{}, routePolicy{mode: modeAfter, dt: dt, warn: max(warn, 0)})
+}
+
+// None returns a [fox.RouteOption] that disables the timeout for a route. Requests are handled by the next handler
+// directly, like requests excluded by a [Filter].
+func None() fox.RouteOption {
+	return fox.WithAnnotation(routeKey{}, routePolicy{mode: modeNone})
+}
+
+// NoneIf returns a [fox.RouteOption] that disables the timeout of a route for the requests matching the predicate only,
+// like with [None], while the other requests remain protected by the timeout of the route. This is useful for routes
+// where a few requests are legitimately long (e.g. a full export with ?export=full). The predicate is invoked for each
+// request, so it should be simple and efficient. If fn is nil, the timeout is never disabled.
+func NoneIf(fn Filter) fox.RouteOption {
+	return fox.WithAnnotation(noneIfKey{}, fn)
+}
+
+// noneIf reports whether the timeout is disabled for the request with [NoneIf].
+func noneIf(c fox.Context) bool {
+	route := c.Route()
+	if route == nil {
+		return false
+	}
+	fn, _ := route.Annotation(noneIfKey{}).(Filter)
+	return fn != nil && fn(c)
+}
+
+// Reject returns a [fox.RouteOption] that sheds every request of a route immediately with the timeout response,
+// without calling the next handler. This gives an explicit way to configure a route to always answer with
+// the timeout response, which is distinct from disabling the timeout with a zero or negative duration.
+func Reject() fox.RouteOption {
+	return fox.WithAnnotation(routeKey{}, routePolicy{mode: modeReject})
+}
+
+// PerPart returns a [fox.RouteOption] for multipart endpoints (e.g. multipart/form-data uploads), where the deadline
+// is reset each time a part of the request body completes. Each part must be read within dt, which prevents many-file
+// uploads from being killed while still bounding the time spent per part. Requests that are not multipart are handled
+// like with [After]. If dt is zero or negative, the timeout is disabled for the route, like with [None].
+func PerPart(dt time.Duration) fox.RouteOption {
+	if dt <= 0 {
+		return None()
+	}
+	return fox.WithAnnotation(routeKey{}, routePolicy{mode: modePerPart, dt: dt})
+}
+
+// IdleAfter returns a [fox.RouteOption] that sets an idle timeout on a route instead of a total budget: the deadline
+// is pushed back by dt each time the handler writes to the response, so that endpoints with long but chunked responses
+// (e.g. exports or server-sent events) run as long as they make progress, while stalled handlers are still caught.
+// The response of the route is not buffered, like with [Stream], since it could otherwise grow without bound for as
+// long as the handler makes progress. A [Resolver] or a timeout set with [WithRequestTimeout] taking precedence
+// replaces dt. If dt is zero or negative, the timeout is disabled for the route, like with [None].
+func IdleAfter(dt time.Duration) fox.RouteOption {
+	if dt <= 0 {
+		return None()
+	}
+	return fox.WithAnnotation(routeKey{}, routePolicy{mode: modeIdle, dt: dt})
+}
+
+// Stream returns a [fox.RouteOption] that disables the buffering of the response for a route, like [WithStreaming]
+// does for every route, so that a single download or server-sent events endpoint doesn't force the whole router into
+// streaming mode.
+func Stream() fox.RouteOption {
+	return fox.WithAnnotation(streamKey{}, true)
+}
+
+// streamed reports whether the response of the request is not buffered, either with [WithStreaming], [Stream] or
+// [IdleAfter].
+func streamed(c fox.Context, stream bool) bool {
+	if stream {
+		return true
+	}
+	route := c.Route()
+	if route == nil {
+		return false
+	}
+	if routePolicyFrom(route).mode == modeIdle {
+		return true
+	}
+	on, _ := route.Annotation(streamKey{}).(bool)
+	return on
+}
+
+// Jitter returns a [fox.RouteOption] that randomizes the budget of a route within the given fraction of the budget
+// (e.g. 0.1 for ±10%), overriding the fraction set with [WithJitter]. This decorrelates the deadlines of endpoints that
+// fan out to the same fragile backend. If fraction is not in the range (0, 1), budgets of the route are not randomized.
+func Jitter(fraction float64) fox.RouteOption {
+	if fraction <= 0 || fraction >= 1 {
+		fraction = 0
+	}
+	return fox.WithAnnotation(jitterKey{}, fraction)
+}
+
+// jitterFraction returns the jitter fraction of the request, set on its route with [Jitter] or else with [WithJitter].
+func jitterFraction(c fox.Context, fraction float64) float64 {
+	route := c.Route()
+	if route == nil {
+		return fraction
+	}
+	if f, ok := route.Annotation(jitterKey{}).(float64); ok {
+		return f
+	}
+	return fraction
+}
+
+// StatusCode returns a [fox.RouteOption] that sets the status code of the timeout response of a route (e.g. 408
+// Request Timeout for an interactive form endpoint), with the status text in its body, like [WithStatusCode] does for
+// every route. It takes precedence over the response handler set with [WithResponse] and the status codes set with
+// [WithSourceStatus], without having to scope a whole custom response handler to the route. If code is not a valid
+// status code, the timeout response of the middleware is used.
+func StatusCode(code int) fox.RouteOption {
+	if code < 100 || code > 999 {
+		code = 0
+	}
+	return fox.WithAnnotation(statusKey{}, code)
+}
+
+// routeStatus returns the status code of the timeout response set on the route of the request with [StatusCode], or
+// zero if none.
+func routeStatus(c fox.Context) int {
+	route := c.Route()
+	if route == nil {
+		return 0
+	}
+	code, _ := route.Annotation(statusKey{}).(int)
+	return code
+}
+
+// Hedge returns a [fox.RouteOption] that marks a route as hedgeable: when a GET or HEAD request without a body is still
+// running after delay, the middleware starts a second invocation of the handler and sends the response of whichever
+// finishes first, canceling the other. This reduces tail latency at the cost of extra work, so the handler must be
+// idempotent. Both invocations share the deadline of the request. Hedging is disabled in streaming mode, since
+// the response of the first invocation may already be partially sent. If delay is zero or negative, the route is not
+// hedged.
+func Hedge(delay time.Duration) fox.RouteOption {
+	return fox.WithAnnotation(hedgeKey{}, delay)
+}
+
+// hedgeDelay returns the delay after which the request is hedged, or zero if the request is not hedgeable.
+func hedgeDelay(c fox.Context) time.Duration {
+	route := c.Route()
+	if route == nil {
+		return 0
+	}
+	delay, _ := route.Annotation(hedgeKey{}).(time.Duration)
+	if delay <= 0 {
+		return 0
+	}
+	req := c.Request()
+	if req.Method != http.MethodGet && req.Method != http.MethodHead || !replayable(req) {
+		return 0
+	}
+	return delay
+}
+
+// Retry returns a [fox.RouteOption] that retries the handler of an idempotent route once when it exceeds the
+// sub-budget dt: the first invocation is abandoned like on timeout, and the handler is invoked again with the remaining
+// budget of the request before the middleware surrenders to the timeout response. This is useful when the slowness is
+// caused by transient contention (e.g. a lock held by another transaction). Requests with a body are not retried, since
+// the body can't be read twice, and retries are disabled in streaming mode. If dt is zero or negative, or not lower than
+// the budget of the request, the route is not retried.
+func Retry(dt time.Duration) fox.RouteOption {
+	return fox.WithAnnotation(retryKey{}, dt)
+}
+
+// retryBudget returns the sub-budget of the first invocation of the handler, or zero if the request is not retried.
+func retryBudget(c fox.Context, budget time.Duration) time.Duration {
+	route := c.Route()
+	if route == nil {
+		return 0
+	}
+	dt, _ := route.Annotation(retryKey{}).(time.Duration)
+	if dt <= 0 || dt >= budget || !replayable(c.Request()) {
+		return 0
+	}
+	return dt
+}
+
+// replayable reports whether the handler can be invoked more than once for the request, which requires the request to
+// have no body.
+func replayable(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody
+}
+
+// RouteTimeout returns the timeout duration configured on the route with [After], [PerPart] or [IdleAfter], so that other
+// middleware and admin tooling can reason about configured budgets. The duration is zero if the timeout is disabled
+// with [None] or if requests are rejected with [Reject]. It returns false if the route doesn't configure its timeout,
+// in which case the default timeout of the middleware applies.
+func RouteTimeout(r *fox.Route) (dt time.Duration, ok bool) {
+	p := routePolicyFrom(r)
+	return p.dt, p.mode != modeDefault
+}
+
+func routePolicyOf(c fox.Context) routePolicy {
+	return routePolicyFrom(c.Route())
+}
+
+func routePolicyFrom(r *fox.Route) routePolicy {
+	if r == nil {
+		return routePolicy{}
+	}
+	p, _ := r.Annotation(routeKey{}).(routePolicy)
+	return p
+}
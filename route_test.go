@@ -0,0 +1,516 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tigerwill90/fox"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRouteOptions(t *testing.T) {
+	var called bool
+	f, err := fox.New(fox.WithMiddleware(Middleware(50 * time.Microsecond)))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/after", success201response, After(time.Second))
+	f.MustHandle(http.MethodGet, "/after/zero", success201response, After(0))
+	f.MustHandle(http.MethodGet, "/none", success201response, None())
+	f.MustHandle(http.MethodGet, "/export", success201response, NoneIf(func(c fox.Context) bool {
+		return c.Request().URL.Query().Get("export") == "full"
+	}))
+	f.MustHandle(http.MethodGet, "/reject", func(c fox.Context) {
+		called = true
+	}, Reject())
+	f.MustHandle(http.MethodGet, "/default", success201response)
+
+	cases := []struct {
+		path string
+		want int
+	}{
+		{path: "/after", want: http.StatusCreated},
+		{path: "/after/zero", want: http.StatusCreated},
+		{path: "/none", want: http.StatusCreated},
+		{path: "/export?export=full", want: http.StatusCreated},
+		{path: "/export?export=page", want: http.StatusServiceUnavailable},
+		{path: "/reject", want: http.StatusServiceUnavailable},
+		{path: "/default", want: http.StatusServiceUnavailable},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.path, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			w := httptest.NewRecorder()
+			f.ServeHTTP(w, req)
+			assert.Equal(t, tc.want, w.Code)
+		})
+	}
+	assert.False(t, called)
+}
+
+func TestStatusCode(t *testing.T) {
+	f, err := fox.New(fox.WithMiddleware(Middleware(
+		50*time.Microsecond,
+		WithStatusCode(http.StatusGatewayTimeout),
+		WithSourceStatus(SourceRoute, http.StatusServiceUnavailable),
+	)))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/form", success201response, StatusCode(http.StatusRequestTimeout))
+	f.MustHandle(http.MethodGet, "/form/route", success201response, After(50*time.Microsecond), StatusCode(http.StatusRequestTimeout))
+	f.MustHandle(http.MethodGet, "/reject", success201response, Reject(), StatusCode(http.StatusTooManyRequests))
+	f.MustHandle(http.MethodGet, "/invalid", success201response, StatusCode(42))
+	f.MustHandle(http.MethodGet, "/scope", success201response, Scope(WithStatusCode(http.StatusBadGateway)))
+	f.MustHandle(http.MethodGet, "/scope/form", success201response, Scope(WithStatusCode(http.StatusBadGateway)), StatusCode(http.StatusRequestTimeout))
+	f.MustHandle(http.MethodGet, "/default", success201response)
+
+	cases := []struct {
+		path string
+		want int
+	}{
+		{path: "/form", want: http.StatusRequestTimeout},
+		{path: "/form/route", want: http.StatusRequestTimeout},
+		{path: "/reject", want: http.StatusTooManyRequests},
+		{path: "/invalid", want: http.StatusGatewayTimeout},
+		{path: "/scope", want: http.StatusBadGateway},
+		{path: "/scope/form", want: http.StatusRequestTimeout},
+		{path: "/default", want: http.StatusGatewayTimeout},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.path, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			w := httptest.NewRecorder()
+			f.ServeHTTP(w, req)
+			assert.Equal(t, tc.want, w.Code)
+			assert.Equal(t, http.StatusText(tc.want)+"\n", w.Body.String())
+		})
+	}
+}
+
+func TestMiddleware_WithDebugHeader(t *testing.T) {
+	resolver := TimeoutResolverFunc(func(c fox.Context) (dt time.Duration, ok bool) {
+		return 3 * time.Second, c.Path() == "/resolver"
+	})
+
+	f, err := fox.New(fox.WithMiddleware(Middleware(time.Second, WithDebugHeader(""), WithTimeoutResolver(resolver))))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/default", success201response)
+	f.MustHandle(http.MethodGet, "/route", success201response, After(2*time.Second))
+	f.MustHandle(http.MethodGet, "/resolver", success201response, After(2*time.Second))
+	f.MustHandle(http.MethodGet, "/timeout", success201response, After(50*time.Microsecond))
+
+	cases := []struct {
+		path string
+		want string
+	}{
+		{path: "/default", want: "source=default; budget=1s"},
+		{path: "/route", want: "source=route; budget=2s"},
+		{path: "/resolver", want: "source=resolver; budget=3s"},
+		{path: "/timeout", want: "source=route; budget=50µs"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.path, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			w := httptest.NewRecorder()
+			f.ServeHTTP(w, req)
+			assert.Equal(t, tc.want, w.Header().Get(DefaultDebugHeader))
+		})
+	}
+}
+
+func TestHedge(t *testing.T) {
+	tm := New(time.Second)
+	var calls atomic.Int32
+	canceled := make(chan struct{})
+	f, err := fox.New(fox.WithMiddleware(tm.Timeout))
+	require.NoError(t, err)
+	handler := func(c fox.Context) {
+		if calls.Add(1) == 1 {
+			// The first invocation is stuck until the hedge wins.
+			<-c.Request().Context().Done()
+			close(canceled)
+			return
+		}
+		_ = c.String(http.StatusOK, "hedge")
+	}
+	f.MustHandle(http.MethodGet, "/hedge", handler, Hedge(10*time.Millisecond))
+	f.MustHandle(http.MethodPost, "/hedge", handler, Hedge(10*time.Millisecond), After(50*time.Millisecond))
+
+	req := httptest.NewRequest(http.MethodGet, "/hedge", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "hedge", w.Body.String())
+	assert.Equal(t, int64(1), tm.Stats().Hedges)
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("the losing invocation was not canceled")
+	}
+
+	calls.Store(0)
+	canceled = make(chan struct{})
+	req = httptest.NewRequest(http.MethodPost, "/hedge", nil)
+	w = httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, int32(1), calls.Load())
+	assert.Equal(t, int64(1), tm.Stats().Hedges)
+}
+
+func TestHedge_RequestCopy(t *testing.T) {
+	var calls atomic.Int32
+	seen := make(chan string, 1)
+	f, err := fox.New(fox.WithMiddleware(Middleware(time.Second)))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/hedge", func(c fox.Context) {
+		if calls.Add(1) == 1 {
+			c.Request().Header.Set("X-Attempt", "initial")
+			<-c.Request().Context().Done()
+			return
+		}
+		// The headers of the hedge are not shared with the initial attempt still running.
+		seen <- c.Request().Header.Get("X-Attempt")
+		c.Request().Header.Set("X-Attempt", "hedge")
+		_ = c.String(http.StatusOK, "hedge")
+	}, Hedge(10*time.Millisecond))
+
+	req := httptest.NewRequest(http.MethodGet, "/hedge", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, <-seen)
+	assert.Empty(t, req.Header.Get("X-Attempt"))
+}
+
+func TestRetry(t *testing.T) {
+	tm := New(200 * time.Millisecond)
+	var calls atomic.Int32
+	f, err := fox.New(fox.WithMiddleware(tm.Timeout))
+	require.NoError(t, err)
+	handler := func(c fox.Context) {
+		if calls.Add(1) == 1 {
+			<-c.Request().Context().Done()
+			_ = c.String(http.StatusInternalServerError, "first")
+			return
+		}
+		_ = c.String(http.StatusOK, "retry")
+	}
+	f.MustHandle(http.MethodGet, "/retry", handler, Retry(20*time.Millisecond))
+	f.MustHandle(http.MethodGet, "/retry/exceeded", handler, Retry(time.Second))
+
+	req := httptest.NewRequest(http.MethodGet, "/retry", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "retry", w.Body.String())
+	assert.Equal(t, int64(1), tm.Stats().Retries)
+	assert.Equal(t, int64(0), tm.Stats().Timeouts)
+
+	calls.Store(0)
+	req = httptest.NewRequest(http.MethodGet, "/retry/exceeded", nil)
+	w = httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, int32(1), calls.Load())
+	assert.Equal(t, int64(1), tm.Stats().Retries)
+}
+
+func TestRetry_Attempts(t *testing.T) {
+	events := make(chan *Event, 1)
+	tm := New(100*time.Millisecond, WithDebugHeader(""), WithTimeoutHook(func(c fox.Context, e *Event) {
+		events <- e
+	}))
+	f, err := fox.New(fox.WithMiddleware(tm.Timeout))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/retry", func(c fox.Context) {
+		<-c.Request().Context().Done()
+	}, Retry(20*time.Millisecond))
+
+	req := httptest.NewRequest(http.MethodGet, "/retry", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Regexp(t, `^source=default; budget=100ms; attempts=initial:[^/]+/20ms,retry:[^/]+/[^,]+$`, w.Header().Get(DefaultDebugHeader))
+
+	e := <-events
+	require.Len(t, e.Attempts, 2)
+	assert.Equal(t, AttemptInitial, e.Attempts[0].Kind)
+	assert.Equal(t, 20*time.Millisecond, e.Attempts[0].Budget)
+	assert.False(t, e.Attempts[0].Running)
+	assert.Equal(t, AttemptRetry, e.Attempts[1].Kind)
+	assert.True(t, e.Attempts[1].Running)
+	assert.GreaterOrEqual(t, e.Attempts[1].Start, 20*time.Millisecond)
+	assert.Equal(t, 100*time.Millisecond, e.Attempts[1].Start+e.Attempts[1].Budget)
+	assert.False(t, e.Attempts[1].Won)
+}
+
+func TestWithPrecedence(t *testing.T) {
+	resolver := TimeoutResolverFunc(func(c fox.Context) (time.Duration, bool) {
+		return 3 * time.Second, true
+	})
+	sources := make(chan Source, 1)
+	f, err := fox.New(fox.WithMiddleware(Middleware(
+		50*time.Microsecond,
+		WithDebugHeader(""),
+		WithTimeoutResolver(resolver),
+		WithPrecedence(SourceRoute, SourceResolver, SourceRequest),
+		WithTimeoutHook(func(c fox.Context, e *Event) {
+			sources <- e.Source
+		}),
+	)))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/route", success201response, After(time.Microsecond))
+	f.MustHandle(http.MethodGet, "/resolver", success201response)
+
+	req := httptest.NewRequest(http.MethodGet, "/route", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "source=route; budget=1µs", w.Header().Get(DefaultDebugHeader))
+	assert.Equal(t, SourceRoute, <-sources)
+
+	req = httptest.NewRequest(http.MethodGet, "/resolver", nil)
+	w = httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "source=resolver; budget=3s", w.Header().Get(DefaultDebugHeader))
+
+	_, err = NewStrict(time.Second, WithPrecedence(SourceRoute, SourceRoute, SourceRequest))
+	assert.Error(t, err)
+}
+
+func TestRouteTimeout(t *testing.T) {
+	type result struct {
+		dt time.Duration
+		ok bool
+	}
+	results := make(chan result, 1)
+	handler := func(c fox.Context) {
+		dt, ok := RouteTimeout(c.Route())
+		results <- result{dt, ok}
+	}
+	f, err := fox.New()
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/after", handler, After(time.Second))
+	f.MustHandle(http.MethodGet, "/part", handler, PerPart(2*time.Second))
+	f.MustHandle(http.MethodGet, "/idle", handler, IdleAfter(3*time.Second))
+	f.MustHandle(http.MethodGet, "/none", handler, None())
+	f.MustHandle(http.MethodGet, "/default", handler)
+
+	cases := []struct {
+		path string
+		want result
+	}{
+		{path: "/after", want: result{time.Second, true}},
+		{path: "/part", want: result{2 * time.Second, true}},
+		{path: "/idle", want: result{3 * time.Second, true}},
+		{path: "/none", want: result{0, true}},
+		{path: "/default", want: result{0, false}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.path, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			w := httptest.NewRecorder()
+			f.ServeHTTP(w, req)
+			assert.Equal(t, tc.want, <-results)
+		})
+	}
+	dt, ok := RouteTimeout(nil)
+	assert.Zero(t, dt)
+	assert.False(t, ok)
+}
+
+func TestThresholds(t *testing.T) {
+	events := make(chan *Event, 1)
+	tm := New(time.Second, WithWarnHook(func(c fox.Context, e *Event) {
+		events <- e
+	}))
+	f, err := fox.New(fox.WithMiddleware(tm.Timeout))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/slow", func(c fox.Context) {
+		defer StartSegment(c, "db")()
+		time.Sleep(30 * time.Millisecond)
+		_ = c.String(http.StatusOK, "slow")
+	}, Thresholds(10*time.Millisecond, 100*time.Millisecond))
+	f.MustHandle(http.MethodGet, "/timeout", success201response, Thresholds(time.Millisecond, 5*time.Millisecond))
+
+	req := httptest.NewRequest(http.MethodGet, "/slow", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	e := <-events
+	assert.Equal(t, EventWarning, e.Kind)
+	assert.Equal(t, "/slow", e.Pattern)
+	assert.Equal(t, 100*time.Millisecond, e.Budget)
+	require.Len(t, e.Segments, 1)
+	assert.True(t, e.Segments[0].Running)
+
+	req = httptest.NewRequest(http.MethodGet, "/timeout", nil)
+	w = httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	<-events
+	assert.Equal(t, int64(2), tm.Stats().Warnings)
+}
+
+func TestOnRoute(t *testing.T) {
+	f, err := fox.New()
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/risky", success201response, OnRoute(50*time.Microsecond, WithStatusCode(http.StatusGatewayTimeout)))
+	f.MustHandle(http.MethodGet, "/after", success201response, OnRoute(50*time.Microsecond), After(time.Second))
+	f.MustHandle(http.MethodGet, "/safe", success201response)
+
+	cases := []struct {
+		path string
+		want int
+	}{
+		{path: "/risky", want: http.StatusGatewayTimeout},
+		{path: "/after", want: http.StatusCreated},
+		{path: "/safe", want: http.StatusCreated},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.path, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			w := httptest.NewRecorder()
+			f.ServeHTTP(w, req)
+			assert.Equal(t, tc.want, w.Code)
+		})
+	}
+}
+
+func TestMiddleware_WithPolicyHeader(t *testing.T) {
+	tm := New(time.Second, WithPolicyHeader(""))
+	f, err := fox.New(fox.WithMiddleware(tm.Timeout))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/default", success201response)
+	f.MustHandle(http.MethodGet, "/route", success201response, After(2*time.Second))
+	f.MustHandle(http.MethodGet, "/timeout", success201response, After(50*time.Microsecond))
+
+	cases := []struct {
+		path string
+		want string
+	}{
+		{path: "/default", want: "budget=1s; source=default"},
+		{path: "/route", want: "budget=2s; source=route"},
+		{path: "/timeout", want: "budget=50µs; source=route"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.path, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			w := httptest.NewRecorder()
+			f.ServeHTTP(w, req)
+			assert.Equal(t, tc.want, w.Header().Get(DefaultPolicyHeader))
+		})
+	}
+	assert.Equal(t, "foxtimeout{default=1s policy=Timeout-Policy}", tm.String())
+}
+
+func TestStream(t *testing.T) {
+	f, err := fox.New(fox.WithMiddleware(Middleware(time.Second)))
+	require.NoError(t, err)
+	handler := func(c fox.Context) {
+		_, _ = c.Writer().WriteString("data: 1\n\n")
+		_ = c.Writer().FlushError()
+		_, _ = c.Writer().WriteString("data: 2\n\n")
+	}
+	f.MustHandle(http.MethodGet, "/download", handler, Stream())
+	f.MustHandle(http.MethodGet, "/buffered", handler)
+
+	req := httptest.NewRequest(http.MethodGet, "/download", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.True(t, w.Flushed)
+	assert.Equal(t, "data: 1\n\ndata: 2\n\n", w.Body.String())
+
+	req = httptest.NewRequest(http.MethodGet, "/buffered", nil)
+	w = httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.False(t, w.Flushed)
+	assert.Equal(t, "data: 1\n\ndata: 2\n\n", w.Body.String())
+}
+
+func TestIdleAfter(t *testing.T) {
+	f, err := fox.New(fox.WithMiddleware(Middleware(time.Second)))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/chunked", func(c fox.Context) {
+		for range 5 {
+			time.Sleep(15 * time.Millisecond)
+			_, _ = c.Writer().WriteString("chunk\n")
+		}
+	}, IdleAfter(50*time.Millisecond))
+	f.MustHandle(http.MethodGet, "/stall", func(c fox.Context) {
+		_, _ = c.Writer().WriteString("chunk\n")
+		<-c.Request().Context().Done()
+	}, IdleAfter(50*time.Millisecond))
+
+	req := httptest.NewRequest(http.MethodGet, "/chunked", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, strings.Repeat("chunk\n", 5), w.Body.String())
+	// The response is streamed rather than buffered without bound, so it was already started when the handler
+	// stalled, and the connection is aborted.
+	req = httptest.NewRequest(http.MethodGet, "/stall", nil)
+	w = httptest.NewRecorder()
+	start := time.Now()
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		f.ServeHTTP(w, req)
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "chunk\n", w.Body.String())
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestJitter(t *testing.T) {
+	tm := New(time.Second, WithPolicyHeader(""), WithJitter(0.5))
+	f, err := fox.New(fox.WithMiddleware(tm.Timeout))
+	require.NoError(t, err)
+	handler := func(c fox.Context) {
+		c.Writer().WriteHeader(http.StatusOK)
+	}
+	f.MustHandle(http.MethodGet, "/global", handler)
+	f.MustHandle(http.MethodGet, "/route", handler, After(2*time.Second), Jitter(0.1))
+	f.MustHandle(http.MethodGet, "/disabled", handler, Jitter(0))
+
+	budgets := func(path string) (lo, hi time.Duration) {
+		for i := range 20 {
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			w := httptest.NewRecorder()
+			f.ServeHTTP(w, req)
+			v, _, _ := strings.Cut(strings.TrimPrefix(w.Header().Get(DefaultPolicyHeader), "budget="), ";")
+			dt, err := time.ParseDuration(v)
+			require.NoError(t, err)
+			if i == 0 {
+				lo, hi = dt, dt
+			}
+			lo, hi = min(lo, dt), max(hi, dt)
+		}
+		return lo, hi
+	}
+
+	lo, hi := budgets("/global")
+	assert.GreaterOrEqual(t, lo, 500*time.Millisecond)
+	assert.LessOrEqual(t, hi, 1500*time.Millisecond)
+	assert.NotEqual(t, lo, hi)
+
+	lo, hi = budgets("/route")
+	assert.GreaterOrEqual(t, lo, 1800*time.Millisecond)
+	assert.LessOrEqual(t, hi, 2200*time.Millisecond)
+	assert.NotEqual(t, lo, hi)
+
+	lo, hi = budgets("/disabled")
+	assert.Equal(t, time.Second, lo)
+	assert.Equal(t, time.Second, hi)
+}
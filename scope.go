@@ -0,0 +1,65 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"cmp"
+	"errors"
+	"github.com/tigerwill90/fox"
+	"maps"
+	"slices"
+)
+
+type scopeKey struct{}
+
+// Scope returns a [fox.RouteOption] that applies the given options to a single route, on top of the options the
+// middleware was created with. This allows using the same [Option] both globally with [New] and per route, e.g.
+// a different status code with [WithStatusCode] for a few routes only. Options are applied once per route, on the first
+// request, and invalid options are logged and ignored. The middleware state, such as statistics, watchers, the
+// [Policy] or the cache created with [WithMicroCache], remains shared with the route, so options creating such state
+// (e.g. [WithSLO]) have no effect in a scope, while options only configuring how it is used (e.g. [WithServeStale])
+// apply to the route. Only the last Scope registered on a route applies.
+func Scope(opts ...Option) fox.RouteOption {
+	return fox.WithAnnotation(scopeKey{}, opts)
+}
+
+// view returns the [Timeout] applying the options of the [Scope] registered on the route of c, or t itself if the route
+// has no scope.
+func (t *Timeout) view(c fox.Context) *Timeout {
+	route := c.Route()
+	if route == nil {
+		return t
+	}
+	opts, _ := route.Annotation(scopeKey{}).([]Option)
+	if len(opts) == 0 {
+		return t
+	}
+	if v, ok := t.views.Load(route); ok {
+		return v.(*Timeout)
+	}
+
+	// The options may append to or write into the slices and maps of the middleware config, so the view works on
+	// copies of them.
+	cfg := *t.cfg
+	cfg.errs = nil
+	cfg.filters = slices.Clip(cfg.filters)
+	cfg.behaviors = maps.Clone(cfg.behaviors)
+	cfg.sourceStatus = maps.Clone(cfg.sourceStatus)
+	for _, opt := range opts {
+		opt.apply(&cfg)
+	}
+	if err := errors.Join(cfg.errs...); err != nil {
+		cfg.logger.Warn("foxtimeout: invalid scope options", "route", route.Pattern(), "error", err)
+	}
+	cfg.resolver = cmp.Or[Resolver](cfg.resolver, noResolver{})
+	if cfg.cache != nil {
+		// The stale window is read from the config of the view, but the cache, possibly shared with the middleware,
+		// must retain the responses long enough.
+		cfg.cache.retainStale(cfg.stale)
+	}
+
+	v, _ := t.views.LoadOrStore(route, &Timeout{cfg: &cfg, shared: t.shared})
+	return v.(*Timeout)
+}
@@ -0,0 +1,128 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tigerwill90/fox"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestScope(t *testing.T) {
+	tm := New(50*time.Microsecond, WithStatusCode(http.StatusGatewayTimeout))
+	f, err := fox.New(fox.WithMiddleware(tm.Timeout))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/default", success201response)
+	f.MustHandle(http.MethodGet, "/scoped", success201response, Scope(WithStatusCode(http.StatusServiceUnavailable)))
+	f.MustHandle(http.MethodGet, "/invalid", success201response, Scope(WithStatusCode(0)))
+	f.MustHandle(http.MethodGet, "/after", success201response, Scope(WithStatusCode(http.StatusServiceUnavailable)), After(time.Second))
+
+	cases := []struct {
+		path string
+		want int
+	}{
+		{path: "/default", want: http.StatusGatewayTimeout},
+		{path: "/scoped", want: http.StatusServiceUnavailable},
+		{path: "/scoped", want: http.StatusServiceUnavailable},
+		{path: "/invalid", want: http.StatusGatewayTimeout},
+		{path: "/after", want: http.StatusCreated},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.path, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			w := httptest.NewRecorder()
+			f.ServeHTTP(w, req)
+			assert.Equal(t, tc.want, w.Code)
+		})
+	}
+
+	// The scoped routes share the statistics of the middleware.
+	assert.Equal(t, int64(4), tm.Stats().Timeouts)
+}
+
+func TestScope_WithWriteStackSampling(t *testing.T) {
+	tm := New(10*time.Millisecond, WithWriteDiagnostics())
+	f, err := fox.New(fox.WithMiddleware(tm.Timeout))
+	require.NoError(t, err)
+	var returned sync.WaitGroup
+	handler := func(c fox.Context) {
+		defer returned.Done()
+		lateWriter(c)
+	}
+	f.MustHandle(http.MethodGet, "/default", handler)
+	f.MustHandle(http.MethodGet, "/scoped", handler, Scope(WithWriteStackSampling(1)))
+
+	// Scoped and unscoped requests record their late writes concurrently.
+	var wg sync.WaitGroup
+	for range 4 {
+		for _, path := range []string{"/default", "/scoped"} {
+			wg.Add(1)
+			returned.Add(1)
+			go func() {
+				defer wg.Done()
+				f.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+			}()
+		}
+	}
+	wg.Wait()
+	returned.Wait()
+
+	// The sampling rate of the scope doesn't leak into the middleware.
+	assert.Zero(t, tm.cfg.stackRate)
+	report := tm.LateWrites()
+	require.NotEmpty(t, report)
+	for _, lw := range report {
+		if lw.Route == "/scoped" {
+			assert.Contains(t, lw.Stack, "foxtimeout.lateWriter")
+		} else {
+			assert.Empty(t, lw.Stack)
+		}
+	}
+}
+
+func TestScope_WithServeStale(t *testing.T) {
+	tm := New(20*time.Millisecond, WithMicroCache(time.Second, nil))
+	now := time.Now()
+	tm.cfg.cache.now = func() time.Time { return now }
+
+	f, err := fox.New(fox.WithMiddleware(tm.Timeout))
+	require.NoError(t, err)
+	handler := func() fox.HandlerFunc {
+		var calls int
+		return func(c fox.Context) {
+			calls++
+			if calls > 1 {
+				<-c.Request().Context().Done()
+				return
+			}
+			_ = c.String(http.StatusOK, "v1")
+		}
+	}
+	f.MustHandle(http.MethodGet, "/default", handler())
+	f.MustHandle(http.MethodGet, "/scoped", handler(), Scope(WithServeStale(time.Minute)))
+
+	for _, path := range []string{"/default", "/scoped"} {
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		require.Equal(t, "v1", w.Body.String())
+	}
+
+	// Only the scoped route serves its expired response on timeout.
+	now = now.Add(2 * time.Second)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/default", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	w = httptest.NewRecorder()
+	f.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/scoped", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `110 - "Response is Stale"`, w.Header().Get("Warning"))
+	assert.Zero(t, tm.Config().ServeStale)
+}
@@ -0,0 +1,86 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultSLOMinFactor = 0.5
+	defaultSLOMaxFactor = 2
+	// Adjustment steps applied at most once per second.
+	sloLoosenStep  = 1.1
+	sloTightenStep = 0.95
+	// Below this burn rate, the error budget is considered healthy enough to tighten budgets.
+	sloSafeBurnRate = 0.5
+)
+
+// SLO describes a service level objective defended by the middleware, see [WithSLO].
+type SLO struct {
+	// Target is the target success rate, in the (0, 1) range (e.g. 0.999).
+	Target float64
+	// Window is the duration over which the burn rate is measured. It is capped to five minutes and defaults
+	// to one minute.
+	Window time.Duration
+	// MinFactor and MaxFactor bound the factor applied to the resolved timeout. They default to 0.5 and 2.
+	MinFactor float64
+	MaxFactor float64
+}
+
+// sloController scales budgets by a factor adjusted from the burn rate, which is the ratio between the observed error
+// rate and the error rate allowed by the SLO. The factor is re-evaluated at most once per second.
+type sloController struct {
+	window *slidingWindow
+	slo    SLO
+	factor atomic.Uint64
+	last   atomic.Int64
+}
+
+func newSLOController(slo SLO, window *slidingWindow) *sloController {
+	if slo.Window <= 0 {
+		slo.Window = time.Minute
+	}
+	if slo.MinFactor <= 0 {
+		slo.MinFactor = defaultSLOMinFactor
+	}
+	if slo.MaxFactor <= 0 {
+		slo.MaxFactor = defaultSLOMaxFactor
+	}
+	s := &sloController{
+		window: window,
+		slo:    slo,
+	}
+	s.factor.Store(math.Float64bits(1))
+	return s
+}
+
+func (s *sloController) scale(dt time.Duration, now time.Time) time.Duration {
+	sec := now.Unix()
+	if last := s.last.Load(); last != sec && s.last.CompareAndSwap(last, sec) {
+		s.adjust(now)
+	}
+	return time.Duration(float64(dt) * math.Float64frombits(s.factor.Load()))
+}
+
+func (s *sloController) adjust(now time.Time) {
+	requests, timeouts := s.window.sum(now, s.slo.Window)
+	if requests == 0 {
+		return
+	}
+
+	burn := (float64(timeouts) / float64(requests)) / (1 - s.slo.Target)
+	factor := math.Float64frombits(s.factor.Load())
+	switch {
+	case burn > 1:
+		factor *= sloLoosenStep
+	case burn < sloSafeBurnRate:
+		factor *= sloTightenStep
+	}
+	factor = min(max(factor, s.slo.MinFactor), s.slo.MaxFactor)
+	s.factor.Store(math.Float64bits(factor))
+}
@@ -0,0 +1,37 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestSLOController(t *testing.T) {
+	w := newSlidingWindow(time.Minute)
+	s := newSLOController(SLO{Target: 0.9, MaxFactor: 1.2, MinFactor: 0.9}, w)
+	now := time.Unix(1000, 0)
+
+	// No traffic, the budget is left untouched.
+	assert.Equal(t, time.Second, s.scale(time.Second, now))
+
+	// 50% of timeouts burns the 10% error budget too fast: loosen up to the max factor.
+	w.record(now, true)
+	w.record(now, false)
+	for i := 1; i <= 5; i++ {
+		s.scale(time.Second, now.Add(time.Duration(i)*time.Second))
+	}
+	assert.Equal(t, 1200*time.Millisecond, s.scale(time.Second, now.Add(5*time.Second)))
+
+	// Only successes: tighten down to the min factor.
+	for i := 0; i < 100; i++ {
+		w.record(now.Add(6*time.Second), false)
+	}
+	for i := 6; i <= 20; i++ {
+		s.scale(time.Second, now.Add(time.Duration(i)*time.Second))
+	}
+	assert.Equal(t, 900*time.Millisecond, s.scale(time.Second, now.Add(20*time.Second)))
+}
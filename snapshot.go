@@ -0,0 +1,82 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"github.com/tigerwill90/fox"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+// Snapshot is a bounded capture of a request that exceeded its deadline, so that slow requests can be reproduced offline.
+type Snapshot struct {
+	// Header holds the selected request headers only.
+	Header http.Header
+	// Method is the request method.
+	Method string
+	// RequestURI is the unmodified request-target of the request.
+	RequestURI string
+	// Pattern is the matched route pattern, if any.
+	Pattern string
+	// Body holds the prefix of the request body read by the handler before the timeout.
+	Body []byte
+}
+
+// SnapshotFunc is a sink invoked with a [Snapshot] of a timed out request, see [WithSnapshot].
+type SnapshotFunc func(c fox.Context, s *Snapshot)
+
+type snapshotConfig struct {
+	fn      SnapshotFunc
+	headers []string
+	maxBody int
+}
+
+func (cfg *snapshotConfig) take(c fox.Context, body *captureBody) *Snapshot {
+	req := c.Request()
+	s := &Snapshot{
+		Method:     req.Method,
+		RequestURI: req.RequestURI,
+		Header:     make(http.Header, len(cfg.headers)),
+	}
+	if route := c.Route(); route != nil {
+		s.Pattern = route.Pattern()
+	}
+	for _, k := range cfg.headers {
+		if vv := req.Header.Values(k); len(vv) > 0 {
+			s.Header[k] = slices.Clone(vv)
+		}
+	}
+	if body != nil {
+		s.Body = body.bytes()
+	}
+	return s
+}
+
+// captureBody records the first bytes read from the request body by the handler. Recording what the handler reads,
+// instead of reading the body on timeout, avoids racing with the handler goroutine.
+type captureBody struct {
+	io.ReadCloser
+	buf []byte
+	max int
+	mu  sync.Mutex
+}
+
+func (b *captureBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.mu.Lock()
+	if room := b.max - len(b.buf); room > 0 {
+		b.buf = append(b.buf, p[:min(n, room)]...)
+	}
+	b.mu.Unlock()
+	return n, err
+}
+
+func (b *captureBody) bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return slices.Clone(b.buf)
+}
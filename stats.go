@@ -0,0 +1,216 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"github.com/tigerwill90/fox"
+	"math/bits"
+	"math/rand/v2"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const cacheLineSize = 64
+
+// Stats is a point-in-time snapshot of the middleware counters.
+type Stats struct {
+	// Requests is the number of requests handled with a deadline.
+	Requests int64
+	// Timeouts is the number of requests that exceeded their deadline.
+	Timeouts int64
+	// Canceled is the number of requests canceled before their deadline (e.g. client gone).
+	Canceled int64
+	// Rejected is the number of requests rejected without calling the handler: by the admission control, by a route
+	// configured with [Reject], in maintenance mode or after [Timeout.Shutdown].
+	Rejected int64
+	// Inflight is the number of handlers currently running, including those abandoned after a timeout.
+	Inflight int64
+	// Abandoned is the number of handlers still running after the deadline or the cancellation of their request.
+	Abandoned int64
+	// Warnings is the number of requests still running after the warn threshold of their route, see [Thresholds].
+	Warnings int64
+	// Hedges is the number of second invocations started for hedgeable routes, see [Hedge].
+	Hedges int64
+	// Retries is the number of handlers invoked again after exceeding their sub-budget, see [Retry].
+	Retries int64
+	// Discarded is the number of bytes written by handlers after their deadline, which were never sent.
+	// It is updated when abandoned handlers return.
+	Discarded int64
+	// Detached is the number of background tasks started with [Detach] and still running.
+	Detached int64
+}
+
+type stats struct {
+	timeoutExemplar atomic.Pointer[exemplar]
+	duration        histogram
+	requests        counter
+	timeouts        counter
+	canceled        counter
+	rejected        counter
+	inflight        counter
+	abandoned       counter
+	warnings        counter
+	hedges          counter
+	retries         counter
+	discarded       counter
+	detached        counter
+	routeDiscarded  sync.Map
+}
+
+func newStats() *stats {
+	return &stats{
+		duration:  newHistogram(),
+		requests:  newCounter(),
+		timeouts:  newCounter(),
+		canceled:  newCounter(),
+		rejected:  newCounter(),
+		inflight:  newCounter(),
+		abandoned: newCounter(),
+		warnings:  newCounter(),
+		hedges:    newCounter(),
+		retries:   newCounter(),
+		discarded: newCounter(),
+		detached:  newCounter(),
+	}
+}
+
+// Stats returns a snapshot of the middleware counters. Counters are updated without locking, so the snapshot
+// is not guaranteed to be consistent across fields under concurrent traffic.
+func (t *Timeout) Stats() Stats {
+	return Stats{
+		Requests:  t.stats.requests.load(),
+		Timeouts:  t.stats.timeouts.load(),
+		Canceled:  t.stats.canceled.load(),
+		Rejected:  t.stats.rejected.load(),
+		Inflight:  t.stats.inflight.load(),
+		Abandoned: t.stats.abandoned.load(),
+		Warnings:  t.stats.warnings.load(),
+		Hedges:    t.stats.hedges.load(),
+		Retries:   t.stats.retries.load(),
+		Discarded: t.stats.discarded.load(),
+		Detached:  t.stats.detached.load(),
+	}
+}
+
+// Inflight returns the number of handlers currently running behind the middleware, including those abandoned after
+// a timeout. Autoscaling and alerting can key off it as the real concurrency behind the middleware.
+func (t *Timeout) Inflight() int64 {
+	return t.stats.inflight.load()
+}
+
+// Abandoned returns the number of handlers still running after the deadline or the cancellation of their request,
+// whose work is wasted.
+func (t *Timeout) Abandoned() int64 {
+	return t.stats.abandoned.load()
+}
+
+// discard records the bytes written by the handler after the deadline, globally and per route.
+func (t *Timeout) discard(c fox.Context, n int64) {
+	if n <= 0 {
+		return
+	}
+	t.stats.discarded.add(n)
+
+	pattern := RoutePattern(c)
+	if t.cfg.labels != nil {
+		pattern = t.cfg.labels.label(c)
+	}
+	v, ok := t.stats.routeDiscarded.Load(pattern)
+	if !ok {
+		v, _ = t.stats.routeDiscarded.LoadOrStore(pattern, new(atomic.Int64))
+	}
+	v.(*atomic.Int64).Add(n)
+
+	if t.cfg.emitter != nil {
+		t.cfg.emitter.discard(c, t.cfg.labels, n)
+	}
+}
+
+// DiscardedBytes returns the number of bytes written by handlers after their deadline, per route pattern, or per route
+// label if set with [WithMetricLabels]. Requests that did not match any route are reported with an empty pattern.
+func (t *Timeout) DiscardedBytes() map[string]int64 {
+	m := make(map[string]int64)
+	t.stats.routeDiscarded.Range(func(key, value any) bool {
+		m[key.(string)] = value.(*atomic.Int64).Load()
+		return true
+	})
+	return m
+}
+
+type outcome uint8
+
+const (
+	outcomeCompleted outcome = iota
+	outcomeTimeout
+	outcomeCanceled
+)
+
+// observe records the outcome of a request handled with a deadline.
+func (t *Timeout) observe(c fox.Context, o outcome, elapsed time.Duration) {
+	now := time.Now()
+	var e *exemplar
+	if traceID := t.cfg.traceID(c); traceID != "" {
+		e = &exemplar{traceID: traceID, value: elapsed.Seconds(), ts: now}
+	}
+	t.stats.duration.observe(elapsed, e)
+
+	switch o {
+	case outcomeTimeout:
+		t.stats.timeouts.add(1)
+		if e != nil {
+			t.stats.timeoutExemplar.Store(&exemplar{traceID: e.traceID, value: 1, ts: now})
+		}
+		if t.cfg.alert != nil {
+			t.cfg.alert.record(now, RouteKey(c))
+		}
+	case outcomeCanceled:
+		t.stats.canceled.add(1)
+	}
+	if t.cfg.bundle != nil && c.Route() != nil {
+		t.cfg.bundle.record(now, RouteKey(c), elapsed, o == outcomeTimeout)
+	}
+	t.window.record(now, o == outcomeTimeout)
+	if t.cfg.penalty != nil {
+		t.cfg.penalty.record(c, o)
+	}
+	if t.cfg.emitter != nil {
+		t.cfg.emitter.emit(c, t.cfg.labels, o, elapsed)
+	}
+}
+
+type paddedInt64 struct {
+	atomic.Int64
+	_ [cacheLineSize - 8]byte
+}
+
+// counter is a lock-free counter sharded across cache lines, so that concurrent updates from many cores don't
+// contend on the same memory location. Updates pick a shard at random using the per-thread runtime generator,
+// which approximates per-P sharding without requiring access to the processor id.
+type counter struct {
+	shards []paddedInt64
+	mask   uint32
+}
+
+func newCounter() counter {
+	n := 1 << bits.Len(uint(runtime.GOMAXPROCS(0)-1))
+	return counter{
+		shards: make([]paddedInt64, n),
+		mask:   uint32(n - 1),
+	}
+}
+
+func (c *counter) add(n int64) {
+	c.shards[rand.Uint32()&c.mask].Add(n)
+}
+
+func (c *counter) load() int64 {
+	var sum int64
+	for i := range c.shards {
+		sum += c.shards[i].Load()
+	}
+	return sum
+}
@@ -0,0 +1,74 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// NewStrict creates and initializes a new [Timeout] middleware like [New], but validates the timeout duration and
+// the options instead of silently ignoring or adjusting invalid values. Invalid values (e.g. a nil resolver, including
+// one wrapped by [CachedResolver], a negative size or an SLO target out of range) and conflicting options (e.g. a
+// partial response without a timeout hook, or [WithETag] in streaming mode) are reported together in the returned
+// error.
+func NewStrict(dt time.Duration, opts ...Option) (*Timeout, error) {
+	cfg := defaultConfig()
+	for _, opt := range opts {
+		opt.apply(cfg)
+	}
+
+	errs := cfg.errs
+	if dt < 0 {
+		errs = append(errs, fmt.Errorf("foxtimeout: negative timeout %s", dt))
+	}
+	if cfg.partial > 0 && cfg.hook == nil {
+		errs = append(errs, errors.New("foxtimeout: partial response requires a timeout hook"))
+	}
+	if cfg.stream {
+		// These options work on the buffered response, which doesn't exist in streaming mode.
+		if cfg.etag != nil {
+			errs = append(errs, errors.New("foxtimeout: ETag requires a buffered response, not streaming"))
+		}
+		if cfg.cache != nil {
+			errs = append(errs, errors.New("foxtimeout: micro-cache requires a buffered response, not streaming"))
+		}
+		if cfg.beforeFlush != nil {
+			errs = append(errs, errors.New("foxtimeout: before flush hook requires a buffered response, not streaming"))
+		}
+	}
+	if cfg.stale > 0 && cfg.cache == nil {
+		errs = append(errs, errors.New("foxtimeout: serve stale requires a micro-cache"))
+	}
+	if err := resolverErr(cfg.resolver); err != nil {
+		errs = append(errs, err)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	return newTimeout(dt, cfg), nil
+}
+
+// resolverErr reports a nil function or resolver within r, which would only panic when the first request is resolved.
+func resolverErr(r Resolver) error {
+	switch r := r.(type) {
+	case TimeoutResolverFunc:
+		if r == nil {
+			return errors.New("foxtimeout: nil timeout resolver function")
+		}
+	case *cachedResolver:
+		if r.resolver == nil {
+			return errors.New("foxtimeout: nil resolver wrapped by CachedResolver")
+		}
+		return resolverErr(r.resolver)
+	case *costResolver:
+		if r.cost == nil || r.curve == nil {
+			return errors.New("foxtimeout: cost resolver requires a non-nil cost function and curve")
+		}
+	}
+	return nil
+}
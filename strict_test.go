@@ -0,0 +1,134 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tigerwill90/fox"
+	"testing"
+	"time"
+)
+
+func TestNewStrict(t *testing.T) {
+	cases := []struct {
+		name    string
+		dt      time.Duration
+		opts    []Option
+		wantErr string
+	}{
+		{
+			name: "valid options",
+			dt:   time.Second,
+			opts: []Option{
+				WithTimeoutHook(func(c fox.Context, e *Event) {}),
+				WithPartialResponse(128),
+				WithSLO(SLO{Target: 0.999}),
+			},
+		},
+		{
+			name:    "negative timeout",
+			dt:      -time.Second,
+			wantErr: "foxtimeout: negative timeout -1s",
+		},
+		{
+			name:    "nil resolver",
+			dt:      time.Second,
+			opts:    []Option{WithTimeoutResolver(nil)},
+			wantErr: "foxtimeout: nil timeout resolver",
+		},
+		{
+			name:    "nil filter",
+			dt:      time.Second,
+			opts:    []Option{WithFilter(func(c fox.Context) bool { return false }, nil)},
+			wantErr: "foxtimeout: nil filter at index 1",
+		},
+		{
+			name:    "slo target out of range",
+			dt:      time.Second,
+			opts:    []Option{WithSLO(SLO{Target: 99.9})},
+			wantErr: "foxtimeout: SLO target 99.9 outside the (0, 1) range",
+		},
+		{
+			name:    "negative clamp",
+			dt:      time.Second,
+			opts:    []Option{WithClamp(-time.Second)},
+			wantErr: "foxtimeout: negative clamp -1s",
+		},
+		{
+			name:    "partial response without hook",
+			dt:      time.Second,
+			opts:    []Option{WithPartialResponse(128)},
+			wantErr: "foxtimeout: partial response requires a timeout hook",
+		},
+		{
+			name:    "etag in streaming mode",
+			dt:      time.Second,
+			opts:    []Option{WithStreaming(true), WithETag(false)},
+			wantErr: "foxtimeout: ETag requires a buffered response, not streaming",
+		},
+		{
+			name:    "micro-cache in streaming mode",
+			dt:      time.Second,
+			opts:    []Option{WithMicroCache(time.Second, nil), WithStreaming(true)},
+			wantErr: "foxtimeout: micro-cache requires a buffered response, not streaming",
+		},
+		{
+			name:    "before flush hook in streaming mode",
+			dt:      time.Second,
+			opts:    []Option{WithStreaming(true), WithBeforeFlush(func(c fox.Context, r *Response) {})},
+			wantErr: "foxtimeout: before flush hook requires a buffered response, not streaming",
+		},
+		{
+			name:    "serve stale without micro-cache",
+			dt:      time.Second,
+			opts:    []Option{WithServeStale(time.Minute)},
+			wantErr: "foxtimeout: serve stale requires a micro-cache",
+		},
+		{
+			name:    "nil resolver function",
+			dt:      time.Second,
+			opts:    []Option{WithTimeoutResolver(TimeoutResolverFunc(nil))},
+			wantErr: "foxtimeout: nil timeout resolver function",
+		},
+		{
+			name:    "nil cached resolver",
+			dt:      time.Second,
+			opts:    []Option{WithTimeoutResolver(CachedResolver(nil, time.Second, nil))},
+			wantErr: "foxtimeout: nil resolver wrapped by CachedResolver",
+		},
+		{
+			name:    "nil cached resolver function",
+			dt:      time.Second,
+			opts:    []Option{WithTimeoutResolver(CachedResolver(TimeoutResolverFunc(nil), time.Second, nil))},
+			wantErr: "foxtimeout: nil timeout resolver function",
+		},
+		{
+			name:    "nil cost function",
+			dt:      time.Second,
+			opts:    []Option{WithTimeoutResolver(CostResolver(nil, LinearCost(time.Second, time.Millisecond, time.Minute)))},
+			wantErr: "foxtimeout: cost resolver requires a non-nil cost function and curve",
+		},
+		{
+			name:    "multiple errors",
+			dt:      time.Second,
+			opts:    []Option{WithResponse(nil), WithPartialResponse(-1)},
+			wantErr: "foxtimeout: nil response handler\nfoxtimeout: negative partial response size -1",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tm, err := NewStrict(tc.dt, tc.opts...)
+			if tc.wantErr != "" {
+				assert.EqualError(t, err, tc.wantErr)
+				assert.Nil(t, tm)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.dt, tm.Policy().Default)
+		})
+	}
+}
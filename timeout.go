@@ -13,10 +13,16 @@ import (
 	"context"
 	"fmt"
 	"github.com/tigerwill90/fox"
+	"log/slog"
+	"maps"
+	"math/rand/v2"
 	"net/http"
-	"runtime"
+	"runtime/debug"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -31,7 +37,24 @@ var (
 // Timeout is a middleware that ensure HTTP handlers don't exceed the configured timeout duration.
 type Timeout struct {
 	cfg *config
-	dt  time.Duration
+	*shared
+}
+
+// shared holds the state of a [Timeout] shared with the per-route views created by [Scope].
+type shared struct {
+	stats        *stats
+	window       *slidingWindow
+	slo          *sloController
+	policy       atomic.Pointer[Policy]
+	maintenance  atomic.Pointer[string]
+	watchers     watchers
+	shutdown     atomic.Bool
+	drain        atomic.Pointer[float64]
+	disabled     atomic.Pointer[map[string]struct{}]
+	disabledMu   sync.Mutex
+	views        sync.Map
+	orderingOnce sync.Once
+	hasRecovery  bool
 }
 
 // Middleware returns a [fox.MiddlewareFunc] with a specified timeout and options.
@@ -40,6 +63,14 @@ func Middleware(dt time.Duration, opts ...Option) fox.MiddlewareFunc {
 	return New(dt, opts...).Timeout
 }
 
+// OnRoute returns a [fox.RouteOption] registering the middleware on a single route, with a specified timeout and
+// options. This allows attaching the timeout to the few risky routes only, rather than wrapping the whole router.
+// Each call creates its own middleware, so use [fox.WithMiddleware] with [Timeout.Timeout] to share a [Timeout], and
+// its statistics, between several routes.
+func OnRoute(dt time.Duration, opts ...Option) fox.RouteOption {
+	return fox.WithMiddleware(Middleware(dt, opts...))
+}
+
 // New creates and initializes a new [Timeout] middleware with the given timeout duration
 // and optional settings.3
 func New(dt time.Duration, opts ...Option) *Timeout {
@@ -47,80 +78,915 @@ func New(dt time.Duration, opts ...Option) *Timeout {
 	for _, opt := range opts {
 		opt.apply(cfg)
 	}
+	return newTimeout(dt, cfg)
+}
 
-	cfg.resolver = cmp.Or[Resolver](
-		cfg.resolver,
-		TimeoutResolverFunc(func(c fox.Context) (time.Duration, bool) { return dt, true }),
-	)
+func newTimeout(dt time.Duration, cfg *config) *Timeout {
+	cfg.resolver = cmp.Or[Resolver](cfg.resolver, noResolver{})
 
-	return &Timeout{
-		dt:  dt,
+	t := &Timeout{
 		cfg: cfg,
+		shared: &shared{
+			stats:  newStats(),
+			window: newSlidingWindow(maxHealthWindow),
+		},
+	}
+	if cfg.slo != nil {
+		t.slo = newSLOController(*cfg.slo, t.window)
+	}
+	if cfg.cache != nil {
+		cfg.cache.retainStale(cfg.stale)
+	}
+	t.policy.Store(&Policy{Default: dt})
+	return t
+}
+
+// Policy returns the [Policy] currently applied by the middleware.
+func (t *Timeout) Policy() Policy {
+	return *t.policy.Load()
+}
+
+// SetPolicy atomically replaces the [Policy] applied by the middleware. In-flight requests keep the policy
+// they started with, and subsequent requests use the new one. This function is safe for concurrent use.
+func (t *Timeout) SetPolicy(p Policy) {
+	t.policy.Store(&p)
+}
+
+// shutdownPollIntervalMax is the maximum interval between two checks of the running handlers by [Timeout.Shutdown].
+const shutdownPollIntervalMax = 500 * time.Millisecond
+
+// Shutdown gracefully shuts down the middleware: it stops accepting new requests, which are rejected with a 503 Service
+// Unavailable error (and "Connection: close" for HTTP/1.x), then waits for the running handlers to return, including
+// those abandoned after a timeout and the background tasks started with [Detach], so that process shutdown doesn't
+// strand work silently. Requests excluded by a [Filter] or with [None] are still handled. If ctx is done before the
+// handlers return, Shutdown returns the error of ctx. Like [http.Server.Shutdown], a request admitted concurrently
+// with the call may start its handler after Shutdown returned. This function is safe for concurrent use.
+func (t *Timeout) Shutdown(ctx context.Context) error {
+	t.shutdown.Store(true)
+
+	interval := time.Millisecond
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		if t.stats.inflight.load() == 0 && t.stats.detached.load() == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			interval = min(2*interval, shutdownPollIntervalMax)
+			timer.Reset(interval)
+		}
+	}
+}
+
+// Drain enables the drain mode, typically once the process received a termination signal: the budget of new requests
+// is multiplied by factor (e.g. 0.5), so that traffic finishes quickly before the termination grace period elapses.
+// In-flight requests keep their budget. If factor is not in the range (0, 1), the drain mode is disabled. This function
+// is safe for concurrent use.
+func (t *Timeout) Drain(factor float64) {
+	if factor <= 0 || factor >= 1 {
+		t.drain.Store(nil)
+		return
+	}
+	t.drain.Store(&factor)
+}
+
+// DisableRoute exempts the route registered with the given pattern from the timeout, whatever its method, until
+// [Timeout.EnableRoute] is called. Requests are handled by the next handler directly, like with the [None] route
+// option. This allows relaxing a route at runtime, e.g. during a known-slow migration, without redeploying. This
+// function is safe for concurrent use.
+func (t *Timeout) DisableRoute(pattern string) {
+	t.disabledMu.Lock()
+	defer t.disabledMu.Unlock()
+	m := make(map[string]struct{})
+	if cur := t.disabled.Load(); cur != nil {
+		maps.Copy(m, *cur)
+	}
+	m[pattern] = struct{}{}
+	t.disabled.Store(&m)
+}
+
+// EnableRoute includes again the route registered with the given pattern, after it was exempted with
+// [Timeout.DisableRoute]. This function is safe for concurrent use.
+func (t *Timeout) EnableRoute(pattern string) {
+	t.disabledMu.Lock()
+	defer t.disabledMu.Unlock()
+	cur := t.disabled.Load()
+	if cur == nil {
+		return
+	}
+	if _, ok := (*cur)[pattern]; !ok {
+		return
+	}
+	if len(*cur) == 1 {
+		t.disabled.Store(nil)
+		return
 	}
+	m := maps.Clone(*cur)
+	delete(m, pattern)
+	t.disabled.Store(&m)
+}
+
+// routeDisabled reports whether the route of the request is exempted with [Timeout.DisableRoute].
+func (t *Timeout) routeDisabled(c fox.Context) bool {
+	m := t.disabled.Load()
+	if m == nil {
+		return false
+	}
+	route := c.Route()
+	if route == nil {
+		return false
+	}
+	_, ok := (*m)[route.Pattern()]
+	return ok
+}
+
+// SetMaintenance enables or disables the maintenance mode. While enabled, every request that is not excluded by
+// a filter is immediately rejected with a 503 Service Unavailable error and the given message in its body,
+// without calling the next handler. If msg is empty, the status text is used. This gives operators a one-call
+// brownout switch during incidents. This function is safe for concurrent use.
+func (t *Timeout) SetMaintenance(on bool, msg string) {
+	if !on {
+		t.maintenance.Store(nil)
+		return
+	}
+	msg = cmp.Or(msg, http.StatusText(http.StatusServiceUnavailable))
+	t.maintenance.Store(&msg)
+}
+
+// WrapF wraps a [http.HandlerFunc] into a [fox.HandlerFunc] protected by the middleware, like [Timeout.Timeout] with
+// [fox.WrapF]. This eases the migration of legacy handlers into a fox router: the handler writes to the buffered
+// response writer of the middleware, the context of its request carries the deadline, and its writes after the
+// deadline are discarded.
+func (t *Timeout) WrapF(f http.HandlerFunc) fox.HandlerFunc {
+	return t.Timeout(fox.WrapF(f))
 }
 
 // Timeout returns a [fox.HandlerFunc] that runs next with the given time limit.
 //
 // The new handler calls next to handle each request, but if a call runs for longer than its time limit,
 // the handler responds with a 503 Service Unavailable error and the given message in its body (if a custom response
-// handler is not configured). After such a timeout, writes by next to its ResponseWriter will return [http.ErrHandlerTimeout].
+// handler is not configured). After such a timeout, writes by next to its ResponseWriter will return a
+// [*WriteAfterTimeoutError] wrapping [http.ErrHandlerTimeout].
 //
 // Timeout supports the [http.Pusher] interface but does not support the [http.Hijacker] or [http.Flusher] interfaces.
 func (t *Timeout) Timeout(next fox.HandlerFunc) fox.HandlerFunc {
-	if t.dt <= 0 {
-		return func(c fox.Context) {
-			next(c)
-		}
-	}
-
 	return func(c fox.Context) {
+		t := t.view(c)
+		if !t.checkOrdering() && t.cfg.requireRecovery {
+			panic(ErrNoRecovery)
+		}
 
-		ctx, cancel := t.resolveContext(c)
-		defer cancel()
+		var d *decision
+		if t.cfg.debug {
+			d = &decision{start: time.Now()}
+			defer t.logDecision(c, d)
+		}
 
 		for _, f := range t.cfg.filters {
+			d.filter()
 			if f(c) {
+				d.done(decisionFiltered)
 				next(c)
 				return
 			}
 		}
 
-		req := c.Request().WithContext(ctx)
-		done := make(chan struct{})
-		panicChan := make(chan any, 1)
+		route := routePolicyOf(c)
+		if route.mode == modeNone || t.routeDisabled(c) || noneIf(c) {
+			d.done(decisionDisabled)
+			next(c)
+			return
+		}
+
+		if msg := t.maintenance.Load(); msg != nil {
+			d.done(reasonMaintenance)
+			t.stats.rejected.add(1)
+			t.setReasonHeaders(c.Writer().Header(), reasonMaintenance)
+			http.Error(c.Writer(), *msg, http.StatusServiceUnavailable)
+			return
+		}
+
+		if t.shutdown.Load() {
+			d.done(reasonShutdown)
+			t.stats.rejected.add(1)
+			t.setReasonHeaders(c.Writer().Header(), reasonShutdown)
+			if c.Request().ProtoMajor == 1 {
+				c.Writer().Header().Set("Connection", "close")
+			}
+			http.Error(c.Writer(), http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+
+		if route.mode == modeReject {
+			d.done(reasonRejected)
+			t.stats.rejected.add(1)
+			t.setReasonHeaders(c.Writer().Header(), reasonRejected)
+			t.respond(c)
+			return
+		}
+
+		if t.cfg.cache != nil {
+			if e, age, ok := t.cfg.cache.lookup(c); ok {
+				d.done(decisionCached)
+				t.serveCached(c, e, age, false)
+				return
+			}
+		}
+
+		def := t.policy.Load().Default
+		if def <= 0 {
+			d.done(decisionDisabled)
+			next(c)
+			return
+		}
+
+		st := &requestState{
+			start:    time.Now(),
+			stream:   streamed(c, t.cfg.stream),
+			detached: &t.stats.detached,
+		}
+		st.budget, st.source = t.resolve(c, def, route)
+		d.resolved(st)
+		if t.cfg.policyHeader != "" {
+			// Set on the response writer, so that the header is sent whatever the outcome of the request.
+			c.Writer().Header().Set(t.cfg.policyHeader, "budget="+st.budget.String()+"; source="+st.source.String())
+		}
+
+		if adm := t.cfg.admission; adm != nil && st.budget-adm.queue(c) < adm.floor {
+			d.done(reasonAdmission)
+			t.stats.rejected.add(1)
+			t.setReasonHeaders(c.Writer().Header(), reasonAdmission)
+			t.respond(c)
+			return
+		}
+		var (
+			ctx    context.Context
+			cancel context.CancelFunc
+			parts  *partReader
+			phase  *phaseReader
+		)
+		if route.mode == modePerPart {
+			parts = newPartReader(c.Request())
+		}
+		if route.mode == modeIdle {
+			rc := withResetTimeout(c.Request().Context(), st.budget)
+			ctx, cancel, st.activity = rc, rc.stop, rc.reset
+		} else if parts != nil {
+			rc := withResetTimeout(c.Request().Context(), st.budget)
+			ctx, cancel, parts.reset = rc, rc.stop, rc.reset
+		} else if read := t.cfg.phases.Read; read > 0 && !replayable(c.Request()) {
+			rc := withResetTimeout(c.Request().Context(), read)
+			ctx, cancel = rc, rc.stop
+			phase = newPhaseReader(c.Request().Body, st, func() { rc.resetTo(st.budget) })
+			st.endRead = phase.end
+		} else {
+			ctx, cancel = t.withTimeout(c.Request().Context(), st.budget)
+		}
+		defer cancel()
+
+		hctx := ctx
+		if t.cfg.redirect != nil {
+			// The handler continues detached once the redirection is sent, so its context must then outlive the
+			// deadline and the request itself.
+			rc := newRedirectContext(ctx)
+			hctx, st.detach = rc, rc.detach
+			defer func() { rc.stop(ctx.Err()) }()
+		}
+		req := c.Request().WithContext(context.WithValue(hctx, stateKey{}, st))
+		if parts != nil {
+			req.Body = parts
+		}
+		if phase != nil {
+			req.Body = phase
+		}
+		var body *captureBody
+		if t.cfg.snapshot != nil && t.cfg.snapshot.maxBody > 0 && req.Body != nil && req.Body != http.NoBody {
+			body = &captureBody{ReadCloser: req.Body, max: t.cfg.snapshot.maxBody}
+			req.Body = body
+		}
+		var hedge, retry time.Duration
+		if !st.stream && parts == nil {
+			hedge = hedgeDelay(c)
+			retry = retryBudget(c, st.budget)
+		}
+		n := 1
+		if hedge > 0 || retry > 0 {
+			n = 2
+		}
+		finished := make(chan *attempt, n)
+		panicChan := make(chan any, n)
+
+		t.stats.requests.add(1)
+		first := t.start(c, next, req, st, AttemptInitial, retry, hedge > 0, finished, panicChan)
+		attempts := []*attempt{first}
+		history := []*attempt{first}
+		var retryC <-chan struct{}
+		if retry > 0 {
+			retryC = first.ctx.Done()
+		}
+		var hedgeC <-chan time.Time
+		if hedge > 0 {
+			timer := time.NewTimer(hedge)
+			defer timer.Stop()
+			hedgeC = timer.C
+		}
+		var warnC <-chan time.Time
+		if route.warn > 0 {
+			timer := time.NewTimer(route.warn - time.Since(st.start))
+			defer timer.Stop()
+			warnC = timer.C
+		}
+		var interimC <-chan time.Time
+		if t.cfg.interim != nil && c.Request().ProtoAtLeast(1, 1) {
+			ticker := time.NewTicker(t.cfg.interim.interval)
+			defer ticker.Stop()
+			interimC = ticker.C
+		}
+
+		for {
+			select {
+			case p := <-panicChan:
+				for _, a := range attempts {
+					a.tw.mu.Lock()
+					a.tw.release()
+					a.tw.mu.Unlock()
+				}
+				panic(p)
+			case <-warnC:
+				t.warn(c, st)
+			case <-interimC:
+				t.sendInterim(c.Writer(), attempts[len(attempts)-1].tw)
+			case <-hedgeC:
+				hedgeC = nil
+				t.stats.hedges.add(1)
+				a := t.start(c, next, req, st, AttemptHedge, 0, true, finished, panicChan)
+				attempts, history = append(attempts, a), append(history, a)
+			case <-retryC:
+				retryC = nil
+				if ctx.Err() != nil {
+					// The request deadline fired at the same time, there is no budget left to retry.
+					continue
+				}
+				// The first attempt exceeded its sub-budget, it is abandoned like on timeout and its writes are
+				// discarded.
+				first.abandoned = true
+				first.end = time.Now()
+				first.cancel()
+				first.tw.mu.Lock()
+				// The late writes of a superseded attempt are expected, they are not reported in strict mode.
+				first.tw.lateWrite = nil
+				t.abandon(first.tw, http.ErrHandlerTimeout)
+				first.tw.release()
+				first.tw.mu.Unlock()
+				attempts = slices.DeleteFunc(attempts, func(a *attempt) bool { return a == first })
+				if len(attempts) == 0 {
+					hedgeC = nil
+					t.stats.retries.add(1)
+					a := t.start(c, next, req, st, AttemptRetry, 0, false, finished, panicChan)
+					attempts, history = append(attempts, a), append(history, a)
+				}
+			case a := <-finished:
+				if a.abandoned {
+					continue
+				}
+				now := time.Now()
+				t.observe(c, outcomeCompleted, now.Sub(st.start))
+				a.won = true
+				for _, loser := range attempts {
+					loser.end = now
+					if loser.cancel != nil {
+						loser.cancel()
+					}
+					if loser != a {
+						loser.tw.mu.Lock()
+						loser.tw.release()
+						loser.tw.mu.Unlock()
+					}
+				}
+				d.done(decisionCompleted)
+				t.complete(c, a.tw, st, account(history, st, now))
+				return
+			case <-ctx.Done():
+				if ctx.Err() == context.DeadlineExceeded {
+					d.done(decisionTimeout)
+				} else {
+					d.done(decisionCanceled)
+				}
+				t.expire(c, ctx.Err(), attempts, history, st, body)
+				return
+			}
+		}
+	}
+}
+
+// attempt is an invocation of the next handler, running in its own goroutine and writing to its own writer.
+type attempt struct {
+	begin     time.Time
+	end       time.Time
+	ctx       context.Context
+	tw        *timeoutWriter
+	cancel    context.CancelFunc
+	budget    time.Duration
+	kind      AttemptKind
+	abandoned bool
+	won       bool
+}
+
+// account returns how the budget of the request was split across the attempts, or nil if the handler was invoked only
+// once. Attempts that did not end by now are reported as running.
+func account(history []*attempt, st *requestState, now time.Time) []Attempt {
+	if len(history) < 2 {
+		return nil
+	}
+	attempts := make([]Attempt, len(history))
+	for i, a := range history {
+		attempts[i] = Attempt{
+			Kind:   a.kind,
+			Start:  a.begin.Sub(st.start),
+			Budget: a.budget,
+			Won:    a.won,
+		}
+		if a.end.IsZero() {
+			attempts[i].Running = true
+			attempts[i].Elapsed = now.Sub(a.begin)
+		} else {
+			attempts[i].Elapsed = a.end.Sub(a.begin)
+		}
+	}
+	return attempts
+}
+
+// start invokes next in a new goroutine, which sends the attempt to finished when next returns, or the recovered value
+// to panicChan if next panics. If dt is positive, the attempt gets its own deadline, and if cancelable is true, its own
+// context, so that it can be canceled when another attempt wins. Either way, it also gets its own copy of the request,
+// since it may run concurrently with other attempts.
+func (t *Timeout) start(c fox.Context, next fox.HandlerFunc, req *http.Request, st *requestState, kind AttemptKind, dt time.Duration, cancelable bool, finished chan<- *attempt, panicChan chan<- any) *attempt {
+	a := &attempt{ctx: req.Context(), kind: kind, begin: time.Now()}
+	a.budget = st.budget - a.begin.Sub(st.start)
+	if dt > 0 {
+		a.budget = dt
+	}
+	switch {
+	case dt > 0:
+		a.ctx, a.cancel = context.WithTimeout(a.ctx, dt)
+		req = req.Clone(a.ctx)
+	case cancelable:
+		a.ctx, a.cancel = context.WithCancel(a.ctx)
+		req = req.Clone(a.ctx)
+	}
+
+	tw := &timeoutWriter{
+		w:        c.Writer(),
+		headers:  make(http.Header),
+		req:      req,
+		code:     http.StatusOK,
+		stream:   st.stream,
+		activity: st.activity,
+	}
+	if st.endRead != nil {
+		// The read phase ends at the latest with the first write of the handler.
+		tw.activity = st.endRead
+	}
+	if tw.stream {
+		// The headers are sent with the first write, so the debug header is set upfront.
+		t.setDebugHeader(tw.headers, st, nil)
+	} else {
+		tw.buf = bufp.Get().(*bytes.Buffer)
+		tw.buf.Reset()
+	}
+	if route := c.Route(); route != nil && (t.cfg.lateWrites != nil || t.cfg.strictLate != strictLateOff) {
+		tw.route = route.Pattern()
+	}
+	tw.late = t.cfg.lateWrites
+	tw.stackRate = t.cfg.stackRate
+	tw.limits = t.cfg.headerLimits
+	tw.stripHop = t.cfg.stripHop
+	a.tw = tw
+
+	var rw fox.ResponseWriter = tw
+	if t.cfg.writer != nil {
+		rw = t.cfg.writer(&Writer{tw})
+	}
+	cp := c.CloneWith(rw, req)
+	if t.cfg.strictHeader {
+		tw.superfluous = func(err *SuperfluousWriteHeaderError) {
+			if t.cfg.warnHook == nil && !t.watchers.active() {
+				return
+			}
+			e := newSuperfluousEvent(cp, st, err)
+			if t.cfg.warnHook != nil {
+				t.cfg.warnHook(cp, e)
+			}
+			t.watchers.publish(e)
+		}
+	}
+	if t.cfg.strictLate != strictLateOff {
+		tw.lateWrite = t.lateWrite(tw.route)
+	}
+	t.stats.inflight.add(1)
+	go func() {
+		defer func() {
+			p := recover()
+			t.stats.inflight.add(-1)
+			tw.mu.Lock()
+			tw.returned = true
+			werr := tw.err
+			tw.mu.Unlock()
+			if werr != nil {
+				t.stats.abandoned.add(-1)
+				t.discard(cp, werr.Dropped())
+				if p == nil && t.watchers.active() {
+					t.watchers.publish(t.lateEvent(cp, tw, st))
+				}
+			}
+			cp.Close()
+			if err, ok := p.(*WriteAfterTimeoutError); ok && err == werr {
+				// Raised in strict mode after the timeout response was sent, so nobody is left to recover it.
+				panic(p)
+			}
+			if p != nil {
+				panicChan <- p
+			}
+		}()
+		next(cp)
+		if st.endRead != nil {
+			st.endRead()
+		}
+		finished <- a
+	}()
+	return a
+}
 
-		w := c.Writer()
-		buf := bufp.Get().(*bytes.Buffer)
-		buf.Reset()
+// lateWrite returns the callback of the writes attempted after the deadline in strict mode, see
+// [WithStrictLateWrites]. Only the first write is logged, since an abandoned handler often writes many times.
+func (t *Timeout) lateWrite(route string) func(err *WriteAfterTimeoutError) {
+	// The callback is called with the lock of the writer held, which guards logged.
+	var logged bool
+	return func(err *WriteAfterTimeoutError) {
+		if !logged {
+			logged = true
+			caller := writeCaller()
+			t.cfg.logger.Error(
+				"foxtimeout: write after timeout, the handler ignores the cancellation of the request context",
+				slog.String("route", route),
+				slog.String("caller", caller.Function),
+				slog.String("file", caller.File),
+				slog.Int("line", caller.Line),
+			)
+		}
+		if t.cfg.strictLate == strictLatePanic {
+			panic(err)
+		}
+	}
+}
+
+// warn records a request still running after the warn threshold of its route.
+func (t *Timeout) warn(c fox.Context, st *requestState) {
+	t.stats.warnings.add(1)
+	if t.cfg.warnHook == nil && !t.watchers.active() {
+		return
+	}
+	e := newWarnEvent(c, st)
+	if t.cfg.warnHook != nil {
+		t.cfg.warnHook(c, e)
+	}
+	t.watchers.publish(e)
+}
+
+// sendInterim sends an interim response, unless the handler already started streaming its response.
+func (t *Timeout) sendInterim(w fox.ResponseWriter, tw *timeoutWriter) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.stream && tw.written {
+		return
+	}
+	w.WriteHeader(t.cfg.interim.code)
+}
+
+// abandon sets the error returned to the handler on subsequent writes, and counts the handler as abandoned if it is
+// still running. It must be called with the writer lock held.
+func (t *Timeout) abandon(tw *timeoutWriter, cause error) {
+	tw.err = &WriteAfterTimeoutError{Err: cause}
+	if !tw.returned {
+		t.stats.abandoned.add(1)
+	}
+}
+
+// complete sends the response of the attempt that completed within the deadline.
+func (t *Timeout) complete(c fox.Context, tw *timeoutWriter, st *requestState, attempts []Attempt) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	defer tw.release()
+	if !tw.written {
+		tw.writeHeaderLocked(tw.code)
+	}
+	if tw.stream {
+		return
+	}
+	if tw.stripHop {
+		stripHopByHop(tw.headers)
+	}
+	resp := Response{Header: tw.headers, Body: tw.buf.Bytes(), StatusCode: tw.code}
+	if t.cfg.beforeFlush != nil {
+		t.cfg.beforeFlush(c, &resp)
+	}
+	if t.cfg.etag != nil {
+		t.setETag(c.Request(), &resp)
+	}
+	if t.cfg.cache != nil {
+		t.cfg.cache.store(c, &resp)
+	}
+	if t.cfg.etag != nil {
+		notModified(c.Request(), &resp)
+	}
+	w := c.Writer()
+	dst := w.Header()
+	for k, vv := range resp.Header {
+		dst[k] = vv
+	}
+	t.setDebugHeader(dst, st, attempts)
+	if write := t.cfg.phases.Write; write > 0 {
+		// A client too slow to receive the response gets its connection closed. The deadline is cleared afterward,
+		// since it would otherwise still apply to the next requests of the connection.
+		_ = w.SetWriteDeadline(time.Now().Add(write))
+		defer func() { _ = w.SetWriteDeadline(time.Time{}) }()
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, _ = w.Write(resp.Body)
+}
+
+// expire abandons the running attempts once the context of the request is done, and sends the timeout response.
+func (t *Timeout) expire(c fox.Context, err error, attempts, history []*attempt, st *requestState, body *captureBody) {
+	accounts := account(history, st, time.Now())
+
+	cause := err
+	if err == context.DeadlineExceeded {
+		t.observe(c, outcomeTimeout, time.Since(st.start))
+		cause = http.ErrHandlerTimeout
+	} else {
+		t.observe(c, outcomeCanceled, time.Since(st.start))
+	}
+	// The expensive diagnostics of the timeout are captured for a sample of the timeouts only, see
+	// [WithDiagnosticsSampling].
+	sampled := cause != http.ErrHandlerTimeout || t.cfg.sampling.keep()
+	written := false
+	for i, a := range attempts {
+		a.tw.mu.Lock()
+		a.tw.unsampled = !sampled
+		if i < len(attempts)-1 {
+			// The attempt was superseded by a hedge, its late writes are not reported in strict mode.
+			a.tw.lateWrite = nil
+		}
+		t.abandon(a.tw, cause)
+		written = written || a.tw.written
+	}
+	// The event is built while the writers are locked, since it captures the partial response of the most recent
+	// attempt from its buffer.
+	var e *Event
+	if cause == http.ErrHandlerTimeout && t.cfg.hook != nil || t.watchers.active() {
+		e = t.newEvent(c, attempts[len(attempts)-1].tw, st, accounts)
+		if cause != http.ErrHandlerTimeout {
+			e.Kind = EventCanceled
+		}
+	}
+	// The abandoned handlers may keep running for a while, but can't write anymore once the error is set, so the
+	// buffers are detached and recycled right away. The locks are released before calling any user code, which may
+	// share synchronized state with the handler.
+	for _, a := range attempts {
+		a.tw.release()
+		a.tw.mu.Unlock()
+	}
+
+	w := c.Writer()
+	// With HTTP/3, the read deadline applies to the QUIC stream, and some servers fail the whole stream when it
+	// expires, which would prevent the timeout response from being sent.
+	if c.Request().ProtoMajor < 3 {
+		_ = w.SetReadDeadline(time.Now())
+	}
+	behavior := t.behavior(c.Request())
+	if st.stream && written {
+		// The response is already partially sent, so the only way to signal the truncation is to abort it.
+		behavior = BehaviorAbort
+	}
+	if behavior != BehaviorAbort {
+		if d := t.cfg.errWrite; d > 0 {
+			// A stalled client can't hold the request while the timeout response is sent. As with the write phase,
+			// the deadline is cleared afterward for the next requests of the connection.
+			_ = w.SetWriteDeadline(time.Now().Add(d))
+			defer func() { _ = w.SetWriteDeadline(time.Time{}) }()
+		}
+		t.setDebugHeader(w.Header(), st, accounts)
+		reading := cause == http.ErrHandlerTimeout && st.reading.Load()
+		switch {
+		case reading:
+			t.setReasonHeaders(w.Header(), reasonRead)
+		case cause == http.ErrHandlerTimeout:
+			t.setReasonHeaders(w.Header(), reasonDeadline)
+		default:
+			t.setReasonHeaders(w.Header(), reasonCanceled)
+		}
+		if (behavior == BehaviorClose || reading) && c.Request().ProtoMajor == 1 {
+			w.Header().Set("Connection", "close")
+		}
+		fallback := st.fallbackHandler()
+		var (
+			stale *cachedResponse
+			age   time.Duration
+		)
+		if cause == http.ErrHandlerTimeout && fallback == nil {
+			stale, age, _ = t.cfg.cache.lookupStale(c, t.cfg.stale)
+		}
+		switch {
+		case reading:
+			// The client is too slow to send the body, which is not a failure of the handler.
+			t.writeStatus(w, http.StatusRequestTimeout)
+		case fallback != nil && cause == http.ErrHandlerTimeout:
+			t.render(c, fallback, t.respond)
+		case stale != nil:
+			// Degrade gracefully with the last successful response rather than failing the request.
+			w.Header().Del("Retry-After")
+			t.serveCached(c, stale, age, true)
+		case t.cfg.redirect != nil && cause == http.ErrHandlerTimeout:
+			t.render(c, func(c fox.Context) { t.redirect(c, st) }, t.respond)
+		case t.cfg.sourceStatus[st.source] != 0 && cause == http.ErrHandlerTimeout && routeStatus(c) == 0:
+			t.writeStatus(w, t.cfg.sourceStatus[st.source])
+		default:
+			t.respond(c)
+		}
+	}
+	if cause == http.ErrHandlerTimeout {
+		if t.cfg.recent != nil {
+			t.cfg.recent.record(c, time.Now(), st)
+		}
+		if t.cfg.hook != nil {
+			t.cfg.hook(c, e)
+		}
+		if t.cfg.snapshot != nil && sampled {
+			t.cfg.snapshot.fn(c, t.cfg.snapshot.take(c, body))
+		}
+	}
+	if e != nil && t.watchers.active() {
+		t.watchers.publish(e)
+	}
+	if behavior == BehaviorAbort {
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// respond sends the timeout response, or the status code set on the route with [StatusCode]. A panic in the response
+// handler is recovered and logged, and the middleware falls back to [DefaultTimeoutResponse] if nothing was written
+// yet, so a buggy error renderer can't turn timeouts into connection resets.
+func (t *Timeout) respond(c fox.Context) {
+	if code := routeStatus(c); code != 0 {
+		t.writeStatus(c.Writer(), code)
+		return
+	}
+	if t.cfg.headersOnly && t.cfg.status != 0 {
+		t.writeStatus(c.Writer(), t.cfg.status)
+		return
+	}
+	t.render(c, t.cfg.resp, DefaultTimeoutResponse)
+}
+
+// writeStatus sends a response with the given status code and its status text in the body, or with an empty body and
+// the static headers set with [WithHeadersOnly].
+func (t *Timeout) writeStatus(w http.ResponseWriter, code int) {
+	if !t.cfg.headersOnly {
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+	dst := w.Header()
+	for k, vv := range t.cfg.headers {
+		dst[k] = slices.Clone(vv)
+	}
+	w.WriteHeader(code)
+}
+
+// redirect responds with 303 See Other to the status URL of the request and detaches the handler, or with the
+// timeout response if there is none.
+func (t *Timeout) redirect(c fox.Context, st *requestState) {
+	url := t.cfg.redirect(c)
+	if url == "" {
+		t.respond(c)
+		return
+	}
+	http.Redirect(c.Writer(), c.Request(), url, http.StatusSeeOther)
+	st.detach()
+}
+
+// redirectContext is the context of a handler on a route that redirects on timeout, see [WithRedirectOnTimeout].
+// It reports the deadline of the request until the handler is detached by the redirection, and is canceled when the
+// request completes unless it was detached.
+type redirectContext struct {
+	context.Context
+	deadline func() (time.Time, bool)
+	cancel   context.CancelCauseFunc
+	detached atomic.Bool
+}
+
+func newRedirectContext(ctx context.Context) *redirectContext {
+	dctx, cancel := context.WithCancelCause(context.WithoutCancel(ctx))
+	return &redirectContext{
+		Context:  dctx,
+		deadline: ctx.Deadline,
+		cancel:   cancel,
+	}
+}
+
+func (c *redirectContext) Deadline() (time.Time, bool) {
+	if c.detached.Load() {
+		return time.Time{}, false
+	}
+	return c.deadline()
+}
+
+func (c *redirectContext) Err() error {
+	if c.Context.Err() == nil {
+		return nil
+	}
+	// The cause is the error of the request context, e.g. context.DeadlineExceeded.
+	return context.Cause(c.Context)
+}
+
+func (c *redirectContext) detach() {
+	c.detached.Store(true)
+}
+
+// stop cancels the context with err, unless the handler was detached.
+func (c *redirectContext) stop(err error) {
+	if !c.detached.Load() {
+		c.cancel(cmp.Or(err, context.Canceled))
+	}
+}
+
+// render calls h to send the response, and recovers from a panic in h by logging it and calling otherwise if nothing
+// was written yet. If a limit is set with [WithResponseTimeout], h runs in its own goroutine, see renderWithin.
+func (t *Timeout) render(c fox.Context, h, otherwise fox.HandlerFunc) {
+	if t.cfg.respTimeout > 0 {
+		h = t.renderWithin(h, otherwise)
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			t.cfg.logger.Error(
+				"foxtimeout: panic in response handler",
+				slog.Any("panic", p),
+				slog.String("stack", string(debug.Stack())),
+			)
+			if !c.Writer().Written() {
+				otherwise(c)
+			}
+		}
+	}()
+	h(c)
+}
+
+// renderWithin returns a handler running h in its own goroutine, with a buffered response writer and a context
+// limited by [WithResponseTimeout] that doesn't inherit the cancellation of the request. If h doesn't return within
+// the limit, it is abandoned like a handler after its deadline, and otherwise sends the response instead. A panic in
+// h is propagated to the caller.
+func (t *Timeout) renderWithin(h, otherwise fox.HandlerFunc) fox.HandlerFunc {
+	return func(c fox.Context) {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(c.Request().Context()), t.cfg.respTimeout)
+		defer cancel()
+		req := c.Request().WithContext(ctx)
 		tw := &timeoutWriter{
-			w:       w,
+			w:       c.Writer(),
 			headers: make(http.Header),
 			req:     req,
 			code:    http.StatusOK,
-			buf:     buf,
+			buf:     bufp.Get().(*bytes.Buffer),
 		}
-
+		tw.buf.Reset()
 		cp := c.CloneWith(tw, req)
 
+		done := make(chan any, 1)
 		go func() {
 			defer func() {
+				p := recover()
 				cp.Close()
-				if p := recover(); p != nil {
-					panicChan <- p
-				}
+				done <- p
 			}()
-			next(cp)
-			close(done)
+			h(cp)
 		}()
 
 		select {
-		case p := <-panicChan:
-			// Don't forget to release the buffer
-			bufp.Put(buf)
-			panic(p)
-		case <-done:
+		case p := <-done:
 			tw.mu.Lock()
 			defer tw.mu.Unlock()
+			defer tw.release()
+			if p != nil {
+				panic(p)
+			}
+			if !tw.written {
+				tw.writeHeaderLocked(tw.code)
+			}
+			w := c.Writer()
 			dst := w.Header()
 			for k, vv := range tw.headers {
 				dst[k] = vv
@@ -129,48 +995,148 @@ func (t *Timeout) Timeout(next fox.HandlerFunc) fox.HandlerFunc {
 			_, _ = w.Write(tw.buf.Bytes())
 		case <-ctx.Done():
 			tw.mu.Lock()
-			defer tw.mu.Unlock()
-			switch err := ctx.Err(); err {
-			case context.DeadlineExceeded:
-				tw.err = http.ErrHandlerTimeout
-			default:
-				tw.err = err
-			}
-			_ = w.SetReadDeadline(time.Now())
-			t.cfg.resp(c)
+			tw.err = &WriteAfterTimeoutError{Err: http.ErrHandlerTimeout}
+			tw.release()
+			tw.mu.Unlock()
+			t.cfg.logger.Warn("foxtimeout: response handler exceeded its time limit", slog.Duration("limit", t.cfg.respTimeout))
+			otherwise(c)
 		}
-		// Don't forget to release the buffer
-		bufp.Put(buf)
 	}
 }
 
-func (t *Timeout) resolveContext(c fox.Context) (ctx context.Context, cancel context.CancelFunc) {
-	dt, ok := t.cfg.resolver.Resolve(c)
-	if ok {
-		return context.WithTimeout(c.Request().Context(), dt)
+// Source identifies which policy decided the timeout duration of a request.
+type Source uint8
+
+const (
+	// SourceDefault is the default timeout of the middleware.
+	SourceDefault Source = iota
+	// SourceRoute is a timeout set on the route with [After].
+	SourceRoute
+	// SourceResolver is a timeout returned by a [Resolver].
+	SourceResolver
+	// SourceRequest is a timeout set in the request context with [WithRequestTimeout].
+	SourceRequest
+)
+
+// String returns the name of the source.
+func (s Source) String() string {
+	switch s {
+	case SourceDefault:
+		return "default"
+	case SourceRoute:
+		return "route"
+	case SourceResolver:
+		return "resolver"
+	case SourceRequest:
+		return "request"
+	default:
+		return "unknown"
 	}
-	return context.WithTimeout(c.Request().Context(), t.dt)
 }
 
-func checkWriteHeaderCode(code int) {
-	if code < 100 || code > 999 {
-		panic(fmt.Sprintf("invalid status code %d", code))
+func (t *Timeout) resolve(c fox.Context, def time.Duration, route routePolicy) (time.Duration, Source) {
+	dt, src := def, SourceDefault
+	for _, s := range t.cfg.precedence {
+		if d, ok := t.lookup(c, s, route); ok {
+			dt, src = d, s
+			break
+		}
+	}
+
+	if t.slo != nil {
+		dt = t.slo.scale(dt, time.Now())
+	}
+	if t.cfg.hints != nil {
+		dt = t.cfg.hints.adapt(dt, c.Request())
+	}
+	if t.cfg.penalty != nil {
+		dt = t.cfg.penalty.scale(c, dt)
+	}
+	if f := jitterFraction(c, t.cfg.jitter); f > 0 {
+		dt += time.Duration((2*rand.Float64() - 1) * f * float64(dt))
+	}
+	if t.cfg.clamp > 0 {
+		dt = min(dt, t.cfg.clamp)
+	}
+	if factor := t.drain.Load(); factor != nil {
+		dt = time.Duration(float64(dt) * *factor)
 	}
+	return dt, src
 }
 
-func relevantCaller() runtime.Frame {
-	pc := make([]uintptr, 16)
-	n := runtime.Callers(1, pc)
-	frames := runtime.CallersFrames(pc[:n])
-	var frame runtime.Frame
-	for {
-		f, more := frames.Next()
-		if !strings.HasPrefix(f.Function, "github.com/tigerwill90/foxtimeout.") {
-			return f
-		}
-		if !more {
-			break
+// defaultPrecedence is the order in which the sources of a timeout duration are consulted, see [WithPrecedence].
+var defaultPrecedence = []Source{SourceRequest, SourceResolver, SourceRoute}
+
+// lookup returns the timeout duration supplied by the given source, if any.
+func (t *Timeout) lookup(c fox.Context, s Source, route routePolicy) (time.Duration, bool) {
+	switch s {
+	case SourceRequest:
+		return requestTimeout(c.Request().Context())
+	case SourceResolver:
+		return t.cfg.resolver.Resolve(c)
+	case SourceRoute:
+		return route.dt, route.mode == modeAfter || route.mode == modePerPart || route.mode == modeIdle
+	default:
+		return 0, false
+	}
+}
+
+// Reasons reported by the header enabled with [WithReasonHeader].
+const (
+	reasonDeadline    = "deadline"
+	reasonCanceled    = "canceled"
+	reasonRejected    = "rejected"
+	reasonAdmission   = "admission"
+	reasonMaintenance = "maintenance"
+	reasonShutdown    = "shutdown"
+	reasonRead        = "read"
+)
+
+func (t *Timeout) setReasonHeaders(h http.Header, reason string) {
+	if t.cfg.reasonHeader != "" {
+		h.Set(t.cfg.reasonHeader, reason)
+	}
+	if t.cfg.retryAfter > 0 && reason != reasonCanceled {
+		h.Set("Retry-After", strconv.FormatInt(int64((t.cfg.retryAfter+time.Second-1)/time.Second), 10))
+	}
+}
+
+// setDebugHeader sets the debug header enabled with [WithDebugHeader]. When the handler was invoked more than once,
+// the header also reports the time consumed and the budget granted to each attempt, in order
+// (e.g. "source=route; budget=200ms; attempts=initial:20ms/20ms,retry:15ms/180ms").
+func (t *Timeout) setDebugHeader(h http.Header, st *requestState, attempts []Attempt) {
+	if t.cfg.debugHeader == "" {
+		return
+	}
+	v := "source=" + st.source.String() + "; budget=" + st.budget.String()
+	if len(attempts) > 0 {
+		var sb strings.Builder
+		sb.WriteString(v)
+		sb.WriteString("; attempts=")
+		for i, a := range attempts {
+			if i > 0 {
+				sb.WriteByte(',')
+			}
+			sb.WriteString(a.Kind.String())
+			sb.WriteByte(':')
+			sb.WriteString(a.Elapsed.String())
+			sb.WriteByte('/')
+			sb.WriteString(a.Budget.String())
 		}
+		v = sb.String()
+	}
+	h.Set(t.cfg.debugHeader, v)
+}
+
+func (t *Timeout) withTimeout(parent context.Context, dt time.Duration) (context.Context, context.CancelFunc) {
+	if t.cfg.wheel != nil {
+		return t.cfg.wheel.withTimeout(parent, dt)
+	}
+	return context.WithTimeout(parent, dt)
+}
+
+func checkWriteHeaderCode(code int) {
+	if code < 100 || code > 999 {
+		panic(fmt.Sprintf("invalid status code %d", code))
 	}
-	return frame
 }
@@ -5,6 +5,8 @@
 package foxtimeout
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -13,6 +15,12 @@ import (
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -91,6 +99,323 @@ func TestMiddleware_WithPanic(t *testing.T) {
 	assert.Equal(t, fmt.Sprintf("%s\n", http.StatusText(http.StatusInternalServerError)), w.Body.String())
 }
 
+func TestMiddleware_WithPanicResponse(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	f, err := fox.New(fox.WithMiddleware(Middleware(50*time.Microsecond, WithResponse(panicResponse), WithLogger(logger))))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo", success201response)
+
+	req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, fmt.Sprintf("%s\n", http.StatusText(http.StatusServiceUnavailable)), w.Body.String())
+}
+
+func TestMiddleware_WithResponseTimeout(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	f, err := fox.New()
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/blocking", success201response, OnRoute(
+		time.Millisecond,
+		WithLogger(logger),
+		WithResponseTimeout(20*time.Millisecond),
+		WithResponse(func(c fox.Context) {
+			c.Writer().Header().Set("X-Renderer", "blocking")
+			<-block
+		}),
+	))
+	f.MustHandle(http.MethodGet, "/io", success201response, OnRoute(
+		time.Millisecond,
+		WithResponseTimeout(time.Second),
+		WithResponse(func(c fox.Context) {
+			// The renderer gets its own context, which is not canceled with the request.
+			require.NoError(t, c.Request().Context().Err())
+			c.Writer().Header().Set("X-Renderer", "io")
+			timeoutResponse(c)
+		}),
+	))
+
+	req := httptest.NewRequest(http.MethodGet, "/blocking", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Empty(t, w.Header().Get("X-Renderer"))
+	assert.Equal(t, fmt.Sprintf("%s\n", http.StatusText(http.StatusServiceUnavailable)), w.Body.String())
+
+	req = httptest.NewRequest(http.MethodGet, "/io", nil)
+	w = httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusRequestTimeout, w.Code)
+	assert.Equal(t, "io", w.Header().Get("X-Renderer"))
+	assert.Equal(t, fmt.Sprintf("%s\n", http.StatusText(http.StatusRequestTimeout)), w.Body.String())
+}
+
+func TestMiddleware_WithHeadersOnly(t *testing.T) {
+	tm := New(
+		50*time.Microsecond,
+		WithStatusCode(http.StatusGatewayTimeout),
+		WithSourceStatus(SourceRequest, http.StatusRequestTimeout),
+		WithHeadersOnly(http.Header{"Cache-Control": {"no-store"}, "X-Error-Code": {"TIMEOUT"}}),
+	)
+	f, err := fox.New(fox.WithMiddleware(tm.Timeout))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo", success201response)
+	f.MustHandle(http.MethodGet, "/route", success201response, StatusCode(http.StatusServiceUnavailable))
+
+	cases := []struct {
+		name string
+		path string
+		req  time.Duration
+		want int
+	}{
+		{name: "status code", path: "/foo", want: http.StatusGatewayTimeout},
+		{name: "source status", path: "/foo", req: 50 * time.Microsecond, want: http.StatusRequestTimeout},
+		{name: "route status", path: "/route", want: http.StatusServiceUnavailable},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			if tc.req > 0 {
+				req = req.WithContext(WithRequestTimeout(req.Context(), tc.req))
+			}
+			w := httptest.NewRecorder()
+			f.ServeHTTP(w, req)
+			assert.Equal(t, tc.want, w.Code)
+			assert.Empty(t, w.Body.String())
+			assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+			assert.Equal(t, "TIMEOUT", w.Header().Get("X-Error-Code"))
+		})
+	}
+	assert.Equal(t, "foxtimeout{default=50µs status=504 headersonly status.request=408}", tm.String())
+
+	// A custom response handler still renders its own response.
+	f, err = fox.New(fox.WithMiddleware(Middleware(50*time.Microsecond, WithResponse(timeoutResponse), WithHeadersOnly(nil))))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo", success201response)
+	req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusRequestTimeout, w.Code)
+	assert.Equal(t, fmt.Sprintf("%s\n", http.StatusText(http.StatusRequestTimeout)), w.Body.String())
+}
+
+func TestMiddleware_WithAbortOnTimeout(t *testing.T) {
+	var event *Event
+	f, err := fox.New(
+		fox.WithMiddleware(
+			fox.Recovery(),
+			Middleware(50*time.Microsecond, WithAbortOnTimeout(true), WithTimeoutHook(func(c fox.Context, e *Event) {
+				event = e
+			})),
+		),
+	)
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo", success201response)
+
+	req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	w := httptest.NewRecorder()
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		f.ServeHTTP(w, req)
+	})
+	assert.False(t, w.Flushed)
+	assert.Empty(t, w.Body.String())
+	assert.NotNil(t, event)
+}
+
+func TestMiddleware_WithCloseOnTimeout(t *testing.T) {
+	f, err := fox.New(fox.WithMiddleware(Middleware(50*time.Microsecond, WithCloseOnTimeout(true))))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo", success201response)
+
+	req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "close", w.Header().Get("Connection"))
+
+	req = httptest.NewRequest(http.MethodGet, "/foo", nil)
+	req.ProtoMajor, req.ProtoMinor, req.Proto = 2, 0, "HTTP/2.0"
+	w = httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Empty(t, w.Header().Get("Connection"))
+}
+
+func TestSetFallback(t *testing.T) {
+	f, err := fox.New(fox.WithMiddleware(Middleware(20 * time.Millisecond)))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo", func(c fox.Context) {
+		var mu sync.Mutex
+		items := []string{"a"}
+		SetFallback(c, func(c fox.Context) {
+			mu.Lock()
+			defer mu.Unlock()
+			_ = c.String(http.StatusPartialContent, "%s\n", strings.Join(items, ","))
+		})
+		mu.Lock()
+		items = append(items, "b")
+		mu.Unlock()
+		<-c.Request().Context().Done()
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "a,b\n", w.Body.String())
+}
+
+func TestSetFallback_SharedMutex(t *testing.T) {
+	f, err := fox.New(fox.WithMiddleware(Middleware(20 * time.Millisecond)))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo", func(c fox.Context) {
+		var mu sync.Mutex
+		SetFallback(c, func(c fox.Context) {
+			mu.Lock()
+			defer mu.Unlock()
+			_ = c.String(http.StatusPartialContent, "fallback\n")
+		})
+		// The handler writes while holding the mutex shared with the fallback, after the deadline fired.
+		mu.Lock()
+		defer mu.Unlock()
+		<-c.Request().Context().Done()
+		time.Sleep(10 * time.Millisecond)
+		_, _ = c.Writer().WriteString("late")
+	})
+
+	done := make(chan struct{})
+	w := httptest.NewRecorder()
+	go func() {
+		defer close(done)
+		f.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/foo", nil))
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("deadlock between the handler and the fallback")
+	}
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "fallback\n", w.Body.String())
+}
+
+func TestSetFallbackWithPanic(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	f, err := fox.New(fox.WithMiddleware(Middleware(20*time.Millisecond, WithResponse(timeoutResponse), WithLogger(logger))))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo", func(c fox.Context) {
+		SetFallback(c, func(c fox.Context) {
+			panic("test")
+		})
+		<-c.Request().Context().Done()
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusRequestTimeout, w.Code)
+}
+
+func TestMiddleware_Gateway(t *testing.T) {
+	f, err := fox.New(fox.WithMiddleware(fox.Recovery(), Middleware(20*time.Millisecond, Gateway(1500*time.Millisecond))))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/slow", func(c fox.Context) {
+		<-c.Request().Context().Done()
+	})
+	f.MustHandle(http.MethodGet, "/stream", func(c fox.Context) {
+		c.Writer().Header().Set("Content-Type", "text/event-stream")
+		_, _ = c.Writer().WriteString("data: 1\n\n")
+		require.NoError(t, c.Writer().FlushError())
+		_, _ = c.Writer().WriteString("data: 2\n\n")
+	})
+	f.MustHandle(http.MethodGet, "/stall", func(c fox.Context) {
+		_, _ = c.Writer().WriteString("data: 1\n\n")
+		<-c.Request().Context().Done()
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/slow", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+	assert.Equal(t, "deadline", w.Header().Get(DefaultReasonHeader))
+	assert.Equal(t, "2", w.Header().Get("Retry-After"))
+
+	req = httptest.NewRequest(http.MethodGet, "/stream", nil)
+	w = httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, w.Flushed)
+	assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+	assert.Equal(t, "data: 1\n\ndata: 2\n\n", w.Body.String())
+
+	req = httptest.NewRequest(http.MethodGet, "/stall", nil)
+	w = httptest.NewRecorder()
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		f.ServeHTTP(w, req)
+	})
+	assert.Equal(t, "data: 1\n\n", w.Body.String())
+}
+
+func TestMiddleware_WithRedirectOnTimeout(t *testing.T) {
+	completed := make(chan error, 1)
+	f, err := fox.New(fox.WithMiddleware(Middleware(20*time.Millisecond, WithRedirectOnTimeout(func(c fox.Context) string {
+		return "/jobs/" + c.Param("id")
+	}))))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodPost, "/jobs/{id}", func(c fox.Context) {
+		// The handler sees its budget until the redirection is sent.
+		_, ok := c.Request().Context().Deadline()
+		assert.True(t, ok)
+		assert.NoError(t, CheckRemaining(c, time.Millisecond))
+		time.Sleep(50 * time.Millisecond)
+		_, ok = c.Request().Context().Deadline()
+		assert.False(t, ok)
+		completed <- c.Request().Context().Err()
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/jobs/42", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	assert.Equal(t, "/jobs/42", w.Header().Get("Location"))
+
+	select {
+	case err := <-completed:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("handler did not complete")
+	}
+}
+
+func TestMiddleware_WithRedirectOnTimeoutNoURL(t *testing.T) {
+	canceled := make(chan error, 1)
+	f, err := fox.New(fox.WithMiddleware(Middleware(20*time.Millisecond, WithRedirectOnTimeout(func(c fox.Context) string {
+		return ""
+	}))))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodPost, "/jobs/{id}", func(c fox.Context) {
+		<-c.Request().Context().Done()
+		canceled <- c.Request().Context().Err()
+	}, StatusCode(http.StatusGatewayTimeout))
+
+	req := httptest.NewRequest(http.MethodPost, "/jobs/42", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	// The timeout response honors the status code of the route.
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+	assert.Empty(t, w.Header().Get("Location"))
+
+	select {
+	case err := <-canceled:
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	case <-time.After(time.Second):
+		t.Fatal("handler context was not canceled")
+	}
+}
+
 func TestMiddleware_NoTimeout(t *testing.T) {
 	f, err := fox.New(fox.WithMiddleware(Middleware(0)))
 	require.NoError(t, err)
@@ -168,3 +493,1173 @@ func ExampleWithTimeoutResolver() {
 		c.Writer().WriteHeader(http.StatusOK)
 	}, fox.WithAnnotation(annotKey, 12*time.Second))
 }
+
+type chanProvider struct {
+	initial Policy
+	updates chan Policy
+}
+
+func (p chanProvider) Get(_ context.Context) (Policy, error) {
+	return p.initial, nil
+}
+
+func (p chanProvider) Watch(_ context.Context) (<-chan Policy, error) {
+	return p.updates, nil
+}
+
+func TestTimeout_Sync(t *testing.T) {
+	tm := New(50 * time.Microsecond)
+	p := chanProvider{initial: Policy{Default: time.Second}, updates: make(chan Policy)}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- tm.Sync(context.Background(), p)
+	}()
+
+	f, err := fox.New(fox.WithMiddleware(tm.Timeout))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo", success201response)
+
+	p.updates <- Policy{Default: time.Second}
+	req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	p.updates <- Policy{Default: 50 * time.Microsecond}
+	p.updates <- Policy{Default: 50 * time.Microsecond}
+	req = httptest.NewRequest(http.MethodGet, "/foo", nil)
+	w = httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	close(p.updates)
+	assert.NoError(t, <-errCh)
+}
+
+func TestTimeout_SetMaintenance(t *testing.T) {
+	tm := New(time.Second)
+	f, err := fox.New(fox.WithMiddleware(tm.Timeout))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo", success201response)
+
+	tm.SetMaintenance(true, "down for maintenance")
+	req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "down for maintenance\n", w.Body.String())
+	assert.Equal(t, int64(1), tm.Stats().Rejected)
+
+	tm.SetMaintenance(false, "")
+	req = httptest.NewRequest(http.MethodGet, "/foo", nil)
+	w = httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+}
+
+func TestMiddleware_WithRequestTimeout(t *testing.T) {
+	override := func(next fox.HandlerFunc) fox.HandlerFunc {
+		return func(c fox.Context) {
+			c.SetRequest(c.Request().WithContext(WithRequestTimeout(c.Request().Context(), time.Second)))
+			next(c)
+		}
+	}
+
+	resolver := WithTimeoutResolver(TimeoutResolverFunc(func(c fox.Context) (dt time.Duration, ok bool) {
+		return 50 * time.Microsecond, true
+	}))
+
+	f, err := fox.New(fox.WithMiddleware(override, Middleware(50*time.Microsecond, resolver)))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo", success201response)
+
+	req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, fmt.Sprintf("%s\n", http.StatusText(http.StatusCreated)), w.Body.String())
+
+	// A zero or negative timeout is ignored rather than timing out the request immediately.
+	for _, dt := range []time.Duration{0, -time.Second} {
+		_, ok := requestTimeout(WithRequestTimeout(context.Background(), dt))
+		assert.False(t, ok)
+	}
+}
+
+func TestTimeout_Stats(t *testing.T) {
+	tm := New(
+		50*time.Microsecond,
+		WithFilter(func(c fox.Context) bool {
+			return c.Path() == "/skip"
+		}),
+		WithTimeoutResolver(TimeoutResolverFunc(func(c fox.Context) (dt time.Duration, ok bool) {
+			return time.Second, c.Path() == "/bar"
+		})),
+	)
+	f, err := fox.New(fox.WithMiddleware(tm.Timeout))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo", success201response)
+	f.MustHandle(http.MethodGet, "/bar", func(c fox.Context) {
+		c.Writer().WriteHeader(http.StatusOK)
+	})
+	f.MustHandle(http.MethodGet, "/skip", success201response)
+
+	for _, path := range []string{"/foo", "/bar", "/skip"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, req)
+	}
+
+	stats := tm.Stats()
+	assert.Equal(t, int64(2), stats.Requests)
+	assert.Equal(t, int64(1), stats.Timeouts)
+	assert.Equal(t, int64(0), stats.Canceled)
+	assert.Eventually(t, func() bool {
+		return tm.Stats().Inflight == 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestMiddleware_SkipWellKnown(t *testing.T) {
+	f, err := fox.New(fox.WithMiddleware(Middleware(50*time.Microsecond, SkipWellKnown())))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/*{path}", success201response)
+
+	cases := []struct {
+		path string
+		want int
+	}{
+		{path: "/healthz", want: http.StatusCreated},
+		{path: "/readyz", want: http.StatusCreated},
+		{path: "/metrics", want: http.StatusCreated},
+		{path: "/debug/pprof/profile", want: http.StatusCreated},
+		{path: "/healthzz", want: http.StatusServiceUnavailable},
+		{path: "/api/metrics", want: http.StatusServiceUnavailable},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.path, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			w := httptest.NewRecorder()
+			f.ServeHTTP(w, req)
+			assert.Equal(t, tc.want, w.Code)
+		})
+	}
+}
+
+func TestTimeout_WrapF(t *testing.T) {
+	tm := New(20 * time.Millisecond)
+	f, err := fox.New()
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/fast", tm.WrapF(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("fast"))
+	}))
+	f.MustHandle(http.MethodGet, "/slow", tm.WrapF(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		_, _ = w.Write([]byte("slow"))
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/fast", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "fast", w.Body.String())
+
+	req = httptest.NewRequest(http.MethodGet, "/slow", nil)
+	w = httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.NotContains(t, w.Body.String(), "slow")
+}
+
+func TestMiddleware_WithAlert(t *testing.T) {
+	alerts := make(chan Alert, 1)
+	f, err := fox.New(fox.WithMiddleware(Middleware(50*time.Microsecond, WithAlert(2, func(a Alert) {
+		alerts <- a
+	}))))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo/{id}", success201response)
+
+	// Three timeouts guarantee that the threshold is reached even if requests straddle two windows.
+	for _, path := range []string{"/foo/1", "/foo/2", "/foo/3"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, req)
+	}
+
+	select {
+	case a := <-alerts:
+		assert.Equal(t, 2, a.Timeouts)
+		assert.Equal(t, map[string]int{"GET /foo/{id}": 2}, a.Routes)
+	case <-time.After(time.Second):
+		t.Fatal("alert not fired")
+	}
+}
+
+func TestMiddleware_WithSnapshot(t *testing.T) {
+	var snapshot *Snapshot
+	f, err := fox.New(fox.WithMiddleware(Middleware(10*time.Millisecond, WithSnapshot(func(c fox.Context, s *Snapshot) {
+		snapshot = s
+	}, 4, "x-foo"))))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodPost, "/foo/{id}", func(c fox.Context) {
+		_, _ = io.ReadAll(c.Request().Body)
+		<-c.Request().Context().Done()
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/foo/1?bar=baz", strings.NewReader("hello world"))
+	req.Header.Set("X-Foo", "foo")
+	req.Header.Set("X-Bar", "bar")
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+
+	require.NotNil(t, snapshot)
+	assert.Equal(t, http.MethodPost, snapshot.Method)
+	assert.Equal(t, "/foo/1?bar=baz", snapshot.RequestURI)
+	assert.Equal(t, "/foo/{id}", snapshot.Pattern)
+	assert.Equal(t, http.Header{"X-Foo": []string{"foo"}}, snapshot.Header)
+	assert.Equal(t, []byte("hell"), snapshot.Body)
+}
+
+func TestMiddleware_WithDiagnosticsSampling(t *testing.T) {
+	var (
+		snapshots int
+		events    []*Event
+	)
+	tm := New(
+		10*time.Millisecond,
+		WithSnapshot(func(c fox.Context, s *Snapshot) {
+			snapshots++
+		}, 0),
+		WithTimeoutHook(func(c fox.Context, e *Event) {
+			events = append(events, e)
+		}),
+		WithPartialResponse(5),
+		WithDiagnosticsSampling(1e-12),
+	)
+	f, err := fox.New(fox.WithMiddleware(tm.Timeout))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo", func(c fox.Context) {
+		_ = c.String(http.StatusOK, "hello world")
+		<-c.Request().Context().Done()
+	})
+
+	for range 3 {
+		req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	}
+
+	// The hook still sees every timeout, without the expensive diagnostics.
+	assert.Zero(t, snapshots)
+	require.Len(t, events, 3)
+	for _, e := range events {
+		assert.Nil(t, e.Partial)
+	}
+	assert.Equal(t, 1e-12, tm.Config().DiagnosticsSampling)
+}
+
+func TestMiddleware_WithTimeoutHook(t *testing.T) {
+	var event *Event
+	f, err := fox.New(fox.WithMiddleware(Middleware(
+		10*time.Millisecond,
+		WithTimeoutHook(func(c fox.Context, e *Event) {
+			event = e
+		}),
+		WithPartialResponse(5),
+	)))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo/{id}", func(c fox.Context) {
+		_ = c.String(http.StatusOK, "hello world")
+		<-c.Request().Context().Done()
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/foo/1", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+
+	require.NotNil(t, event)
+	assert.ErrorIs(t, event.Err, http.ErrHandlerTimeout)
+	assert.Equal(t, http.MethodGet, event.Method)
+	assert.Equal(t, "/foo/{id}", event.Pattern)
+	assert.Equal(t, http.StatusOK, event.Status)
+	assert.Equal(t, []byte("hello"), event.Partial)
+	assert.Equal(t, 10*time.Millisecond, event.Budget)
+	assert.GreaterOrEqual(t, event.Elapsed, 10*time.Millisecond)
+}
+
+func TestStartSegment(t *testing.T) {
+	var event *Event
+	f, err := fox.New(fox.WithMiddleware(Middleware(
+		20*time.Millisecond,
+		WithTimeoutHook(func(c fox.Context, e *Event) {
+			event = e
+		}),
+	)))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo", func(c fox.Context) {
+		end := StartSegment(c, "cache")
+		time.Sleep(time.Millisecond)
+		end()
+		defer StartSegment(c, "db")()
+		<-c.Request().Context().Done()
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+
+	require.NotNil(t, event)
+	require.Len(t, event.Segments, 2)
+	assert.Equal(t, "cache", event.Segments[0].Name)
+	assert.False(t, event.Segments[0].Running)
+	assert.GreaterOrEqual(t, event.Segments[0].Elapsed, time.Millisecond)
+	assert.Equal(t, "db", event.Segments[1].Name)
+	assert.True(t, event.Segments[1].Running)
+	assert.Greater(t, event.Segments[1].Elapsed, time.Duration(0))
+}
+
+func TestCheckRemaining(t *testing.T) {
+	f, err := fox.New()
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo", func(c fox.Context) {
+		assert.NoError(t, CheckRemaining(c, 500*time.Millisecond))
+		assert.ErrorIs(t, CheckRemaining(c, 2*time.Second), ErrTimeout)
+	}, fox.WithMiddleware(Middleware(time.Second)))
+	f.MustHandle(http.MethodGet, "/bar", func(c fox.Context) {
+		assert.NoError(t, CheckRemaining(c, time.Hour))
+	})
+
+	for _, path := range []string{"/foo", "/bar"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, req)
+	}
+}
+
+func TestPortion(t *testing.T) {
+	f, err := fox.New()
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo", func(c fox.Context) {
+		ctx, cancel := Portion(c, 0.6)
+		defer cancel()
+		dl, ok := ctx.Deadline()
+		require.True(t, ok)
+		assert.Equal(t, 6*time.Second, time.Until(dl).Round(time.Second))
+
+		ctx, cancel = Portion(c, 2)
+		defer cancel()
+		dl, ok = ctx.Deadline()
+		require.True(t, ok)
+		assert.Equal(t, 10*time.Second, time.Until(dl).Round(time.Second))
+	}, fox.WithMiddleware(Middleware(10*time.Second)))
+	f.MustHandle(http.MethodGet, "/bar", func(c fox.Context) {
+		ctx, cancel := Portion(c, 0.5)
+		defer cancel()
+		_, ok := ctx.Deadline()
+		assert.False(t, ok)
+	})
+
+	for _, path := range []string{"/foo", "/bar"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, req)
+	}
+}
+
+func TestEffectiveTimeout(t *testing.T) {
+	f, err := fox.New()
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo", func(c fox.Context) {
+		dt, ok := EffectiveTimeout(c)
+		assert.True(t, ok)
+		assert.Equal(t, 2*time.Second, dt)
+	}, fox.WithMiddleware(Middleware(time.Second)), After(2*time.Second))
+	f.MustHandle(http.MethodGet, "/bar", func(c fox.Context) {
+		_, ok := EffectiveTimeout(c)
+		assert.False(t, ok)
+	})
+
+	for _, path := range []string{"/foo", "/bar"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, req)
+	}
+}
+
+func TestMiddleware_WithAdmission(t *testing.T) {
+	tm := New(time.Second, WithAdmission(100*time.Millisecond, func(c fox.Context) time.Duration {
+		if c.Header("X-Queue") != "" {
+			return 950 * time.Millisecond
+		}
+		return 0
+	}))
+	f, err := fox.New(fox.WithMiddleware(tm.Timeout))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo", success201response)
+
+	req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/foo", nil)
+	req.Header.Set("X-Queue", "true")
+	w = httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, int64(1), tm.Stats().Rejected)
+	assert.Equal(t, int64(1), tm.Stats().Requests)
+}
+
+func TestMiddleware_WriteAfterTimeoutError(t *testing.T) {
+	var event *Event
+	written := make(chan error)
+	f, err := fox.New(fox.WithMiddleware(Middleware(
+		10*time.Millisecond,
+		WithTimeoutHook(func(c fox.Context, e *Event) {
+			event = e
+		}),
+	)))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo", func(c fox.Context) {
+		<-c.Request().Context().Done()
+		// Give the middleware a chance to respond first.
+		time.Sleep(5 * time.Millisecond)
+		_, err := c.Writer().Write([]byte("hello"))
+		_, _ = c.Writer().WriteString(" world")
+		written <- err
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+
+	wErr := <-written
+	var timeoutErr *WriteAfterTimeoutError
+	require.ErrorAs(t, wErr, &timeoutErr)
+	assert.ErrorIs(t, wErr, http.ErrHandlerTimeout)
+	assert.Equal(t, int64(11), timeoutErr.Dropped())
+	require.NotNil(t, event)
+	assert.Same(t, timeoutErr, event.Err)
+}
+
+func TestTimeoutWriter_Release(t *testing.T) {
+	tw := &timeoutWriter{buf: bytes.NewBuffer(make([]byte, 0, maxPooledBuffer+1))}
+	tw.err = &WriteAfterTimeoutError{Err: http.ErrHandlerTimeout}
+	tw.release()
+	assert.Nil(t, tw.buf)
+
+	// Late writes never reach the detached buffer.
+	n, err := tw.Write([]byte("hello"))
+	assert.Zero(t, n)
+	assert.ErrorIs(t, err, http.ErrHandlerTimeout)
+	assert.Equal(t, int64(5), tw.err.Dropped())
+
+	// Releasing twice is a no-op.
+	tw.release()
+}
+
+func TestTimeoutWriter_BufferedBytes(t *testing.T) {
+	f, err := fox.New(fox.WithMiddleware(Middleware(time.Second)))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo", func(c fox.Context) {
+		bw, ok := c.Writer().(BufferedWriter)
+		require.True(t, ok)
+		assert.Zero(t, bw.BufferedBytes())
+		_, _ = c.Writer().WriteString("hello")
+		assert.Equal(t, 5, bw.BufferedBytes())
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, "hello", w.Body.String())
+}
+
+func TestMiddleware_WriteAfterReturn(t *testing.T) {
+	written := make(chan error)
+	f, err := fox.New(fox.WithMiddleware(Middleware(time.Second)))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo", func(c fox.Context) {
+		w := c.Writer()
+		_, _ = w.WriteString("foo")
+		go func() {
+			time.Sleep(5 * time.Millisecond)
+			_, err := w.WriteString("bar")
+			written <- err
+		}()
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+
+	assert.ErrorIs(t, <-written, ErrWriterReleased)
+	assert.Equal(t, "foo", w.Body.String())
+}
+
+func TestTimeout_Shutdown(t *testing.T) {
+	tm := New(10*time.Millisecond, WithReasonHeader(""))
+	f, err := fox.New(fox.WithMiddleware(tm.Timeout))
+	require.NoError(t, err)
+	release := make(chan struct{})
+	f.MustHandle(http.MethodGet, "/foo", func(c fox.Context) {
+		<-release
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, tm.Shutdown(ctx), context.DeadlineExceeded)
+
+	req = httptest.NewRequest(http.MethodGet, "/foo", nil)
+	w = httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "shutdown", w.Header().Get(DefaultReasonHeader))
+	assert.Equal(t, "close", w.Header().Get("Connection"))
+
+	close(release)
+	assert.NoError(t, tm.Shutdown(context.Background()))
+	assert.Zero(t, tm.Stats().Inflight)
+}
+
+func TestDetach(t *testing.T) {
+	type userKey struct{}
+	tm := New(10 * time.Millisecond)
+	f, err := fox.New(fox.WithMiddleware(tm.Timeout))
+	require.NoError(t, err)
+	release := make(chan struct{})
+	finished := make(chan error, 1)
+	f.MustHandle(http.MethodGet, "/foo", func(c fox.Context) {
+		c.SetRequest(c.Request().WithContext(context.WithValue(c.Request().Context(), userKey{}, "john")))
+		ctx, done := Detach(c)
+		go func() {
+			defer done()
+			<-release
+			assert.Equal(t, "john", ctx.Value(userKey{}))
+			_, ok := ctx.Deadline()
+			assert.False(t, ok)
+			finished <- ctx.Err()
+		}()
+		_ = c.String(http.StatusOK, "ok")
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, int64(1), tm.Stats().Detached)
+
+	// The detached task outlives both the request and its deadline, and holds the shutdown.
+	time.Sleep(20 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, tm.Shutdown(ctx), context.DeadlineExceeded)
+
+	close(release)
+	assert.NoError(t, <-finished)
+	assert.NoError(t, tm.Shutdown(context.Background()))
+	assert.Zero(t, tm.Stats().Detached)
+
+	// Without the middleware, the context is still detached but not tracked.
+	f, err = fox.New()
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo", func(c fox.Context) {
+		ctx, done := Detach(c)
+		defer done()
+		assert.NotNil(t, ctx)
+	})
+	f.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/foo", nil))
+	assert.Zero(t, tm.Stats().Detached)
+}
+
+func TestTimeout_Drain(t *testing.T) {
+	tm := New(10 * time.Second)
+	f, err := fox.New(fox.WithMiddleware(tm.Timeout))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo", func(c fox.Context) {
+		dl, ok := c.Request().Context().Deadline()
+		require.True(t, ok)
+		_ = c.String(http.StatusOK, "%s", time.Until(dl).Round(time.Second))
+	})
+
+	tm.Drain(0.5)
+	assert.Equal(t, 0.5, tm.Config().DrainFactor)
+	req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, "5s", w.Body.String())
+
+	tm.Drain(1)
+	assert.Zero(t, tm.Config().DrainFactor)
+	req = httptest.NewRequest(http.MethodGet, "/foo", nil)
+	w = httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, "10s", w.Body.String())
+}
+
+func TestTimeout_DisableRoute(t *testing.T) {
+	tm := New(50 * time.Microsecond)
+	f, err := fox.New(fox.WithMiddleware(tm.Timeout))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo", success201response)
+	f.MustHandle(http.MethodPost, "/foo", success201response)
+	f.MustHandle(http.MethodGet, "/bar", success201response)
+
+	serve := func(method, path string) int {
+		req := httptest.NewRequest(method, path, nil)
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	tm.DisableRoute("/foo")
+	tm.DisableRoute("/baz")
+	assert.Equal(t, []string{"/baz", "/foo"}, tm.Config().DisabledRoutes)
+	assert.Equal(t, http.StatusCreated, serve(http.MethodGet, "/foo"))
+	assert.Equal(t, http.StatusCreated, serve(http.MethodPost, "/foo"))
+	assert.Equal(t, http.StatusServiceUnavailable, serve(http.MethodGet, "/bar"))
+
+	tm.EnableRoute("/foo")
+	tm.EnableRoute("/baz")
+	assert.Empty(t, tm.Config().DisabledRoutes)
+	assert.Equal(t, http.StatusServiceUnavailable, serve(http.MethodGet, "/foo"))
+}
+
+type auditWriter struct {
+	*Writer
+	code int
+	body bytes.Buffer
+}
+
+func TestMiddleware_WithWriter(t *testing.T) {
+	audits := make(chan *auditWriter, 1)
+	tm := New(time.Second, WithWriter(func(w *Writer) fox.ResponseWriter {
+		aw := &auditWriter{Writer: w}
+		w.OnWriteHeader(func(code int) { aw.code = code })
+		w.OnWrite(func(p []byte) { aw.body.Write(p) })
+		audits <- aw
+		return aw
+	}))
+	f, err := fox.New(fox.WithMiddleware(tm.Timeout))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo", func(c fox.Context) {
+		_, ok := c.Writer().(*auditWriter)
+		assert.True(t, ok)
+		_, _ = c.Writer().WriteString("foo")
+		_, _ = c.Writer().ReadFrom(strings.NewReader("bar"))
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, "foobar", w.Body.String())
+	aw := <-audits
+	assert.Equal(t, http.StatusOK, aw.code)
+	assert.Equal(t, "foobar", aw.body.String())
+	assert.Equal(t, "foxtimeout{default=1s writer}", tm.String())
+}
+
+func TestMiddleware_WithBeforeFlush(t *testing.T) {
+	tm := New(time.Second, WithBeforeFlush(func(c fox.Context, r *Response) {
+		r.Header.Set("X-Signature", fmt.Sprintf("%x", len(r.Body)))
+		r.Body = bytes.ToUpper(r.Body)
+		r.StatusCode = http.StatusAccepted
+	}))
+	f, err := fox.New(fox.WithMiddleware(tm.Timeout))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo", func(c fox.Context) {
+		_ = c.String(http.StatusOK, "foobar")
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Equal(t, "FOOBAR", w.Body.String())
+	assert.Equal(t, "6", w.Header().Get("X-Signature"))
+	assert.Equal(t, "foxtimeout{default=1s flush}", tm.String())
+
+	_, err = NewStrict(time.Second, WithBeforeFlush(nil))
+	assert.Error(t, err)
+}
+
+func TestMiddleware_WithHeaderLimit(t *testing.T) {
+	tm := New(time.Second, WithHeaderLimit(4, 64))
+	f, err := fox.New(fox.WithMiddleware(tm.Timeout))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/count", func(c fox.Context) {
+		for i := range 5 {
+			c.Writer().Header().Add("X-Trace", strconv.Itoa(i))
+		}
+		_, err := c.Writer().WriteString("hello")
+		var herr *HeaderLimitError
+		require.ErrorAs(t, err, &herr)
+		assert.Equal(t, 5, herr.Count)
+		assert.Equal(t, 4, herr.MaxCount)
+	})
+	f.MustHandle(http.MethodGet, "/size", func(c fox.Context) {
+		c.Writer().Header().Set("X-Large", strings.Repeat("a", 64))
+		c.Writer().WriteHeader(http.StatusOK)
+	})
+	f.MustHandle(http.MethodGet, "/ok", func(c fox.Context) {
+		c.Writer().Header().Set("X-Small", "a")
+		_ = c.String(http.StatusOK, "hello")
+	})
+
+	cases := []struct {
+		path string
+		want int
+	}{
+		{path: "/count", want: http.StatusInternalServerError},
+		{path: "/size", want: http.StatusInternalServerError},
+		{path: "/ok", want: http.StatusOK},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.path, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			w := httptest.NewRecorder()
+			f.ServeHTTP(w, req)
+			assert.Equal(t, tc.want, w.Code)
+			if tc.want != http.StatusOK {
+				assert.Empty(t, w.Body.String())
+				assert.Empty(t, w.Header().Get("X-Trace"))
+				assert.Empty(t, w.Header().Get("X-Large"))
+			}
+		})
+	}
+	assert.Equal(t, "foxtimeout{default=1s headers=4 headers.size=64}", tm.String())
+}
+
+func TestMiddleware_WithStripHopByHop(t *testing.T) {
+	for _, stream := range []bool{false, true} {
+		t.Run(fmt.Sprintf("stream=%t", stream), func(t *testing.T) {
+			tm := New(time.Second, WithStripHopByHop(true), WithStreaming(stream))
+			f, err := fox.New(fox.WithMiddleware(tm.Timeout))
+			require.NoError(t, err)
+			f.MustHandle(http.MethodGet, "/foo", func(c fox.Context) {
+				h := c.Writer().Header()
+				h.Set("Connection", "keep-alive, X-Private")
+				h.Set("Keep-Alive", "timeout=5")
+				h.Set("Transfer-Encoding", "chunked")
+				h.Set("X-Private", "secret")
+				h.Set("X-Public", "public")
+				_ = c.String(http.StatusOK, "hello")
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+			w := httptest.NewRecorder()
+			f.ServeHTTP(w, req)
+			assert.Equal(t, "hello", w.Body.String())
+			for _, k := range []string{"Connection", "Keep-Alive", "Transfer-Encoding", "X-Private"} {
+				assert.Empty(t, w.Header().Get(k), k)
+			}
+			assert.Equal(t, "public", w.Header().Get("X-Public"))
+		})
+	}
+}
+
+func TestMiddleware_WithStripHopByHopDisabled(t *testing.T) {
+	f, err := fox.New(fox.WithMiddleware(Middleware(time.Second, WithStripHopByHop(false))))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo", func(c fox.Context) {
+		h := c.Writer().Header()
+		h.Set("Connection", "X-Private")
+		h.Set("X-Private", "secret")
+		_ = c.String(http.StatusOK, "hello")
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, "X-Private", w.Header().Get("Connection"))
+	assert.Equal(t, "secret", w.Header().Get("X-Private"))
+}
+
+func TestTimeoutWriter_Presize(t *testing.T) {
+	tw := &timeoutWriter{headers: make(http.Header), buf: new(bytes.Buffer)}
+	tw.headers.Set("Content-Length", "100000")
+	tw.WriteHeader(http.StatusOK)
+	assert.GreaterOrEqual(t, tw.buf.Cap(), 100000)
+
+	tw = &timeoutWriter{headers: make(http.Header), buf: new(bytes.Buffer)}
+	tw.headers.Set("Content-Length", strconv.Itoa(maxPresizedBuffer*2))
+	tw.WriteHeader(http.StatusOK)
+	assert.Less(t, tw.buf.Cap(), maxPresizedBuffer*2)
+}
+
+func TestMiddleware_WithStrictWriteHeader(t *testing.T) {
+	warned := make(chan *Event, 1)
+	tm := New(time.Second, WithStrictWriteHeader(true), WithWarnHook(func(c fox.Context, e *Event) {
+		// The hook is called without the writer lock held.
+		assert.Equal(t, http.StatusOK, c.Writer().Status())
+		warned <- e
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := tm.Watch(ctx)
+	f, err := fox.New(fox.WithMiddleware(tm.Timeout))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo", func(c fox.Context) {
+		c.Writer().WriteHeader(http.StatusOK)
+		err := c.String(http.StatusInternalServerError, "hello")
+		var werr *SuperfluousWriteHeaderError
+		require.ErrorAs(t, err, &werr)
+		assert.Equal(t, http.StatusInternalServerError, werr.Code)
+		assert.Equal(t, http.StatusOK, werr.Status)
+		// The caller is the handler, not the helper of fox.
+		assert.Contains(t, werr.Function, "TestMiddleware_WithStrictWriteHeader")
+		assert.Contains(t, werr.File, "timeout_test.go")
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	e := <-warned
+	assert.Equal(t, EventSuperfluousWriteHeader, e.Kind)
+	assert.Equal(t, "/foo", e.Pattern)
+	assert.Equal(t, EventSuperfluousWriteHeader, (<-events).Kind)
+}
+
+func TestMiddleware_WithStrictWriteHeaderDisabled(t *testing.T) {
+	f, err := fox.New(fox.WithMiddleware(Middleware(time.Second, WithStrictWriteHeader(false))))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo", func(c fox.Context) {
+		c.Writer().WriteHeader(http.StatusOK)
+		c.Writer().WriteHeader(http.StatusInternalServerError)
+		_, err := c.Writer().WriteString("hello")
+		assert.NoError(t, err)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "hello", w.Body.String())
+}
+
+func TestMiddleware_WithInterimResponses(t *testing.T) {
+	f, err := fox.New(fox.WithMiddleware(Middleware(time.Second, WithInterimResponses(10*time.Millisecond, 0))))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo", func(c fox.Context) {
+		time.Sleep(55 * time.Millisecond)
+		_ = c.String(http.StatusOK, "done")
+	})
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	var interim atomic.Int32
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			if code == http.StatusProcessing {
+				interim.Add(1)
+			}
+			return nil
+		},
+	}
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), http.MethodGet, srv.URL+"/foo", nil)
+	require.NoError(t, err)
+	resp, err := srv.Client().Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "done", string(body))
+	assert.GreaterOrEqual(t, interim.Load(), int32(3))
+
+	_, err = NewStrict(time.Second, WithInterimResponses(time.Second, http.StatusSwitchingProtocols))
+	assert.Error(t, err)
+}
+
+func TestMiddleware_WithSourceStatus(t *testing.T) {
+	tm := New(50*time.Microsecond, WithSourceStatus(SourceRequest, http.StatusRequestTimeout), WithStatusCode(http.StatusGatewayTimeout))
+	stamp := func(next fox.HandlerFunc) fox.HandlerFunc {
+		return func(c fox.Context) {
+			if c.Request().Header.Get("Request-Timeout") != "" {
+				c.SetRequest(c.Request().WithContext(WithRequestTimeout(c.Request().Context(), 50*time.Microsecond)))
+			}
+			next(c)
+		}
+	}
+	f, err := fox.New(fox.WithMiddleware(stamp, tm.Timeout))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo", success201response)
+
+	req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	req.Header.Set("Request-Timeout", "50us")
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusRequestTimeout, w.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/foo", nil)
+	w = httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+	assert.Equal(t, "foxtimeout{default=50µs status=504 status.request=408}", tm.String())
+}
+
+func TestMiddleware_WithClamp(t *testing.T) {
+	cases := []struct {
+		name string
+		opt  Option
+		want string
+	}{
+		{name: "clamp", opt: WithClamp(10 * time.Second), want: "10s"},
+		{name: "cloudflare", opt: BehindCloudflare(0), want: "1m39s"},
+		{name: "alb", opt: BehindALB(0), want: "59s"},
+		{name: "cloudfront", opt: BehindCloudFront(0), want: "29s"},
+		{name: "disabled", opt: WithClamp(0), want: "2m0s"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := fox.New(fox.WithMiddleware(Middleware(time.Second, tc.opt)))
+			require.NoError(t, err)
+			f.MustHandle(http.MethodGet, "/foo", func(c fox.Context) {
+				dt, _ := EffectiveTimeout(c)
+				_ = c.String(http.StatusOK, "%s", dt)
+			}, After(2*time.Minute))
+
+			req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+			w := httptest.NewRecorder()
+			f.ServeHTTP(w, req)
+			assert.Equal(t, tc.want, w.Body.String())
+		})
+	}
+}
+
+type slowReader struct {
+	delay time.Duration
+	r     io.Reader
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(r.delay)
+	return r.r.Read(p[:min(len(p), 1)])
+}
+
+func TestMiddleware_WithPhases(t *testing.T) {
+	tm := New(200*time.Millisecond, WithPhases(Phases{Read: 20 * time.Millisecond, Write: time.Second}), WithReasonHeader(""))
+	f, err := fox.New(fox.WithMiddleware(tm.Timeout))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodPost, "/foo", func(c fox.Context) {
+		b, err := io.ReadAll(c.Request().Body)
+		if err != nil {
+			return
+		}
+		// The compute phase has its own budget, which is larger than the read phase.
+		time.Sleep(40 * time.Millisecond)
+		_ = c.String(http.StatusOK, "%s", b)
+	})
+	f.MustHandle(http.MethodPost, "/write", func(c fox.Context) {
+		// The read phase ends with the first write, even though the body is not read.
+		_, _ = c.Writer().WriteString("hello")
+		time.Sleep(40 * time.Millisecond)
+		_, _ = c.Writer().WriteString(" world")
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/foo", strings.NewReader("hello"))
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "hello", w.Body.String())
+
+	req = httptest.NewRequest(http.MethodPost, "/foo", &slowReader{delay: 10 * time.Millisecond, r: strings.NewReader("hello")})
+	w = httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusRequestTimeout, w.Code)
+	assert.Equal(t, reasonRead, w.Header().Get(DefaultReasonHeader))
+	assert.Equal(t, "close", w.Header().Get("Connection"))
+
+	req = httptest.NewRequest(http.MethodPost, "/write", strings.NewReader("hello"))
+	w = httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "hello world", w.Body.String())
+	assert.Equal(t, "foxtimeout{default=200ms read=20ms write=1s reason=X-Timeout-Reason}", tm.String())
+}
+
+// deadlineRecorder is a [httptest.ResponseRecorder] recording the write deadlines set through
+// [http.ResponseController].
+type deadlineRecorder struct {
+	*httptest.ResponseRecorder
+	deadlines []time.Time
+}
+
+func (r *deadlineRecorder) SetWriteDeadline(deadline time.Time) error {
+	r.deadlines = append(r.deadlines, deadline)
+	return nil
+}
+
+func TestMiddleware_WithErrorWriteTimeout(t *testing.T) {
+	f, err := fox.New()
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/default", success201response, OnRoute(time.Millisecond))
+	f.MustHandle(http.MethodGet, "/custom", success201response, OnRoute(time.Millisecond, WithErrorWriteTimeout(time.Minute)))
+	f.MustHandle(http.MethodGet, "/disabled", success201response, OnRoute(time.Millisecond, WithErrorWriteTimeout(0)))
+
+	cases := []struct {
+		path string
+		want time.Duration
+	}{
+		{path: "/default", want: DefaultErrorWriteTimeout},
+		{path: "/custom", want: time.Minute},
+		{path: "/disabled"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.path, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			w := &deadlineRecorder{ResponseRecorder: httptest.NewRecorder()}
+			start := time.Now()
+			f.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+			if tc.want == 0 {
+				assert.Empty(t, w.deadlines)
+				return
+			}
+			// The deadline is cleared once the timeout response is sent.
+			require.Len(t, w.deadlines, 2)
+			assert.WithinRange(t, w.deadlines[0], start.Add(tc.want), time.Now().Add(tc.want))
+			assert.True(t, w.deadlines[1].IsZero())
+		})
+	}
+	assert.Equal(t, "foxtimeout{default=1s errwrite=1m0s}", New(time.Second, WithErrorWriteTimeout(time.Minute)).String())
+}
+
+func TestMiddleware_WithStrictLateWrites(t *testing.T) {
+	t.Run("log", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		done := make(chan struct{})
+		sent := make(chan struct{})
+		f, err := fox.New(fox.WithMiddleware(Middleware(
+			time.Millisecond,
+			WithStrictLateWrites(false),
+			WithLogger(slog.New(slog.NewTextHandler(buf, nil))),
+		)))
+		require.NoError(t, err)
+		f.MustHandle(http.MethodGet, "/foo", func(c fox.Context) {
+			defer close(done)
+			<-sent
+			_ = c.String(http.StatusOK, "foo")
+			_, err := c.Writer().WriteString("bar")
+			assert.ErrorIs(t, err, http.ErrHandlerTimeout)
+		})
+
+		req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, req)
+		close(sent)
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		<-done
+		assert.Equal(t, 1, strings.Count(buf.String(), "write after timeout"))
+		assert.Contains(t, buf.String(), "route=/foo")
+		// The caller is the handler, not the helper of fox.
+		assert.Contains(t, buf.String(), "timeout_test.go")
+	})
+
+	t.Run("panic", func(t *testing.T) {
+		recovered := make(chan any)
+		sent := make(chan struct{})
+		tm := New(time.Millisecond, WithStrictLateWrites(true))
+		f, err := fox.New(fox.WithMiddleware(tm.Timeout))
+		require.NoError(t, err)
+		f.MustHandle(http.MethodGet, "/foo", func(c fox.Context) {
+			defer func() {
+				recovered <- recover()
+			}()
+			<-sent
+			_, _ = c.Writer().WriteString("foo")
+		})
+
+		req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, req)
+		close(sent)
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		p := <-recovered
+		assert.IsType(t, &WriteAfterTimeoutError{}, p)
+		assert.Equal(t, "foxtimeout{default=1ms late=panic}", tm.String())
+	})
+
+	t.Run("retry", func(t *testing.T) {
+		var calls atomic.Int32
+		done := make(chan error, 1)
+		f, err := fox.New(fox.WithMiddleware(Middleware(time.Second, WithStrictLateWrites(true))))
+		require.NoError(t, err)
+		f.MustHandle(http.MethodGet, "/foo", func(c fox.Context) {
+			if calls.Add(1) == 1 {
+				// The writes of the attempt superseded by the retry neither panic nor crash the program.
+				<-c.Request().Context().Done()
+				// Give the middleware a chance to abandon the attempt first.
+				time.Sleep(10 * time.Millisecond)
+				_, err := c.Writer().WriteString("first")
+				done <- err
+				return
+			}
+			_ = c.String(http.StatusOK, "retry")
+		}, Retry(20*time.Millisecond))
+
+		req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "retry", w.Body.String())
+		assert.ErrorIs(t, <-done, http.ErrHandlerTimeout)
+	})
+}
+
+func TestMiddleware_WithDebug(t *testing.T) {
+	buf := new(bytes.Buffer)
+	tm := New(
+		50*time.Millisecond,
+		WithDebug(true),
+		WithFilter(func(c fox.Context) bool {
+			return c.Path() == "/health"
+		}),
+		WithLogger(slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug}))),
+	)
+	f, err := fox.New(fox.WithMiddleware(tm.Timeout))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/health", success201response)
+	f.MustHandle(http.MethodGet, "/foo", success201response, After(time.Second))
+	f.MustHandle(http.MethodGet, "/bar", func(c fox.Context) {
+		<-c.Request().Context().Done()
+	})
+
+	cases := []struct {
+		path string
+		want []string
+	}{
+		{path: "/health", want: []string{"route=/health", "outcome=filtered", "filters=1"}},
+		{path: "/foo", want: []string{"route=/foo", "outcome=completed", "filters=1", "budget=1s", "source=route"}},
+		{path: "/bar", want: []string{"route=/bar", "outcome=timeout", "budget=50ms", "source=default"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.path, func(t *testing.T) {
+			buf.Reset()
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			w := httptest.NewRecorder()
+			f.ServeHTTP(w, req)
+			for _, want := range tc.want {
+				assert.Contains(t, buf.String(), want)
+			}
+			assert.Contains(t, buf.String(), "elapsed=")
+		})
+	}
+	assert.Equal(t, "foxtimeout{default=50ms filters=1 verbose}", tm.String())
+}
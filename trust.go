@@ -0,0 +1,59 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/tigerwill90/fox"
+	"net/netip"
+	"slices"
+)
+
+// TrustPolicy reports whether the budget provided by the client with a header, whose raw value is given, can be
+// trusted, see [HeaderOptions]. Without a trust policy, arbitrary internet clients can inflate their own budgets and
+// hold server resources for as long as they want.
+type TrustPolicy func(c fox.Context, value string) bool
+
+// TrustedProxies returns a [TrustPolicy] that trusts the budgets of requests whose remote address, i.e. the address of
+// the peer connected to the server, belongs to one of the given prefixes (e.g. the range of an internal load
+// balancer). The client IP forwarded by proxies is deliberately not used, since clients can forge it.
+func TrustedProxies(prefixes ...netip.Prefix) TrustPolicy {
+	prefixes = slices.Clone(prefixes)
+	return func(c fox.Context, _ string) bool {
+		ip := c.RemoteIP()
+		if ip == nil {
+			return false
+		}
+		addr, ok := netip.AddrFromSlice(ip.IP)
+		if !ok {
+			return false
+		}
+		addr = addr.Unmap()
+		for _, p := range prefixes {
+			if p.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// SignedHeader returns a [TrustPolicy] that trusts the budgets signed by an upstream holding the shared key: the
+// header with the given name must carry the hex-encoded HMAC-SHA256 of the raw budget value. The signature only
+// covers the value, so a signed budget can be replayed by the client on other requests, but never inflated.
+func SignedHeader(name string, key []byte) TrustPolicy {
+	key = slices.Clone(key)
+	return func(c fox.Context, value string) bool {
+		sig, err := hex.DecodeString(c.Request().Header.Get(name))
+		if err != nil || len(sig) != sha256.Size {
+			return false
+		}
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(value))
+		return hmac.Equal(sig, mac.Sum(nil))
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"context"
+	"slices"
+	"sync"
+)
+
+// watchBuffer is the capacity of the channels returned by [Timeout.Watch].
+const watchBuffer = 64
+
+// Watch returns a channel streaming the timeout, cancellation and late completion events of the middleware, until ctx
+// is done, at which point the channel is closed. This allows applications to build their own pipelines (e.g. to Kafka
+// or audit logs) without the package choosing an exporter for them. Events are delivered without blocking requests:
+// if the receiver falls behind and the buffer of the channel is full, events are dropped. The slices of an event are
+// shared between receivers and with the timeout hook, and must not be modified. This function is safe for concurrent
+// use.
+func (t *Timeout) Watch(ctx context.Context) <-chan Event {
+	ch := make(chan Event, watchBuffer)
+	t.watchers.add(ch)
+	context.AfterFunc(ctx, func() {
+		t.watchers.remove(ch)
+	})
+	return ch
+}
+
+// watchers is the set of channels returned by [Timeout.Watch]. The zero value is ready to use.
+type watchers struct {
+	chans []chan Event
+	mu    sync.RWMutex
+}
+
+func (w *watchers) add(ch chan Event) {
+	w.mu.Lock()
+	w.chans = append(w.chans, ch)
+	w.mu.Unlock()
+}
+
+// remove unregisters ch and closes it. The channel is never closed during a publication, which holds the read lock.
+func (w *watchers) remove(ch chan Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.chans = slices.DeleteFunc(w.chans, func(c chan Event) bool { return c == ch })
+	close(ch)
+}
+
+// active reports whether there is at least one watcher, so that events are only built when needed.
+func (w *watchers) active() bool {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return len(w.chans) > 0
+}
+
+func (w *watchers) publish(e *Event) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	for _, ch := range w.chans {
+		select {
+		case ch <- *e:
+		default:
+		}
+	}
+}
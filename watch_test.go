@@ -0,0 +1,57 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tigerwill90/fox"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTimeout_Watch(t *testing.T) {
+	tm := New(10 * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	events := tm.Watch(ctx)
+
+	f, err := fox.New()
+	require.NoError(t, err)
+	served := make(chan struct{})
+	f.MustHandle(http.MethodGet, "/foo/{id}", func(c fox.Context) {
+		<-served
+		_, _ = c.Writer().Write([]byte("late"))
+	}, fox.WithMiddleware(tm.Timeout))
+
+	req := httptest.NewRequest(http.MethodGet, "/foo/1", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	close(served)
+
+	e := <-events
+	assert.Equal(t, EventTimeout, e.Kind)
+	assert.Equal(t, "/foo/{id}", e.Pattern)
+	assert.Equal(t, 10*time.Millisecond, e.Budget)
+
+	e = <-events
+	assert.Equal(t, EventLateCompletion, e.Kind)
+	assert.Equal(t, "/foo/{id}", e.Pattern)
+	assert.ErrorIs(t, e.Err, http.ErrHandlerTimeout)
+	var werr *WriteAfterTimeoutError
+	require.ErrorAs(t, e.Err, &werr)
+	assert.Equal(t, int64(4), werr.Dropped())
+
+	cancel()
+	select {
+	case _, ok := <-events:
+		assert.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("the channel was not closed")
+	}
+}
@@ -0,0 +1,237 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultWheelTick  = 10 * time.Millisecond
+	defaultWheelSlots = 512
+)
+
+// timerWheel is a hashed timing wheel shared by all requests handled by a middleware instance. Instead of arming
+// one runtime timer per request, deadlines are hashed into slots that are scanned by a single ticker goroutine,
+// which reduces the timer heap pressure at very high request rates. Deadlines are fired with a precision of one tick.
+type timerWheel struct {
+	slots   []wheelSlot
+	tick    time.Duration
+	cursor  atomic.Uint64
+	pending atomic.Int64
+	mu      sync.Mutex
+	running bool
+}
+
+type wheelSlot struct {
+	timers []*wheelTimer
+	mu     sync.Mutex
+}
+
+type wheelTimer struct {
+	fn      func()
+	rounds  uint64
+	stopped atomic.Bool
+}
+
+func newTimerWheel(tick time.Duration, slots int) *timerWheel {
+	if tick <= 0 {
+		tick = defaultWheelTick
+	}
+	if slots <= 0 {
+		slots = defaultWheelSlots
+	}
+	return &timerWheel{
+		tick:  tick,
+		slots: make([]wheelSlot, slots),
+	}
+}
+
+// schedule arranges to call fn in the ticker goroutine once d has elapsed. The returned timer can be stopped.
+func (w *timerWheel) schedule(d time.Duration, fn func()) *wheelTimer {
+	ticks := uint64(max((d+w.tick-1)/w.tick, 1))
+	n := uint64(len(w.slots))
+	t := &wheelTimer{
+		fn:     fn,
+		rounds: (ticks - 1) / n,
+	}
+
+	// The slot is locked before the cursor is checked again: advance moves the cursor while holding the lock of the
+	// slot it drains, so the timer can't land in a slot that was drained behind our back and wait a full rotation.
+	for {
+		cursor := w.cursor.Load()
+		slot := &w.slots[(cursor+ticks)%n]
+		slot.mu.Lock()
+		if w.cursor.Load() == cursor {
+			slot.timers = append(slot.timers, t)
+			slot.mu.Unlock()
+			break
+		}
+		slot.mu.Unlock()
+	}
+
+	w.pending.Add(1)
+	w.mu.Lock()
+	if !w.running {
+		w.running = true
+		go w.run()
+	}
+	w.mu.Unlock()
+	return t
+}
+
+func (w *timerWheel) run() {
+	ticker := time.NewTicker(w.tick)
+	defer ticker.Stop()
+	for range ticker.C {
+		w.advance()
+
+		w.mu.Lock()
+		if w.pending.Load() == 0 {
+			w.running = false
+			w.mu.Unlock()
+			return
+		}
+		w.mu.Unlock()
+	}
+}
+
+func (w *timerWheel) advance() {
+	// Only the ticker goroutine advances the cursor.
+	next := w.cursor.Load() + 1
+	slot := &w.slots[next%uint64(len(w.slots))]
+	slot.mu.Lock()
+	w.cursor.Store(next)
+	kept := slot.timers[:0]
+	var expired []*wheelTimer
+	for _, t := range slot.timers {
+		switch {
+		case t.stopped.Load():
+			w.pending.Add(-1)
+		case t.rounds > 0:
+			t.rounds--
+			kept = append(kept, t)
+		default:
+			w.pending.Add(-1)
+			expired = append(expired, t)
+		}
+	}
+	clear(slot.timers[len(kept):])
+	slot.timers = kept
+	slot.mu.Unlock()
+
+	for _, t := range expired {
+		if t.stopped.CompareAndSwap(false, true) {
+			t.fn()
+		}
+	}
+}
+
+// stop prevents the timer from firing. It returns false if the timer has already fired or been stopped.
+func (t *wheelTimer) stop() bool {
+	return t.stopped.CompareAndSwap(false, true)
+}
+
+// withTimeout is the equivalent of [context.WithTimeout] backed by the timing wheel.
+func (w *timerWheel) withTimeout(parent context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	deadline := time.Now().Add(d)
+	if cur, ok := parent.Deadline(); ok && cur.Before(deadline) {
+		// The current deadline is already sooner than the new one.
+		return context.WithCancel(parent)
+	}
+
+	c := &wheelContext{
+		Context:  parent,
+		deadline: deadline,
+		done:     make(chan struct{}),
+	}
+	// Neither callback runs synchronously, and both wait for the setup to complete before canceling.
+	c.mu.Lock()
+	c.stopParent = context.AfterFunc(parent, func() {
+		c.cancel(parent.Err())
+	})
+	c.timer = w.schedule(d, func() {
+		c.cancel(context.DeadlineExceeded)
+	})
+	c.mu.Unlock()
+
+	return c, func() {
+		c.cancel(context.Canceled)
+	}
+}
+
+// wheelContext is a context whose deadline is managed by a timerWheel. It implements the AfterFunc method recognized
+// by the context package, so that contexts derived from it are canceled without spawning a goroutine each.
+type wheelContext struct {
+	context.Context
+	deadline   time.Time
+	err        error
+	done       chan struct{}
+	timer      *wheelTimer
+	stopParent func() bool
+	afterFuncs map[*struct{ fn func() }]struct{}
+	mu         sync.Mutex
+}
+
+func (c *wheelContext) Deadline() (time.Time, bool) {
+	return c.deadline, true
+}
+
+func (c *wheelContext) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *wheelContext) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// AfterFunc arranges to call fn in its own goroutine after c is done, see [context.AfterFunc].
+func (c *wheelContext) AfterFunc(fn func()) (stop func() bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		go fn()
+		return func() bool { return false }
+	}
+	if c.afterFuncs == nil {
+		c.afterFuncs = make(map[*struct{ fn func() }]struct{})
+	}
+	key := &struct{ fn func() }{fn: fn}
+	c.afterFuncs[key] = struct{}{}
+	return func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if _, ok := c.afterFuncs[key]; !ok {
+			return false
+		}
+		delete(c.afterFuncs, key)
+		return true
+	}
+}
+
+func (c *wheelContext) cancel(err error) {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return
+	}
+	c.err = err
+	close(c.done)
+	fns := c.afterFuncs
+	c.afterFuncs = nil
+	timer, stopParent := c.timer, c.stopParent
+	c.mu.Unlock()
+
+	timer.stop()
+	stopParent()
+	for key := range fns {
+		go key.fn()
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2023 Sylvain Müller. All rights reserved.
+// Mount of this source code is governed by a MIT license that can be found
+// at https://github.com/tigerwill90/foxtimeout/blob/master/LICENSE.txt.
+
+package foxtimeout
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tigerwill90/fox"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTimerWheel_WithTimeout(t *testing.T) {
+	w := newTimerWheel(time.Millisecond, 8)
+
+	t.Run("deadline exceeded", func(t *testing.T) {
+		ctx, cancel := w.withTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		child, childCancel := context.WithCancel(ctx)
+		defer childCancel()
+
+		_, ok := ctx.Deadline()
+		assert.True(t, ok)
+
+		select {
+		case <-child.Done():
+		case <-time.After(time.Second):
+			t.Fatal("context not canceled")
+		}
+		assert.ErrorIs(t, ctx.Err(), context.DeadlineExceeded)
+		assert.ErrorIs(t, child.Err(), context.DeadlineExceeded)
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := w.withTimeout(context.Background(), time.Minute)
+		cancel()
+		<-ctx.Done()
+		assert.ErrorIs(t, ctx.Err(), context.Canceled)
+	})
+
+	t.Run("parent canceled", func(t *testing.T) {
+		parent, parentCancel := context.WithCancel(context.Background())
+		ctx, cancel := w.withTimeout(parent, time.Minute)
+		defer cancel()
+		parentCancel()
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+			t.Fatal("context not canceled")
+		}
+		assert.ErrorIs(t, ctx.Err(), context.Canceled)
+	})
+}
+
+func TestMiddleware_WithTimerWheel(t *testing.T) {
+	f, err := fox.New(fox.WithMiddleware(Middleware(time.Millisecond, WithTimerWheel(time.Millisecond, 64))))
+	require.NoError(t, err)
+	f.MustHandle(http.MethodGet, "/foo", success201response)
+
+	req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, fmt.Sprintf("%s\n", http.StatusText(http.StatusServiceUnavailable)), w.Body.String())
+}
+
+func TestTimerWheel_ScheduleConcurrentAdvance(t *testing.T) {
+	// The ticker never fires, the wheel is advanced by hand.
+	w := newTimerWheel(time.Hour, 8)
+
+	var fired atomic.Int64
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	const n = 10000
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < n; j++ {
+				w.schedule(time.Hour, func() {
+					fired.Add(1)
+				})
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	for {
+		select {
+		case <-done:
+			// Every timer is due on the next tick following its scheduling.
+			w.advance()
+			assert.Equal(t, int64(4*n), fired.Load())
+			assert.Zero(t, w.pending.Load())
+			return
+		default:
+			w.advance()
+		}
+	}
+}
@@ -10,17 +10,74 @@ package foxtimeout
 import (
 	"bufio"
 	"bytes"
+	"fmt"
 	"github.com/tigerwill90/fox"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/textproto"
 	"path"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var _ fox.ResponseWriter = (*timeoutWriter)(nil)
+var (
+	_ fox.ResponseWriter = (*timeoutWriter)(nil)
+	_ BufferedWriter     = (*timeoutWriter)(nil)
+	_ fox.ResponseWriter = (*Writer)(nil)
+)
+
+// Writer is the buffered [fox.ResponseWriter] of the middleware, which holds the response until the handler completes
+// and rejects writes after the deadline. It is meant to be embedded in custom writers registered with [WithWriter],
+// which inherit the timeout-safety machinery and extend it with the OnWrite and OnWriteHeader hooks, e.g. to record
+// an audit copy of the response:
+//
+//	type auditWriter struct {
+//		*foxtimeout.Writer
+//		body bytes.Buffer
+//	}
+//
+//	foxtimeout.WithWriter(func(w *foxtimeout.Writer) fox.ResponseWriter {
+//		aw := &auditWriter{Writer: w}
+//		w.OnWrite(func(p []byte) { aw.body.Write(p) })
+//		return aw
+//	})
+//
+// Custom writers should rely on the hooks rather than override the write methods, since the writer also writes
+// through its other methods (e.g. ReadFrom).
+type Writer struct {
+	*timeoutWriter
+}
+
+// OnWrite registers a hook called with the bytes accepted by the writer, i.e. written before the deadline. The hook is
+// called with the lock of the writer held, so it must not call the writer back. It must be registered before the
+// writer is used, typically from the constructor given to [WithWriter].
+func (w *Writer) OnWrite(fn func(p []byte)) {
+	w.onWrite = fn
+}
+
+// OnWriteHeader registers a hook called with the status code accepted by the writer, i.e. the first status code
+// written before the deadline. The same rules as for [Writer.OnWrite] apply.
+func (w *Writer) OnWriteHeader(fn func(code int)) {
+	w.onWriteHeader = fn
+}
+
+// BufferedWriter is implemented by the [fox.ResponseWriter] passed to handlers running behind the middleware. It allows
+// downstream middleware and handlers to make decisions based on the size of the response, e.g. switching to an
+// attachment download or compressing only above a size threshold.
+//
+//	if bw, ok := c.Writer().(foxtimeout.BufferedWriter); ok && bw.BufferedBytes() > threshold {
+//		// ...
+//	}
+type BufferedWriter interface {
+	// BufferedBytes returns the number of bytes written by the handler and not sent yet. It is always zero in
+	// streaming mode, or once the response was sent or the deadline fired.
+	BufferedBytes() int
+}
 
 var copyBufPool = sync.Pool{
 	New: func() any {
@@ -29,20 +86,167 @@ var copyBufPool = sync.Pool{
 	},
 }
 
+// maxPooledBuffer is the largest buffer capacity returned to the pool. Larger buffers, grown by an unusually large
+// response, are left to the garbage collector so that the pool doesn't pin their memory.
+const maxPooledBuffer = 64 * 1024
+
+// maxPresizedBuffer is the largest capacity the buffer is grown to upfront from the Content-Length header set by the
+// handler. It bounds the allocation caused by a wrong header, while larger responses still grow the buffer as they are
+// written.
+const maxPresizedBuffer = 8 << 20
+
 type onlyWrite struct {
 	io.Writer
 }
 
+// WriteAfterTimeoutError is the error returned by writes attempted after the deadline of the request fired. It
+// records the number of bytes dropped since the deadline, which quantifies how much work is wasted after deadlines.
+// The count keeps growing while the abandoned handler keeps writing, so it may be retained, e.g. from the
+// timeout hook, and read later.
+type WriteAfterTimeoutError struct {
+	// Err is the cause of the deadline, typically [http.ErrHandlerTimeout].
+	Err     error
+	dropped atomic.Int64
+}
+
+// Error returns the message of the underlying error.
+func (e *WriteAfterTimeoutError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *WriteAfterTimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// Dropped returns the number of bytes written by the handler after the deadline, which were never sent.
+func (e *WriteAfterTimeoutError) Dropped() int64 {
+	return e.dropped.Load()
+}
+
+// SuperfluousWriteHeaderError is returned by the writes following a superfluous WriteHeader call, if enabled with
+// [WithStrictWriteHeader], so that integration tests catch the bug instead of a log line.
+type SuperfluousWriteHeaderError struct {
+	// Function is the function that made the superfluous call.
+	Function string
+	// File and Line locate the superfluous call.
+	File string
+	Line int
+	// Code is the status code of the superfluous call.
+	Code int
+	// Status is the status code already written.
+	Status int
+}
+
+// Error returns a description of the superfluous call.
+func (e *SuperfluousWriteHeaderError) Error() string {
+	return fmt.Sprintf(
+		"foxtimeout: superfluous WriteHeader(%d) call from %s (%s:%d), status %d already written",
+		e.Code, e.Function, path.Base(e.File), e.Line, e.Status,
+	)
+}
+
+// HeaderLimitError is returned by the writes of a handler whose response headers exceed the limits set with
+// [WithHeaderLimit]. The headers are discarded and a 500 Internal Server Error is sent instead.
+type HeaderLimitError struct {
+	// Count and Size are the number of header values and their total size in bytes, including the keys.
+	Count int
+	Size  int
+	// MaxCount and MaxSize are the limits set with [WithHeaderLimit], zero meaning unbounded.
+	MaxCount int
+	MaxSize  int
+}
+
+// Error returns a description of the exceeded limits.
+func (e *HeaderLimitError) Error() string {
+	return fmt.Sprintf(
+		"foxtimeout: response headers exceed limits, %d values (max %d) totaling %d bytes (max %d)",
+		e.Count, e.MaxCount, e.Size, e.MaxSize,
+	)
+}
+
+type headerLimits struct {
+	count int
+	size  int
+}
+
+// check returns a [*HeaderLimitError] if h exceeds the limits.
+func (l *headerLimits) check(h http.Header) error {
+	var count, size int
+	for k, vv := range h {
+		for _, v := range vv {
+			count++
+			size += len(k) + len(v)
+		}
+	}
+	if l.count > 0 && count > l.count || l.size > 0 && size > l.size {
+		return &HeaderLimitError{Count: count, Size: size, MaxCount: l.count, MaxSize: l.size}
+	}
+	return nil
+}
+
+// hopByHopHeaders are the headers meaningful only for a single transport-level connection, which handlers should never
+// set, see [WithStripHopByHop]. The Trailer header is kept, since handlers use it to announce trailers.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// stripHopByHop removes the hop-by-hop headers from h, including those listed by the Connection header.
+func stripHopByHop(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, k := range hopByHopHeaders {
+		h.Del(k)
+	}
+}
+
 type timeoutWriter struct {
 	w       fox.ResponseWriter
-	err     error
+	err     *WriteAfterTimeoutError
 	headers http.Header
 	req     *http.Request
 	buf     *bytes.Buffer
-	code    int
-	mu      sync.RWMutex
-	written bool
-	n       int
+	late    *lateWrites
+	// stackRate is the fraction of the writes after the deadline whose stack trace is captured, see
+	// [WithWriteStackSampling].
+	stackRate float64
+	route     string
+	code      int
+	mu        sync.RWMutex
+	written   bool
+	closed    bool
+	stream    bool
+	// returned reports whether the handler returned.
+	returned bool
+	// superfluous is called on superfluous WriteHeader calls in strict mode, without the lock held.
+	superfluous func(err *SuperfluousWriteHeaderError)
+	// headerErr is returned by the writes following a superfluous WriteHeader call in strict mode, or headers
+	// exceeding the limits.
+	headerErr error
+	limits    *headerLimits
+	stripHop  bool
+	// lateWrite is called on writes after the deadline in strict mode, with the lock held.
+	lateWrite func(err *WriteAfterTimeoutError)
+	// onWrite and onWriteHeader are the hooks registered with the Writer wrapping this writer, see [WithWriter].
+	onWrite       func(p []byte)
+	onWriteHeader func(code int)
+	// activity is called on each write, with the lock held, see [IdleAfter] and [WithPhases].
+	activity func()
+	// unsampled reports whether the diagnostics of the timeout are skipped, see [WithDiagnosticsSampling].
+	unsampled bool
+	n         int
 }
 
 func (tw *timeoutWriter) Status() int {
@@ -57,18 +261,45 @@ func (tw *timeoutWriter) Size() int {
 	return tw.n
 }
 
+func (tw *timeoutWriter) BufferedBytes() int {
+	tw.mu.RLock()
+	defer tw.mu.RUnlock()
+	if tw.buf == nil || tw.err != nil {
+		return 0
+	}
+	return tw.buf.Len()
+}
+
 func (tw *timeoutWriter) WriteString(s string) (int, error) {
 	tw.mu.Lock()
 	defer tw.mu.Unlock()
 	if tw.err != nil {
-		return 0, tw.err
+		return 0, tw.dropLocked(len(s))
+	}
+	if tw.closed {
+		return 0, ErrWriterReleased
 	}
 	if !tw.written {
 		tw.writeHeaderLocked(http.StatusOK)
 	}
+	if tw.headerErr != nil {
+		return 0, tw.headerErr
+	}
 
-	n, err := io.WriteString(tw.buf, s)
+	var n int
+	var err error
+	if tw.stream {
+		n, err = tw.w.WriteString(s)
+	} else {
+		n, err = io.WriteString(tw.buf, s)
+	}
 	tw.n += n
+	if tw.onWrite != nil && n > 0 {
+		tw.onWrite([]byte(s[:n]))
+	}
+	if tw.activity != nil && n > 0 {
+		tw.activity()
+	}
 	return n, err
 }
 
@@ -84,35 +315,144 @@ func (tw *timeoutWriter) Write(p []byte) (int, error) {
 	tw.mu.Lock()
 	defer tw.mu.Unlock()
 	if tw.err != nil {
-		return 0, tw.err
+		return 0, tw.dropLocked(len(p))
+	}
+	if tw.closed {
+		return 0, ErrWriterReleased
 	}
 	if !tw.written {
 		tw.writeHeaderLocked(http.StatusOK)
 	}
+	if tw.headerErr != nil {
+		return 0, tw.headerErr
+	}
 
-	n, err := tw.buf.Write(p)
+	var n int
+	var err error
+	if tw.stream {
+		n, err = tw.w.Write(p)
+	} else {
+		n, err = tw.buf.Write(p)
+	}
 	tw.n += n
+	if tw.onWrite != nil && n > 0 {
+		tw.onWrite(p[:n])
+	}
+	if tw.activity != nil && n > 0 {
+		tw.activity()
+	}
 	return n, err
 }
 
+// dropLocked records n bytes written after the deadline, and returns the error of the write.
+func (tw *timeoutWriter) dropLocked(n int) error {
+	tw.err.dropped.Add(int64(n))
+	if tw.late != nil {
+		// The stack traces are only captured for the sampled timeouts, see [WithDiagnosticsSampling].
+		rate := tw.stackRate
+		if tw.unsampled {
+			rate = 0
+		}
+		tw.late.record(tw.route, n, rate)
+	}
+	if tw.lateWrite != nil {
+		tw.lateWrite(tw.err)
+	}
+	return tw.err
+}
+
+// release closes the writer, then detaches the buffer and recycles it. It must be called with the lock held, once the
+// buffered response has been sent or the deadline has fired. Writes never reach the buffer afterward, even from
+// a goroutine that outlived the handler, so it can be safely reused by another request.
+func (tw *timeoutWriter) release() {
+	tw.closed = true
+	if tw.buf == nil {
+		return
+	}
+	if tw.buf.Cap() <= maxPooledBuffer {
+		bufp.Put(tw.buf)
+	}
+	tw.buf = nil
+}
+
+// sendHeaderLocked sends the status code and the headers set by the handler to the client. It is used in streaming
+// mode, where the response is not buffered.
+func (tw *timeoutWriter) sendHeaderLocked() {
+	if tw.stripHop {
+		stripHopByHop(tw.headers)
+	}
+	dst := tw.w.Header()
+	for k, vv := range tw.headers {
+		dst[k] = vv
+	}
+	tw.w.WriteHeader(tw.code)
+}
+
 func (tw *timeoutWriter) writeHeaderLocked(code int) {
 	checkWriteHeaderCode(code)
 	switch {
 	case tw.err != nil:
 		return
 	case tw.written:
-		caller := relevantCaller()
+		caller := writeCaller()
 		log.Printf("http: superfluous response.WriteHeader call from %s (%s:%d)", caller.Function, path.Base(caller.File), caller.Line)
+		if tw.superfluous != nil && tw.headerErr == nil {
+			err := &SuperfluousWriteHeaderError{
+				Function: caller.Function,
+				File:     caller.File,
+				Line:     caller.Line,
+				Code:     code,
+				Status:   tw.code,
+			}
+			tw.headerErr = err
+		}
 	default:
+		if tw.limits != nil {
+			if err := tw.limits.check(tw.headers); err != nil {
+				tw.headerErr = err
+				clear(tw.headers)
+				code = http.StatusInternalServerError
+			}
+		}
 		tw.written = true
 		tw.code = code
+		if tw.onWriteHeader != nil {
+			tw.onWriteHeader(code)
+		}
+		if tw.stream {
+			tw.sendHeaderLocked()
+			return
+		}
+		tw.presizeLocked()
+	}
+}
+
+// presizeLocked grows the buffer once to the size declared by the Content-Length header set by the handler, if any,
+// to avoid repeated reallocations for large responses of known size.
+func (tw *timeoutWriter) presizeLocked() {
+	if tw.buf == nil {
+		return
+	}
+	cl, err := strconv.ParseInt(tw.headers.Get("Content-Length"), 10, 64)
+	if err != nil || cl <= 0 {
+		return
+	}
+	if n := int(min(cl, maxPresizedBuffer)); n > tw.buf.Cap() {
+		tw.buf.Grow(n - tw.buf.Len())
 	}
 }
 
 func (tw *timeoutWriter) WriteHeader(code int) {
 	tw.mu.Lock()
-	defer tw.mu.Unlock()
+	prev := tw.headerErr
 	tw.writeHeaderLocked(code)
+	err, superfluous := tw.headerErr.(*SuperfluousWriteHeaderError)
+	tw.mu.Unlock()
+
+	// The report runs user hooks, so it is made without the lock held.
+	if superfluous && prev == nil && tw.superfluous != nil {
+		tw.superfluous(err)
+	}
 }
 
 func (tw *timeoutWriter) ReadFrom(src io.Reader) (n int64, err error) {
@@ -125,7 +465,21 @@ func (tw *timeoutWriter) ReadFrom(src io.Reader) (n int64, err error) {
 }
 
 func (tw *timeoutWriter) FlushError() error {
-	return fox.ErrNotSupported()
+	if !tw.stream {
+		return fox.ErrNotSupported()
+	}
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.err != nil {
+		return tw.err
+	}
+	if tw.closed {
+		return ErrWriterReleased
+	}
+	if !tw.written {
+		tw.writeHeaderLocked(http.StatusOK)
+	}
+	return tw.w.FlushError()
 }
 
 func (tw *timeoutWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {